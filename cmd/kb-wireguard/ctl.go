@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zapu/kb-wireguard/kbwg"
+)
+
+// ctlMain implements subcommands that talk to kb-wireguard daemon through
+// its control socket: up, down, status, peers and reannounce.
+func ctlMain(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	var socketArg string
+	var teamArg string
+	flags.StringVar(&socketArg, "socket", defaultSocketPath(), "Control socket of kb-wireguard daemon.")
+	flags.StringVar(&teamArg, "team", "", "Keybase team name. Can also be passed as the first argument.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kb-wireguard %s [flags] [team]\n", cmd)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if teamArg == "" {
+		teamArg = flags.Arg(0)
+	}
+	if teamArg == "" && cmd != "status" && cmd != "reannounce" {
+		fmt.Fprintf(os.Stderr, "Error: `team` argument is required\n\n")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	client, err := jsonrpc.Dial("unix", socketArg)
+	if err != nil {
+		fail("Failed to connect to daemon on %s, is `kb-wireguard daemon` running? %s", socketArg, err)
+	}
+	defer client.Close()
+
+	if err := runCtlCommand(client, os.Stdout, cmd, teamArg); err != nil {
+		fail("%s", err)
+	}
+}
+
+// runCtlCommand calls daemon method for `cmd` and prints the result to `w`.
+func runCtlCommand(client *rpc.Client, w io.Writer, cmd string, team string) error {
+	call := func(method string, args interface{}, reply interface{}) error {
+		return client.Call(controlServiceName+"."+method, args, reply)
+	}
+	switch cmd {
+	case "up":
+		var status kbwg.TeamStatus
+		if err := call("Up", TeamArgs{Team: team}, &status); err != nil {
+			return err
+		}
+		printTeams(w, []kbwg.TeamStatus{status})
+	case "down":
+		if err := call("Down", TeamArgs{Team: team}, &Empty{}); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Disconnected from team %s\n", team)
+	case "status":
+		var statuses []kbwg.TeamStatus
+		if err := call("Status", Empty{}, &statuses); err != nil {
+			return err
+		}
+		if len(statuses) == 0 {
+			fmt.Fprintf(w, "Not connected to any team networks\n")
+			return nil
+		}
+		printTeams(w, statuses)
+	case "peers":
+		var peers []kbwg.PeerStatus
+		if err := call("Peers", TeamArgs{Team: team}, &peers); err != nil {
+			return err
+		}
+		printPeers(w, peers, time.Now())
+	case "reannounce":
+		if err := call("Reannounce", TeamArgs{Team: team}, &Empty{}); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Announced\n")
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
+
+func printTeams(w io.Writer, statuses []kbwg.TeamStatus) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "TEAM\tDEVICE\tPORT\tADDRESSES\tPUBLIC KEY\tPEERS\n")
+	for _, s := range statuses {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%d/%d active, %d connected\n", s.Team, s.DeviceName, s.ListenPort,
+			strings.Join(s.Addresses, ", "), s.PublicKey, s.ActivePeers, s.Peers, s.ConnectedPeers)
+	}
+	tw.Flush()
+}
+
+func printPeers(w io.Writer, peers []kbwg.PeerStatus, now time.Time) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "PEER\tADDRESSES\tSTATE\tENDPOINT\tLAST HANDSHAKE\tTRANSFER\tLAST ANNOUNCEMENT\n")
+	for _, p := range peers {
+		state := p.State
+		if p.Dynamic {
+			state += " (dynamic)"
+		}
+		endpoint := p.Endpoint
+		if endpoint == "" {
+			endpoint = "-"
+		}
+		transfer := fmt.Sprintf("%s received, %s sent", formatBytes(p.RxBytes), formatBytes(p.TxBytes))
+		fmt.Fprintf(tw, "%s (%s)\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Username, p.Device, strings.Join(p.Addresses, ", "),
+			state, endpoint, timeAgo(p.LastHandshake, now), transfer, timeAgo(p.LastAnnouncement, now))
+	}
+	tw.Flush()
+}
+
+// timeAgo formats `t` as e.g. "35s ago", or "never" if it's zero.
+func timeAgo(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", now.Sub(t).Round(time.Second))
+}
+
+// formatBytes formats byte count like `wg show` does, e.g. "1.50 KiB".
+func formatBytes(n uint64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	unit := -1
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f %s", value, units[unit])
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/zapu/kb-wireguard/kbwg"
+)
+
+// controlServiceName is the name of JSON-RPC service on control socket.
+// Methods are called as "KBWG.<method>", see `ControlService`.
+const controlServiceName = "KBWG"
+
+// defaultSocketPath returns path of control socket of the daemon: in
+// XDG_RUNTIME_DIR if it's set, in temp directory otherwise.
+func defaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "kb-wireguard.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("kb-wireguard-%d.sock", os.Getuid()))
+}
+
+// daemon keeps team networks that were brought up through control socket.
+type daemon struct {
+	// Guards `teams`. Held while a team is brought up or down.
+	sync.Mutex
+
+	api  kbwg.KeybaseClient
+	opts teamOptions
+	ctx  context.Context
+
+	teams map[string]*team
+}
+
+func newDaemon(ctx context.Context, api kbwg.KeybaseClient, opts teamOptions) *daemon {
+	return &daemon{
+		api:   api,
+		opts:  opts,
+		ctx:   ctx,
+		teams: make(map[string]*team),
+	}
+}
+
+// freeIndex returns the lowest team index that is not used, so devices and
+// ports are reused after teams are brought down.
+func (d *daemon) freeIndex() int {
+	used := make(map[int]bool)
+	for _, t := range d.teams {
+		used[t.index] = true
+	}
+	index := 0
+	for used[index] {
+		index++
+	}
+	return index
+}
+
+func (d *daemon) sortedTeams() (ret []*team) {
+	for _, t := range d.teams {
+		ret = append(ret, t)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].index < ret[j].index
+	})
+	return ret
+}
+
+func (d *daemon) findTeam(name string) (*team, error) {
+	t, ok := d.teams[name]
+	if !ok {
+		return nil, fmt.Errorf("not connected to team %q", name)
+	}
+	return t, nil
+}
+
+// up connects to team network `name`.
+func (d *daemon) up(name string) (ret kbwg.TeamStatus, err error) {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.teams[name]; ok {
+		return ret, fmt.Errorf("already connected to team %q", name)
+	}
+	t, err := loadTeam(d.api, name, d.freeIndex(), d.opts)
+	if err != nil {
+		return ret, err
+	}
+	teams := append(d.sortedTeams(), t)
+	var progs []*kbwg.Program
+	for _, other := range teams {
+		progs = append(progs, other.prog)
+	}
+	if collisions := kbwg.TeamNetworkCollisions(progs); len(collisions) > 0 {
+		return ret, fmt.Errorf("team network can't be used with the ones that are up:\n  %s", strings.Join(collisions, "\n  "))
+	}
+	if err := t.start(d.opts, overlayIPs(teams)); err != nil {
+		return ret, err
+	}
+	t.run(d.ctx)
+	d.teams[name] = t
+	fmt.Printf(":: Connected to team @%s\n", name)
+	return t.status(), nil
+}
+
+// down disconnects from team network `name`.
+func (d *daemon) down(name string) error {
+	d.Lock()
+	defer d.Unlock()
+	t, err := d.findTeam(name)
+	if err != nil {
+		return err
+	}
+	t.stop()
+	delete(d.teams, name)
+	fmt.Printf(":: Disconnected from team @%s\n", name)
+	return nil
+}
+
+// downAll disconnects from all team networks.
+func (d *daemon) downAll() {
+	d.Lock()
+	defer d.Unlock()
+	for name, t := range d.teams {
+		t.stop()
+		delete(d.teams, name)
+	}
+}
+
+// serve handles JSON-RPC connections from `listener` until it's closed.
+func (d *daemon) serve(listener net.Listener) {
+	server := rpc.NewServer()
+	if err := server.RegisterName(controlServiceName, &ControlService{d: d}); err != nil {
+		fail("%s", err)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+	}
+}
+
+// listenControlSocket creates the control socket, only accessible by us.
+func listenControlSocket(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("daemon is already running on %s", path)
+	}
+	// Left by a daemon that did not exit cleanly.
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// daemonMain runs kb-wireguard in daemon mode: team networks are brought up
+// and down through control socket, starting with `teams`.
+func daemonMain(api kbwg.KeybaseClient, opts teamOptions, socketPath string, teams []string) {
+	fmt.Printf(":: Starting run-dev launcher... You may be asked for `sudo` password.\n")
+	launcher, err := kbwg.StartDevLauncher()
+	if err != nil {
+		fail("Failed to start run-dev launcher: %s", err)
+	}
+	opts.launcher = launcher
+
+	listener, err := listenControlSocket(socketPath)
+	if err != nil {
+		fail("Failed to listen on control socket: %s", err)
+	}
+	fmt.Printf(":: Listening on control socket: %s\n", socketPath)
+
+	d := newDaemon(context.Background(), api, opts)
+	go d.serve(listener)
+
+	for _, name := range teams {
+		if _, err := d.up(name); err != nil {
+			fmt.Printf("! Failed to connect to team @%s: %s\n", name, err)
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	rotateSigs := make(chan os.Signal, 1)
+	signal.Notify(rotateSigs, syscall.SIGUSR1)
+
+loop:
+	for {
+		select {
+		case <-rotateSigs:
+			d.Lock()
+			for _, t := range d.sortedTeams() {
+				fmt.Printf(":: Rotating WireGuard key of %s...\n", t.deviceName)
+				if err := t.devRun.RotateKey(); err != nil {
+					fmt.Printf("! Failed to rotate key of %s: %s\n", t.deviceName, err)
+				}
+			}
+			d.Unlock()
+		case <-sigs:
+			fmt.Printf("! Stopping on signal...\n")
+			break loop
+		}
+	}
+
+	listener.Close()
+	d.downAll()
+	launcher.Close()
+
+	fmt.Printf(":: kb-wireguard daemon exiting...\n")
+	os.Exit(0)
+}
+
+// ControlService is JSON-RPC API of the daemon.
+type ControlService struct {
+	d *daemon
+}
+
+// TeamArgs are arguments of methods that act on a single team.
+type TeamArgs struct {
+	Team string `json:"team"`
+}
+
+// Empty is used for methods without arguments or results.
+type Empty struct{}
+
+// Up connects to a team network.
+func (s *ControlService) Up(args TeamArgs, reply *kbwg.TeamStatus) (err error) {
+	*reply, err = s.d.up(args.Team)
+	return err
+}
+
+// Down disconnects from a team network.
+func (s *ControlService) Down(args TeamArgs, reply *Empty) error {
+	return s.d.down(args.Team)
+}
+
+// Status returns status of all team networks that are up.
+func (s *ControlService) Status(args Empty, reply *[]kbwg.TeamStatus) error {
+	s.d.Lock()
+	defer s.d.Unlock()
+	statuses := []kbwg.TeamStatus{}
+	for _, t := range s.d.sortedTeams() {
+		statuses = append(statuses, t.status())
+	}
+	*reply = statuses
+	return nil
+}
+
+// Peers returns peers of a team network.
+func (s *ControlService) Peers(args TeamArgs, reply *[]kbwg.PeerStatus) error {
+	s.d.Lock()
+	defer s.d.Unlock()
+	t, err := s.d.findTeam(args.Team)
+	if err != nil {
+		return err
+	}
+	t.prog.Lock()
+	defer t.prog.Unlock()
+	*reply = kbwg.GetPeerStatuses(t.prog.MCtxTODO(), time.Now())
+	return nil
+}
+
+// Reannounce sends our announcement to a team right away, or to all teams
+// if team is empty.
+func (s *ControlService) Reannounce(args TeamArgs, reply *Empty) error {
+	s.d.Lock()
+	defer s.d.Unlock()
+	teams := s.d.sortedTeams()
+	if args.Team != "" {
+		t, err := s.d.findTeam(args.Team)
+		if err != nil {
+			return err
+		}
+		teams = []*team{t}
+	}
+	for _, t := range teams {
+		t.prog.Lock()
+		err := kbwg.SendAnnouncement(t.prog.MCtxTODO())
+		t.prog.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+	"github.com/zapu/kb-wireguard/kbwg"
+)
+
+// stubKeybase is alice's laptop in team "wgteam" with bob, and has just
+// enough for the daemon to load the team and announce. Other methods of
+// KeybaseClient are not implemented and panic.
+type stubKeybase struct {
+	kbwg.KeybaseClient
+	// Messages sent to the announcement channel.
+	sent []string
+}
+
+var stubAnnounceChannel = chat1.ChatChannel{
+	Name:        "wgteam",
+	MembersType: "team",
+	TopicType:   "chat",
+	TopicName:   kbwg.AnnounceChatName,
+}
+
+func (*stubKeybase) LoggedInStatus() (ret kbwg.StatusJSONPart, err error) {
+	ret.Username = "alice"
+	ret.Device.Name = "laptop"
+	ret.Device.DeviceID = "a11ce"
+	return ret, nil
+}
+
+func (*stubKeybase) GetConversations(unreadOnly bool) ([]chat1.ConvSummary, error) {
+	return []chat1.ConvSummary{{Id: "conv", Channel: stubAnnounceChannel}}, nil
+}
+
+func (*stubKeybase) ReadKBFS(path string) ([]byte, error) {
+	if path != "/keybase/team/wgteam/peers.json" {
+		return nil, os.ErrNotExist
+	}
+	return []byte(`[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.2" }
+	]`), nil
+}
+
+func (*stubKeybase) TeamMembers(team string) ([]string, error) {
+	return []string{"alice", "bob"}, nil
+}
+
+func (*stubKeybase) UserDevices(username string) ([]string, error) {
+	return map[string][]string{"alice": {"laptop"}, "bob": {"desktop"}}[username], nil
+}
+
+func (*stubKeybase) SignMessage(msg []byte) (string, error) {
+	return "SIGNED " + string(msg), nil
+}
+
+func (k *stubKeybase) SendMessage(channel chat1.ChatChannel, body string, args ...interface{}) (ret kbchat.SendResponse, err error) {
+	k.sent = append(k.sent, body)
+	msgID := chat1.MessageID(len(k.sent))
+	ret.Result.MessageID = &msgID
+	return ret, nil
+}
+
+func TestControlSocket(t *testing.T) {
+	opts := teamOptions{port: 51820}
+	api := &stubKeybase{}
+	d := newDaemon(context.Background(), api, opts)
+	// Team is loaded but not started, so there is no WireGuard device to
+	// stop when it goes down.
+	tm, err := loadTeam(d.api, "wgteam", d.freeIndex(), opts)
+	require.NoError(t, err)
+	d.teams["wgteam"] = tm
+
+	socketPath := filepath.Join(t.TempDir(), "kbwg.sock")
+	listener, err := listenControlSocket(socketPath)
+	require.NoError(t, err)
+	defer listener.Close()
+	go d.serve(listener)
+
+	// Only one daemon can use the socket.
+	_, err = listenControlSocket(socketPath)
+	require.Error(t, err)
+
+	client, err := jsonrpc.Dial("unix", socketPath)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var statuses []kbwg.TeamStatus
+	require.NoError(t, client.Call("KBWG.Status", Empty{}, &statuses))
+	require.Len(t, statuses, 1)
+	require.Equal(t, "wgteam", statuses[0].Team)
+	require.Equal(t, "kbwg0", statuses[0].DeviceName)
+	require.Equal(t, uint16(51820), statuses[0].ListenPort)
+	require.Equal(t, 1, statuses[0].Peers)
+
+	var peers []kbwg.PeerStatus
+	require.NoError(t, client.Call("KBWG.Peers", TeamArgs{Team: "wgteam"}, &peers))
+	require.Len(t, peers, 1)
+	require.Equal(t, "bob", peers[0].Username)
+	require.False(t, peers[0].Active)
+	require.Equal(t, kbwg.PeerStateInactive, peers[0].State)
+
+	require.NoError(t, client.Call("KBWG.Reannounce", TeamArgs{}, &Empty{}))
+	require.Len(t, api.sent, 1)
+	require.Error(t, client.Call("KBWG.Peers", TeamArgs{Team: "otherteam"}, &peers))
+	require.Error(t, client.Call("KBWG.Down", TeamArgs{Team: "otherteam"}, &Empty{}))
+
+	var out bytes.Buffer
+	require.NoError(t, runCtlCommand(client, &out, "peers", "wgteam"))
+	require.Contains(t, out.String(), "bob (desktop)")
+	require.Contains(t, out.String(), "never")
+
+	require.NoError(t, runCtlCommand(client, &out, "down", "wgteam"))
+	out.Reset()
+	require.NoError(t, runCtlCommand(client, &out, "status", ""))
+	require.Equal(t, "Not connected to any team networks\n", out.String())
+
+	// Socket is not left behind.
+	listener.Close()
+	_, err = net.Dial("unix", socketPath)
+	require.Error(t, err)
+}
@@ -4,17 +4,17 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/zapu/kb-wireguard/kbwg"
 	"github.com/zapu/kb-wireguard/libwireguard"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
-
-	"gortc.io/stun"
 )
 
 func fail(msg string, args ...interface{}) {
@@ -28,59 +28,110 @@ func failUsage(msg string, args ...interface{}) {
 	os.Exit(2)
 }
 
-// WIP
-func stunDial() {
-	fmt.Printf(":: Trying to STUN\n")
-	// Creating a "connection" to STUN server.
-	c, err := stun.Dial("udp", "stun.l.google.com:19302")
-	if err != nil {
-		panic(err)
-	}
-	// Building binding request with random transaction id.
-	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-	// Sending request to STUN server, waiting for response message.
-	if err := c.Do(message, func(res stun.Event) {
-		if res.Error != nil {
-			panic(res.Error)
-		}
-		// Decoding XOR-MAPPED-ADDRESS attribute from message.
-		var xorAddr stun.XORMappedAddress
-		if err := xorAddr.GetFrom(res.Message); err != nil {
-			panic(err)
+// teamsFlag collects values of `-team` flag, which can be repeated or be a
+// comma separated list.
+type teamsFlag []string
+
+func (f *teamsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *teamsFlag) Set(value string) error {
+	for _, team := range strings.Split(value, ",") {
+		if team = strings.TrimSpace(team); team != "" {
+			*f = append(*f, team)
 		}
-		spew.Dump(xorAddr)
-	}); err != nil {
-		panic(err)
 	}
+	return nil
+}
+
+// Subcommands that talk to the daemon, see `ctlMain`.
+var ctlCommands = map[string]bool{
+	"up":         true,
+	"down":       true,
+	"status":     true,
+	"peers":      true,
+	"reannounce": true,
 }
 
 func main() {
 	var err error
 
-	// stunDial()
+	if len(os.Args) > 1 {
+		switch cmd := os.Args[1]; {
+		case cmd == "validate":
+			validateMain(os.Args[2:])
+			return
+		case ctlCommands[cmd]:
+			ctlMain(cmd, os.Args[2:])
+			return
+		}
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
+	daemonMode := len(os.Args) > 1 && os.Args[1] == "daemon"
+	if daemonMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 
 	var endpointArg string
-	var kbTeamArg string
+	var kbTeamArg teamsFlag
 	var portArg int
-	flag.StringVar(&endpointArg, "endpoint", "", "Public endpoint for this machine. Will be announced to other peers.")
-	flag.StringVar(&kbTeamArg, "team", "", "Keybase team name to coordinate peering with. Each team can be considered a separate VPN where team members can connect to each other.")
-	flag.IntVar(&portArg, "port", 51820, "Port to bind to.")
+	var stunArg string
+	var subnetArg string
+	var subnet6Arg string
+	var persistKeyArg bool
+	var rotateKeyArg bool
+	var allowUnsignedArg bool
+	var socketArg string
+	var exitNodeArg string
+	flag.StringVar(&endpointArg, "endpoint", "", "Public endpoint for this machine, or comma separated list of endpoints. Will be announced to other peers along with local interface addresses. If not provided, it's discovered using STUN. With multiple teams, ports are shifted the same way as -port.")
+	flag.Var(&kbTeamArg, "team", "Keybase team name to coordinate peering with. Each team can be considered a separate VPN where team members can connect to each other. Can be repeated to connect to multiple teams, each one gets its own WireGuard device (kbwg0, kbwg1, ...).")
+	flag.IntVar(&portArg, "port", 51820, "Port to bind to. With multiple teams, n-th team uses port + n.")
+	flag.StringVar(&subnetArg, "subnet", "", fmt.Sprintf("Subnet of the team network. Devices that are not in peers.json pick a random address from it. Overrides subnet from peers.json, %s if not provided in either. Only allowed with a single team.", kbwg.DefaultSubnet))
+	flag.StringVar(&subnet6Arg, "subnet6", "", fmt.Sprintf("IPv6 subnet of the team network, used for the prefix length of our ip6 address from peers.json. Overrides subnet6 from peers.json, /%d prefix if not provided in either. Only allowed with a single team.", kbwg.DefaultPrefix6))
+	flag.BoolVar(&persistKeyArg, "persist-key", false, "Keep WireGuard key pair in a root-owned file, so it survives restarts. Send SIGUSR1 to rotate the key while running.")
+	flag.BoolVar(&rotateKeyArg, "rotate-key", false, "Generate new persistent key pair on start, replacing the stored one.")
+	flag.BoolVar(&allowUnsignedArg, "allow-unsigned", false, "Accept announcements that are not signed with Keybase device key of the sender, e.g. from peers running older versions.")
+	flag.StringVar(&stunArg, "stun", strings.Join(kbwg.DefaultSTUNServers, ","), "Comma separated list of STUN servers (host:port) used to discover public endpoint.")
+	flag.StringVar(&socketArg, "socket", defaultSocketPath(), "Control socket of the daemon. Only used in daemon mode.")
+	flag.StringVar(&exitNodeArg, "exit-node", "", "Route all traffic through this peer, \"device\" or \"username/device\". It has to be marked with exit_node in peers.json. Only allowed with a single team.")
 	flag.Parse()
 
-	if endpointArg == "" {
-		failUsage("`endpoint` argument is required")
-	}
-	if kbTeamArg == "" {
+	if len(kbTeamArg) == 0 && !daemonMode {
 		failUsage("`team` argument is required")
 	}
-	endpointHostPortArg := libwireguard.ParseHostPort(endpointArg)
-	if endpointHostPortArg.IsNil() {
-		failUsage("`endpoint` argument has to be host:port")
+	if (len(kbTeamArg) > 1 || daemonMode) && (subnetArg != "" || subnet6Arg != "") {
+		failUsage("`subnet` and `subnet6` can only be used with a single team, set them in peers.json of each team instead")
+	}
+	if (len(kbTeamArg) > 1 || daemonMode) && exitNodeArg != "" {
+		failUsage("`exit-node` can only be used with a single team")
 	}
 
-	prog := &kbwg.Program{}
-	prog.KeybaseTeam = kbTeamArg
-	prog.Endpoint = endpointHostPortArg
+	opts := teamOptions{
+		port:          portArg,
+		subnet:        subnetArg,
+		subnet6:       subnet6Arg,
+		persistKey:    persistKeyArg,
+		rotateKey:     rotateKeyArg,
+		allowUnsigned: allowUnsignedArg,
+		exitNode:      exitNodeArg,
+	}
+	if endpointArg != "" {
+		for _, v := range strings.Split(endpointArg, ",") {
+			endpointHostPortArg := libwireguard.ParseHostPort(strings.TrimSpace(v))
+			if endpointHostPortArg.IsNil() {
+				failUsage("`endpoint` argument has to be a list of host:port")
+			}
+			opts.endpoints = append(opts.endpoints, endpointHostPortArg)
+		}
+	}
+	for _, server := range strings.Split(stunArg, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			opts.stunServers = append(opts.stunServers, server)
+		}
+	}
 
 	var kbc *kbchat.API
 
@@ -91,94 +142,68 @@ func main() {
 
 	fmt.Printf(":: Started Keybase Chat API\n")
 
-	prog.API = kbc
-
-	// fmt.Printf("My username is: %s\n", kbc.GetUsername())
-
-	// res, err := kbc.ListChannels("wgtestteam1")
-	// if err != nil {
-	// 	fail("%s", err)
-	// }
-	// spew.Dump(res)
+	api := kbwg.NewKeybaseClient(kbc)
 
-	err = prog.LoadSelf(context.TODO())
-	if err != nil {
-		fail("%s", err)
-	}
-
-	fmt.Printf(":: We are logged in as: %s (%s)\n", prog.Self.Username, prog.Self.Device)
-	fmt.Printf(":: Trying to peer with team @%s\n", prog.KeybaseTeam)
-
-	announceConv, err := kbwg.AnnounceFindChat(prog.MCtxTODO())
-	if err != nil {
-		fail("didn't find announce conv: %s", err)
-	}
-	prog.AnnounceChannel = announceConv.Channel
-
-	fmt.Printf(":: Found announcement channel: @%s#%s\n", announceConv.Channel.Name, announceConv.Channel.TopicName)
-
-	// Load peers
-	peers, err := kbwg.LoadPeerList(prog.MCtxTODO())
-	if err != nil {
-		fail("%s", err)
+	if daemonMode {
+		daemonMain(api, opts, socketArg, kbTeamArg)
+		return
 	}
 
-	prog.KeybasePeers = make(map[kbwg.KBDev]kbwg.KeybasePeer, len(peers))
-
-	var foundSelf bool
-	for _, peer := range peers {
-		kbPeer, err := peer.MakeKeybasePeer()
-		if err != nil {
-			fail("failed to parse kb peer %v %s:", peer.GetKBDev(), err)
+	var teams []*team
+	var progs []*kbwg.Program
+	seen := make(map[string]bool)
+	for i, name := range kbTeamArg {
+		if seen[name] {
+			failUsage("team %q is passed more than once", name)
 		}
-
-		if peer.Username == prog.Self.Username && peer.Device == prog.Self.Device {
-			if foundSelf {
-				// TODO: be smarter about finding duplicates in peers.json
-				fail("Found self twice???")
-			}
-			foundSelf = true
-			prog.SelfPeer = kbPeer
-		} else {
-			prog.KeybasePeers[kbPeer.Device] = kbPeer
+		seen[name] = true
+		t, err := loadTeam(api, name, i, opts)
+		if err != nil {
+			fail("%s", err)
 		}
+		teams = append(teams, t)
+		progs = append(progs, t.prog)
 	}
 
-	if !foundSelf {
-		fail("Failed to find us in peers.json. Maybe we can't peer with this team. Looking for device: %q", prog.Self.Device)
+	if collisions := kbwg.TeamNetworkCollisions(progs); len(collisions) > 0 {
+		fail("Team networks can't be used together:\n  %s", strings.Join(collisions, "\n  "))
 	}
 
-	fmt.Printf(":: We are: %s\n", prog.SelfPeer.IP)
-	fmt.Printf(":: Found %d other peer(s) in peers.json\n", len(prog.KeybasePeers))
-
-	fmt.Printf(":: Trying to start WireGuard device... You may be asked for `sudo` password.\n")
-
-	devRun, err := kbwg.RunDevRunner(prog.SelfPeer.IP.String(), uint16(portArg))
-	if err != nil {
-		fail("Failed to run dev owner: %s", err)
+	ips := overlayIPs(teams)
+	for _, t := range teams {
+		if err := t.start(opts, ips); err != nil {
+			fail("%s", err)
+		}
 	}
 
-	wgPubKey := <-devRun.PubKeyCh
-	prog.SelfPeer.PublicKey = wgPubKey
-
-	prog.DevRunner = devRun
-
-	go kbwg.AnnouncementsBgTask(prog.MCtxTODO())
-	go kbwg.SelfAnnouncementBgTask(prog.MCtxTODO())
+	for _, t := range teams {
+		t.run(context.Background())
+	}
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	rotateSigs := make(chan os.Signal, 1)
+	signal.Notify(rotateSigs, syscall.SIGUSR1)
 
 loop:
 	for {
 		select {
+		case <-rotateSigs:
+			for _, t := range teams {
+				fmt.Printf(":: Rotating WireGuard key of %s...\n", t.deviceName)
+				if err := t.devRun.RotateKey(); err != nil {
+					fmt.Printf("! Failed to rotate key of %s: %s\n", t.deviceName, err)
+				}
+			}
 		case <-sigs:
 			fmt.Printf("! Stopping on signal...\n")
 			break loop
 		}
 	}
 
-	devRun.Process.Wait()
+	for _, t := range teams {
+		t.stop()
+	}
 
 	fmt.Printf(":: kb-wireguard exiting...\n")
 
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zapu/kb-wireguard/devowner"
+	"github.com/zapu/kb-wireguard/kbwg"
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+// teamOptions are settings from flags that apply to every team.
+type teamOptions struct {
+	port          int
+	endpoints     []libwireguard.HostPort
+	stunServers   []string
+	subnet        string
+	subnet6       string
+	persistKey    bool
+	rotateKey     bool
+	allowUnsigned bool
+	exitNode      string
+	// Starts run-dev processes if set, otherwise they are ran with `sudo`.
+	launcher *kbwg.DevLauncher
+}
+
+// team is one team network we are connected to, with its own WireGuard
+// device.
+type team struct {
+	prog *kbwg.Program
+	// Team number `index` has device kbwg<index> and listens on `-port` +
+	// `index`.
+	index      int
+	port       uint16
+	deviceName string
+	devRun     *kbwg.DevRunnerProcess
+
+	cancel context.CancelFunc
+	tasks  sync.WaitGroup
+}
+
+// loadTeam finds announcement channel of team `name` and loads its
+// peers.json.
+func loadTeam(api kbwg.KeybaseClient, name string, index int, opts teamOptions) (*team, error) {
+	prog := &kbwg.Program{}
+	prog.API = api
+	prog.KeybaseTeam = name
+	prog.ListenPort = uint16(opts.port + index)
+	prog.AllowUnsigned = opts.allowUnsigned
+	prog.ExitNode = opts.exitNode
+	t := &team{
+		prog:       prog,
+		index:      index,
+		port:       prog.ListenPort,
+		deviceName: fmt.Sprintf("kbwg%d", index),
+	}
+
+	err := prog.LoadSelf(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf(":: We are logged in as: %s (%s)\n", prog.Self.Username, prog.Self.Device)
+	fmt.Printf(":: Trying to peer with team @%s using device %s\n", prog.KeybaseTeam, t.deviceName)
+
+	announceConv, err := kbwg.AnnounceFindChat(prog.MCtxTODO())
+	if err != nil {
+		return nil, fmt.Errorf("didn't find announce conv: %w", err)
+	}
+	prog.AnnounceChannel = announceConv.Channel
+
+	fmt.Printf(":: Found announcement channel: @%s#%s\n", announceConv.Channel.Name, announceConv.Channel.TopicName)
+
+	// Load peers
+	peerList, err := kbwg.LoadPeerList(prog.MCtxTODO())
+	if err != nil {
+		return nil, err
+	}
+	prog.Network = peerList.Network
+
+	subnet, subnet6 := opts.subnet, opts.subnet6
+	if subnet == "" {
+		subnet = peerList.Network.Subnet
+	}
+	if subnet6 == "" {
+		subnet6 = peerList.Network.Subnet6
+	}
+	if err := prog.SetSubnets(subnet, subnet6); err != nil {
+		return nil, err
+	}
+	if err := kbwg.CheckPeerList(prog.MCtxTODO(), peerList); err != nil {
+		var listErr *kbwg.PeerListError
+		if errors.As(err, &listErr) {
+			return nil, fmt.Errorf("%w\nRun `kb-wireguard validate -team %s` after fixing it.", err, prog.KeybaseTeam)
+		}
+		fmt.Printf("! %s\n", err)
+	}
+
+	foundSelf, err := prog.SetPeerList(peerList.Peers)
+	if err != nil {
+		return nil, err
+	}
+	exitNode, err := kbwg.FindExitNode(prog)
+	if err != nil {
+		return nil, err
+	}
+
+	if !foundSelf {
+		fmt.Printf(":: We are not in peers.json (looking for device: %q), will pick a dynamic address in %s\n",
+			prog.Self.Device, prog.Subnet)
+		prog.SelfPeer.Device = prog.Self
+
+		// Learn addresses claimed by other dynamic peers first, so we don't
+		// pick one of them.
+		mctx := prog.MCtxTODO()
+		if _, err := kbwg.FindAnnouncements(mctx); err != nil {
+			return nil, fmt.Errorf("Failed to read announcements: %w", err)
+		}
+		kbwg.ResolveAddressConflicts(mctx)
+		if err := kbwg.AllocateSelfAddress(mctx); err != nil {
+			return nil, fmt.Errorf("Failed to allocate dynamic address: %w", err)
+		}
+	}
+
+	fmt.Printf(":: We are: %s\n", strings.Join(prog.SelfAddresses(), ", "))
+	fmt.Printf(":: Found %d other peer(s) in peers.json\n", len(prog.KeybasePeers))
+	if prog.SelfPeer.ExitNode {
+		fmt.Printf(":: We are an exit node\n")
+	}
+	if prog.ExitNode != "" {
+		fmt.Printf(":: Routing all traffic through exit node %s (%s)\n", exitNode.Username, exitNode.Device)
+	}
+	return t, nil
+}
+
+// overlayIPs returns our addresses in all team networks of `teams`.
+func overlayIPs(teams []*team) (ret []net.IP) {
+	for _, t := range teams {
+		ret = append(ret, t.prog.SelfPeer.IP)
+		if t.prog.SelfPeer.IP6 != nil {
+			ret = append(ret, t.prog.SelfPeer.IP6)
+		}
+	}
+	return ret
+}
+
+// start discovers our endpoints for the team and starts its WireGuard
+// device. Addresses in `overlayIPs` are our addresses in all team networks,
+// they are never announced as endpoint candidates.
+func (t *team) start(opts teamOptions, overlayIPs []net.IP) error {
+	prog := t.prog
+	if len(opts.endpoints) > 0 {
+		// Ports of endpoints are shifted for each team, the same way as
+		// listen ports.
+		for _, endpoint := range opts.endpoints {
+			endpoint.Port += uint16(t.index)
+			prog.Endpoints = append(prog.Endpoints, endpoint)
+		}
+	} else {
+		// Has to happen before we start WireGuard device, which will take
+		// the port.
+		fmt.Printf(":: Trying to discover public endpoint using STUN\n")
+		endpoint, err := kbwg.DiscoverEndpoint(opts.stunServers, t.port)
+		if err != nil {
+			return fmt.Errorf("Failed to discover endpoint, try passing `-endpoint` manually: %w", err)
+		}
+		prog.Endpoints = append(prog.Endpoints, endpoint)
+	}
+
+	localEndpoints, err := kbwg.LocalEndpointCandidates(t.port, overlayIPs...)
+	if err != nil {
+		return err
+	}
+	prog.Endpoints = append(prog.Endpoints, localEndpoints...)
+
+	fmt.Printf(":: Our endpoint candidates for team @%s are: %v\n", prog.KeybaseTeam, prog.Endpoints)
+
+	if opts.launcher == nil {
+		fmt.Printf(":: Trying to start WireGuard device %s... You may be asked for `sudo` password.\n", t.deviceName)
+	}
+
+	devRunOpts := kbwg.DevRunnerOptions{
+		DeviceName: t.deviceName,
+		Addresses:  prog.SelfAddresses(),
+		BindPort:   t.port,
+		RotateKey:  opts.rotateKey,
+		Launcher:   opts.launcher,
+	}
+	if opts.persistKey {
+		keyFile, err := devowner.KeyFilePath(prog.KeybaseTeam, prog.SelfDeviceID)
+		if err != nil {
+			return fmt.Errorf("can't persist key: %w", err)
+		}
+		devRunOpts.KeyTeam = prog.KeybaseTeam
+		devRunOpts.KeyDeviceID = prog.SelfDeviceID
+		fmt.Printf(":: Using persistent key file: %s\n", keyFile)
+	}
+
+	devRun, err := kbwg.RunDevRunner(devRunOpts)
+	if err != nil {
+		return fmt.Errorf("Failed to run dev owner: %w", err)
+	}
+
+	select {
+	case wgPubKey := <-devRun.PubKeyCh:
+		prog.SelfPeer.PublicKey = wgPubKey
+	case <-devRun.ExitCh:
+		return fmt.Errorf("run-dev for %s exited before sending public key", t.deviceName)
+	}
+
+	prog.DevRunner = devRun
+	t.devRun = devRun
+	if prog.Network.MTU != 0 || len(prog.Network.DNS) > 0 || prog.SelfPeer.ExitNode {
+		kbwg.SendNetworkSettings(prog.MCtxTODO())
+	}
+	return nil
+}
+
+// run starts background tasks of the team.
+func (t *team) run(ctx context.Context) {
+	ctx, t.cancel = context.WithCancel(ctx)
+	mctx := kbwg.MetaContext{Prog: t.prog, Ctx: ctx}
+	for _, task := range []func(kbwg.MetaContext) error{
+		kbwg.AnnouncementsBgTask,
+		kbwg.SelfAnnouncementBgTask,
+		kbwg.PubKeyBgTask,
+		kbwg.PeerListBgTask,
+		kbwg.KeyRotationBgTask,
+	} {
+		t.tasks.Add(1)
+		go func(task func(kbwg.MetaContext) error) {
+			defer t.tasks.Done()
+			task(mctx)
+		}(task)
+	}
+}
+
+// stop says goodbye to the team, stops background tasks and removes the
+// WireGuard device.
+func (t *team) stop() {
+	if t.cancel != nil {
+		t.cancel()
+		t.tasks.Wait()
+	}
+	t.prog.Lock()
+	if err := kbwg.SendGoodbye(t.prog.MCtxTODO()); err != nil {
+		fmt.Printf("! Failed to say goodbye to team @%s: %s\n", t.prog.KeybaseTeam, err)
+	}
+	t.prog.Unlock()
+	if t.devRun != nil {
+		if err := t.devRun.Stop(); err != nil && !errors.Is(err, kbwg.ErrRunDevExited) {
+			fmt.Printf("! Failed to stop run-dev for %s: %s\n", t.deviceName, err)
+		}
+		t.devRun.Wait()
+	}
+}
+
+// status returns status of the team network.
+func (t *team) status() kbwg.TeamStatus {
+	t.prog.Lock()
+	defer t.prog.Unlock()
+	return kbwg.GetTeamStatus(t.prog.MCtxTODO(), t.deviceName, time.Now())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/zapu/kb-wireguard/kbwg"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+// validateMain implements `kb-wireguard validate`, which checks peers.json
+// and prints all problems found, without starting WireGuard device.
+func validateMain(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	var kbTeamArg string
+	var fileArg string
+	var subnetArg string
+	var subnet6Arg string
+	var offlineArg bool
+	flags.StringVar(&kbTeamArg, "team", "", "Keybase team name to validate peers.json of.")
+	flags.StringVar(&fileArg, "file", "", "Validate local file instead of peers.json in team's KBFS folder, e.g. before uploading it.")
+	flags.StringVar(&subnetArg, "subnet", "", "Subnet of the team network, same as -subnet of kb-wireguard.")
+	flags.StringVar(&subnet6Arg, "subnet6", "", "IPv6 subnet of the team network, same as -subnet6 of kb-wireguard.")
+	flags.BoolVar(&offlineArg, "offline", false, "Don't check team membership and devices of users with Keybase.")
+	flags.Parse(args)
+
+	if kbTeamArg == "" && !(offlineArg && fileArg != "") {
+		fmt.Fprintf(os.Stderr, "Error: `team` argument is required, unless both `-file` and `-offline` are passed\n\n")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	prog := &kbwg.Program{}
+	prog.KeybaseTeam = kbTeamArg
+	if fileArg == "" || !offlineArg {
+		kbc, err := kbchat.Start(kbchat.RunOptions{})
+		if err != nil {
+			fail("Failed to start kbchat: %s", err)
+		}
+		prog.API = kbwg.NewKeybaseClient(kbc)
+		if err := prog.LoadSelf(context.TODO()); err != nil {
+			fail("%s", err)
+		}
+	}
+
+	var peerList kbwg.PeerList
+	var err error
+	if fileArg != "" {
+		var peerBytes []byte
+		peerBytes, err = ioutil.ReadFile(fileArg)
+		if err != nil {
+			fail("%s", err)
+		}
+		peerList, err = kbwg.ParsePeerList(peerBytes)
+	} else {
+		peerList, err = kbwg.LoadPeerList(prog.MCtxTODO())
+	}
+	if err != nil {
+		fail("%s", err)
+	}
+
+	if subnetArg == "" {
+		subnetArg = peerList.Network.Subnet
+	}
+	if subnet6Arg == "" {
+		subnet6Arg = peerList.Network.Subnet6
+	}
+	if err := prog.SetSubnets(subnetArg, subnet6Arg); err != nil {
+		fail("%s", err)
+	}
+
+	problems := kbwg.ValidatePeerList(peerList, prog.Subnet, prog.Subnet6)
+	if !offlineArg {
+		memberProblems, err := kbwg.ValidatePeerListMembers(prog.MCtxTODO(), peerList)
+		if err != nil {
+			fail("Failed to check team members and devices: %s", err)
+		}
+		problems = append(problems, memberProblems...)
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%s\n", kbwg.NewPeerListError(problems))
+		os.Exit(1)
+	}
+	fmt.Printf(":: peers.json is valid (%d peer(s))\n", len(peerList.Peers))
+}
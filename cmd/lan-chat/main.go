@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 
@@ -30,7 +31,7 @@ func makeConns() {
 	var s byte
 	for s = 1; s < 255; s++ {
 		ip := net.IPv4(100, 0, 0, s)
-		conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", ip.String(), Port))
+		conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), strconv.Itoa(Port)))
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to dial to %s: %s\n", ip, err)
 			continue
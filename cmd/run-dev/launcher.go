@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/zapu/kb-wireguard/devowner"
+	"github.com/zapu/kb-wireguard/libpipe"
+)
+
+// deviceNameRe matches names we allow for WireGuard devices. Linux allows up
+// to 15 characters (IFNAMSIZ).
+var deviceNameRe = regexp.MustCompile(`^[a-z0-9_-]{1,15}$`)
+
+// runLauncher starts run-dev processes on request of kb-wireguard daemon,
+// so the daemon only needs `sudo` once, and not every time it connects to a
+// team network. Requests come through named pipe `pipeFilename`, launcher
+// exits when the pipe is closed.
+//
+// Launcher runs as root and requests come from unprivileged process, so
+// requests are checked, and only named pipes owned by the same user as
+// `pipeFilename` are used.
+func runLauncher(pipeFilename string) {
+	exe, err := os.Executable()
+	if err != nil {
+		fail("Failed to find run-dev executable: %s", err)
+	}
+	uid, err := fifoOwner(pipeFilename)
+	if err != nil {
+		fail("Bad launcher pipe: %s", err)
+	}
+
+	msgCh := make(chan libpipe.PipeMsg)
+	go func() {
+		err := messageReaderTask(context.Background(), pipeFilename, msgCh)
+		if err != nil {
+			debug("Error from messageReaderTask: %s", err)
+		}
+		close(msgCh)
+	}()
+
+	for msg := range msgCh {
+		if msg.ID != "launch" {
+			continue
+		}
+		var launch libpipe.LaunchMsg
+		if err := json.Unmarshal([]byte(msg.Payload), &launch); err != nil {
+			debug("Failed to unmarshal launch msg: %s", err)
+			continue
+		}
+		if err := launchRunDev(exe, uid, launch); err != nil {
+			debug("Failed to launch run-dev: %s", err)
+		}
+	}
+	debug("Launcher pipe closed, exiting")
+}
+
+// launchRunDev starts run-dev as requested by `msg`, with output going to
+// named pipes from `msg` that have to be owned by `uid`.
+func launchRunDev(exe string, uid uint32, msg libpipe.LaunchMsg) error {
+	// Requester waits for both pipes to be opened, open them before
+	// anything else can fail, so it gets the error instead of hanging.
+	stdout, err := openUserFifo(msg.Stdout, uid)
+	if err != nil {
+		return fmt.Errorf("failed to open stdout pipe: %w", err)
+	}
+	defer stdout.Close()
+	stderr, err := openUserFifo(msg.Stderr, uid)
+	if err != nil {
+		return fmt.Errorf("failed to open stderr pipe: %w", err)
+	}
+	defer stderr.Close()
+
+	args, err := launchArgs(msg, uid)
+	if err != nil {
+		fmt.Fprintf(stderr, "run-dev launcher: %s\n", err)
+		return err
+	}
+
+	debug("Launching run-dev %v", args)
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(stderr, "run-dev launcher: %s\n", err)
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// launchArgs checks launch request and returns command line arguments for
+// run-dev.
+func launchArgs(msg libpipe.LaunchMsg, uid uint32) ([]string, error) {
+	if _, err := checkUserFifo(msg.Pipe, uid); err != nil {
+		return nil, fmt.Errorf("bad pipe: %w", err)
+	}
+	// Values are given as "-flag=value", so they can't be taken for flags.
+	args := []string{"-pipe=" + msg.Pipe}
+
+	if msg.Device != "" {
+		if !deviceNameRe.MatchString(msg.Device) {
+			return nil, fmt.Errorf("invalid device name %q", msg.Device)
+		}
+		args = append(args, "-dev="+msg.Device)
+	}
+	if len(msg.Addresses) > 0 {
+		addrs, err := parseAddresses(msg.Addresses)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-ip="+strings.Join(addrs, ","))
+	}
+	if msg.Port != 0 {
+		if msg.Port < 1 || msg.Port > 65535 {
+			return nil, fmt.Errorf("invalid port %d", msg.Port)
+		}
+		args = append(args, "-port="+strconv.Itoa(msg.Port))
+	}
+	if msg.KeyTeam != "" || msg.KeyDeviceID != "" {
+		keyFile, err := devowner.KeyFilePath(msg.KeyTeam, msg.KeyDeviceID)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-keyfile="+keyFile)
+	}
+	if msg.RotateKey {
+		args = append(args, "-rotate-key")
+	}
+	return args, nil
+}
+
+// fifoOwner returns owner of named pipe `filename`. Fails if `filename` is
+// not a named pipe, symlinks are not followed.
+func fifoOwner(filename string) (uint32, error) {
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return fifoInfoOwner(filename, fi)
+}
+
+func fifoInfoOwner(filename string, fi os.FileInfo) (uint32, error) {
+	if fi.Mode()&os.ModeType != os.ModeNamedPipe {
+		return 0, fmt.Errorf("%s is not a named pipe", filename)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("can't get owner of %s", filename)
+	}
+	return st.Uid, nil
+}
+
+// checkUserFifo fails unless `filename` is a named pipe owned by `uid`.
+func checkUserFifo(filename string, uid uint32) (os.FileInfo, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("no pipe given")
+	}
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := fifoInfoOwner(filename, fi)
+	if err != nil {
+		return nil, err
+	}
+	if owner != uid {
+		return nil, fmt.Errorf("%s is owned by %d, not %d", filename, owner, uid)
+	}
+	return fi, nil
+}
+
+// openUserFifo opens named pipe `filename` for writing, if it's owned by
+// `uid`. Checks again after opening, in case the file was swapped.
+func openUserFifo(filename string, uid uint32) (*os.File, error) {
+	before, err := checkUserFifo(filename, uid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	after, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !os.SameFile(before, after) {
+		f.Close()
+		return nil, fmt.Errorf("%s changed while opening", filename)
+	}
+	return f, nil
+}
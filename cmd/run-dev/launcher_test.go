@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zapu/kb-wireguard/libpipe"
+)
+
+func TestLaunchArgs(t *testing.T) {
+	dir := t.TempDir()
+	pipe := filepath.Join(dir, "wr.pipe")
+	require.NoError(t, syscall.Mkfifo(pipe, 0600))
+	uid := uint32(os.Getuid())
+
+	msg := libpipe.LaunchMsg{
+		Pipe:        pipe,
+		Device:      "kbwg0",
+		Addresses:   []string{"100.64.1.2", "fd00::2/64"},
+		Port:        51821,
+		KeyTeam:     "Team.Sub",
+		KeyDeviceID: "0123456789abcdef0123456789abcd18",
+		RotateKey:   true,
+	}
+	args, err := launchArgs(msg, uid)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"-pipe=" + pipe,
+		"-dev=kbwg0",
+		"-ip=100.64.1.2/24,fd00::2/64",
+		"-port=51821",
+		"-keyfile=/var/lib/kb-wireguard/keys/team.sub/0123456789abcdef0123456789abcd18.key",
+		"-rotate-key",
+	}, args)
+
+	bad := []func(m *libpipe.LaunchMsg){
+		func(m *libpipe.LaunchMsg) { m.Device = "KBWG0" },
+		func(m *libpipe.LaunchMsg) { m.Device = "kbwg0 -rotate-key" },
+		func(m *libpipe.LaunchMsg) { m.Device = "averyveryverylongname" },
+		func(m *libpipe.LaunchMsg) { m.Addresses = []string{"100.64.1.2,10.0.0.1"} },
+		func(m *libpipe.LaunchMsg) { m.Addresses = []string{"-rotate-key"} },
+		func(m *libpipe.LaunchMsg) { m.Port = -1 },
+		func(m *libpipe.LaunchMsg) { m.Port = 70000 },
+		func(m *libpipe.LaunchMsg) { m.KeyTeam = "../../etc" },
+		func(m *libpipe.LaunchMsg) { m.KeyDeviceID = "../shadow" },
+		func(m *libpipe.LaunchMsg) { m.KeyTeam = "" },
+		func(m *libpipe.LaunchMsg) { m.Pipe = "" },
+		func(m *libpipe.LaunchMsg) { m.Pipe = filepath.Join(dir, "missing") },
+	}
+	for i, f := range bad {
+		m := msg
+		f(&m)
+		_, err := launchArgs(m, uid)
+		require.Error(t, err, "case %d", i)
+	}
+
+	// Pipe has to be owned by the requester.
+	_, err = launchArgs(msg, uid+1)
+	require.Error(t, err)
+}
+
+func TestCheckUserFifo(t *testing.T) {
+	dir := t.TempDir()
+	uid := uint32(os.Getuid())
+
+	pipe := filepath.Join(dir, "out.pipe")
+	require.NoError(t, syscall.Mkfifo(pipe, 0600))
+	_, err := checkUserFifo(pipe, uid)
+	require.NoError(t, err)
+	_, err = checkUserFifo(pipe, uid+1)
+	require.Error(t, err)
+
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+	_, err = checkUserFifo(file, uid)
+	require.Error(t, err)
+	_, err = openUserFifo(file, uid)
+	require.Error(t, err)
+
+	link := filepath.Join(dir, "link.pipe")
+	require.NoError(t, os.Symlink(pipe, link))
+	_, err = checkUserFifo(link, uid)
+	require.Error(t, err)
+	_, err = openUserFifo(link, uid)
+	require.Error(t, err)
+
+	owner, err := fifoOwner(pipe)
+	require.NoError(t, err)
+	require.Equal(t, uid, owner)
+}
@@ -2,15 +2,15 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
-	"os/exec"
 	"os/signal"
+	"reflect"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -42,20 +42,9 @@ wg syncconf kbwg0 kbwg0.conf
 
 */
 
-const deviceName = "kbwg0"
-
-func sudoExec(name string, args ...string) ([]byte, error) {
-	var stdout, stderr bytes.Buffer
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		cmdStr := fmt.Sprintf("%s %s", name, strings.Join(args, " "))
-		fmt.Fprintf(os.Stderr, "Command %q stderr:\n%s\n", cmdStr, stderr.String())
-		return nil, fmt.Errorf("exec %q: %w", cmdStr, err)
-	}
-	return stdout.Bytes(), nil
-}
+// Name of WireGuard device, set with `-dev` flag. Every team network that
+// kb-wireguard connects to has its own device.
+var deviceName = "kbwg0"
 
 func fail(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
@@ -70,18 +59,34 @@ func serializeToStdout(id string, payload interface{}) {
 	fmt.Printf("%s\n", msg)
 }
 
+func replyToStdout(seq uint64, payload interface{}, replyErr error) {
+	msg, err := libpipe.SerializeReply(seq, payload, replyErr)
+	if err != nil {
+		fail("libpipe fail: %s", err)
+	}
+	fmt.Printf("%s\n", msg)
+}
+
 func debug(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
 }
 
 func messageReaderTask(ctx context.Context, pipeFilename string, ch chan libpipe.PipeMsg) error {
-	fd, err := os.OpenFile(pipeFilename, os.O_RDONLY, os.ModeNamedPipe)
+	fd, err := os.OpenFile(pipeFilename, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return err
 	}
 
 	defer fd.Close()
 
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeType != os.ModeNamedPipe {
+		return fmt.Errorf("%s is not a named pipe", pipeFilename)
+	}
+
 	stdinReader := bufio.NewReader(fd)
 
 	debug("Opened read side of pipe %s", pipeFilename)
@@ -105,67 +110,467 @@ func messageReaderTask(ctx context.Context, pipeFilename string, ch chan libpipe
 }
 
 type DeviceOwnerProgram struct {
-	IPAddress string
-
-	ConfigFilename string
-	Config         libwireguard.WireguardConfig
+	// Addresses of the device in CIDR notation.
+	Addresses []string
+	// Routes to peer subnets that are not covered by `Addresses`.
+	Routes []string
+	// Default routes (0.0.0.0/0, ::/0) through the device, when one of the
+	// peers is our exit node.
+	DefaultRoutes []string
+	// Subnets forwarded and masqueraded when we are an exit node.
+	ExitSubnets []string
+	// Network settings (MTU, DNS) from kb-wireguard.
+	Network libpipe.NetworkMsg
+
+	Device devowner.Device
+	Config libwireguard.WireguardConfig
+
+	// Private key is persisted in that file if not empty.
+	KeyFilename string
+	// Key pair for scheduled rotation, prepared by `prepare-key` and used
+	// by the next `rotate-key`. Zero if none.
+	NextKey libwireguard.WireguardPrivKey
 
 	signals chan os.Signal
 	msgCh   chan libpipe.PipeMsg
+	// Closed when kb-wireguard closes the pipe, e.g. because it exited.
+	pipeClosedCh chan struct{}
 }
 
 func (prog *DeviceOwnerProgram) mainLoop() {
+	statsTicker := time.NewTicker(5 * time.Second)
+	defer statsTicker.Stop()
+
 	for {
 		select {
+		case <-statsTicker.C:
+			prog.reportStats()
 		case <-prog.signals:
 			debug("Stopping on signal...")
 			return
+		case <-prog.pipeClosedCh:
+			debug("Pipe closed, stopping...")
+			return
 		case msg := <-prog.msgCh:
-			debug("Got msg: %s %d", string(msg.Payload), len(string(msg.Payload)))
-			if msg.ID == "peers" {
-				err := prog.handlePeersMessage(msg)
-				if err != nil {
-					debug("Failed to handler peers msg:", err)
-				}
+			// Payload is not logged, peer lists have preshared keys.
+			debug("Got msg: %s %d", msg.ID, len(msg.Payload))
+			reply, err := prog.handleMessage(msg)
+			if err != nil {
+				debug("Failed to handle %s msg: %s", msg.ID, err)
+			}
+			if msg.Seq != 0 {
+				replyToStdout(msg.Seq, reply, err)
+			}
+			if msg.ID == "stop" {
+				debug("Stopping on request...")
+				return
 			}
 		}
 	}
 }
 
+// handleMessage handles message from kb-wireguard. Returned reply payload or
+// error is sent back if the message was a request.
+func (prog *DeviceOwnerProgram) handleMessage(msg libpipe.PipeMsg) (reply interface{}, err error) {
+	switch msg.ID {
+	case "hello":
+		return handleHelloMessage(msg)
+	case "peers":
+		return nil, prog.handlePeersMessage(msg)
+	case "prepare-key":
+		return prog.prepareKey()
+	case "rotate-key":
+		return nil, prog.rotateKey()
+	case "address":
+		return nil, prog.handleAddressMessage(msg)
+	case "network":
+		return nil, prog.handleNetworkMessage(msg)
+	case "stop":
+		// Handled by mainLoop.
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown message %q", msg.ID)
+	}
+}
+
+// handleHelloMessage checks that kb-wireguard speaks the same protocol
+// version as we do.
+func handleHelloMessage(msg libpipe.PipeMsg) (interface{}, error) {
+	var hello libpipe.HelloMsg
+	err := json.Unmarshal([]byte(msg.Payload), &hello)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	if hello.Version != libpipe.ProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d, run-dev speaks version %d",
+			hello.Version, libpipe.ProtocolVersion)
+	}
+	return libpipe.HelloMsg{Version: libpipe.ProtocolVersion}, nil
+}
+
+// reportStats sends runtime state of peers upstream, so kb-wireguard can
+// tell which peer endpoints work and report it in status.
+func (prog *DeviceOwnerProgram) reportStats() {
+	msg, err := prog.readStats()
+	if err != nil {
+		debug("Failed to get peer stats: %s", err)
+		return
+	}
+	serializeToStdout("stats", msg)
+}
+
+func (prog *DeviceOwnerProgram) readStats() (ret libpipe.StatsMsg, err error) {
+	stats, err := prog.Device.Stats()
+	if err != nil {
+		return ret, err
+	}
+	ret.Peers = make([]libpipe.PeerStats, 0, len(stats))
+	for _, peer := range stats {
+		ret.Peers = append(ret.Peers, libpipe.PeerStats{
+			PublicKey:     peer.PublicKey.Base64(),
+			Endpoint:      peer.Endpoint,
+			LastHandshake: peer.LastHandshake,
+			RxBytes:       peer.RxBytes,
+			TxBytes:       peer.TxBytes,
+		})
+	}
+	return ret, nil
+}
+
 func (prog *DeviceOwnerProgram) handlePeersMessage(msg libpipe.PipeMsg) error {
 	var newPeers []libwireguard.WireguardPeer
 	err := json.Unmarshal([]byte(msg.Payload), &newPeers)
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal: %w", err)
 	}
-	prog.Config.Peers = newPeers
-	return prog.flushConfig()
+	newConfig := prog.Config
+	newConfig.Peers = newPeers
+	// Marks our encrypted packets, so they are not routed back into the
+	// device by default routes.
+	newConfig.FwMark = 0
+	if len(defaultRoutes(newPeers)) > 0 {
+		newConfig.FwMark = prog.routeTable()
+	}
+	if diff := libwireguard.DiffConfigs(prog.Config, newConfig); !diff.IsEmpty() {
+		debug("Peers changed:\n%s", diff)
+	}
+	prog.Config = newConfig
+	if err := prog.flushConfig(); err != nil {
+		return err
+	}
+	if err := prog.syncRoutes(); err != nil {
+		return err
+	}
+	return prog.syncDefaultRoutes()
 }
 
-func (prog *DeviceOwnerProgram) flushConfig() error {
-	cfgFile, err := os.OpenFile(prog.ConfigFilename, os.O_WRONLY, 0)
+// peerRoutes returns allowed IPs of peers that are not in networks of device
+// addresses. These need routes through the device. Default routes are left
+// out, see `defaultRoutes`.
+func peerRoutes(addresses []string, peers []libwireguard.WireguardPeer) (ret []string) {
+	var addrNets []*net.IPNet
+	for _, addr := range addresses {
+		if _, ipNet, err := net.ParseCIDR(addr); err == nil {
+			addrNets = append(addrNets, ipNet)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			if !strings.Contains(allowedIP, "/") {
+				// Bare address is a host route.
+				if strings.Contains(allowedIP, ":") {
+					allowedIP += "/128"
+				} else {
+					allowedIP += "/32"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(allowedIP)
+			if err != nil {
+				continue
+			}
+			if ones, _ := ipNet.Mask.Size(); ones == 0 {
+				continue
+			}
+			if covered(addrNets, ipNet) || seen[ipNet.String()] {
+				continue
+			}
+			seen[ipNet.String()] = true
+			ret = append(ret, ipNet.String())
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// defaultRoutes returns default routes (0.0.0.0/0, ::/0) in allowed IPs of
+// peers, which is what exit nodes have.
+func defaultRoutes(peers []libwireguard.WireguardPeer) (ret []string) {
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			ipNet, err := libwireguard.ParseAllowedIP(allowedIP)
+			if err != nil {
+				continue
+			}
+			if ones, _ := ipNet.Mask.Size(); ones == 0 && !seen[ipNet.String()] {
+				seen[ipNet.String()] = true
+				ret = append(ret, ipNet.String())
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// routeTable returns routing table, and fwmark, used for default routes.
+// Devices of different teams listen on different ports, so it's unique.
+func (prog *DeviceOwnerProgram) routeTable() uint32 {
+	if prog.Config.ListenPort == 0 {
+		return 51820
+	}
+	return uint32(prog.Config.ListenPort)
+}
+
+// covered returns true if `ipNet` is inside one of `nets`.
+func covered(nets []*net.IPNet, ipNet *net.IPNet) bool {
+	ones, bits := ipNet.Mask.Size()
+	for _, n := range nets {
+		nOnes, nBits := n.Mask.Size()
+		if bits == nBits && ones >= nOnes && n.Contains(ipNet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncRoutes makes sure there are routes for all peer subnets.
+func (prog *DeviceOwnerProgram) syncRoutes() error {
+	routes := peerRoutes(prog.Addresses, prog.Config.Peers)
+	if reflect.DeepEqual(routes, prog.Routes) {
+		return nil
+	}
+	if err := prog.Device.SetRoutes(routes); err != nil {
+		return fmt.Errorf("failed to set routes: %w", err)
+	}
+	prog.Routes = routes
+	debug("Set routes to %v", routes)
+	return nil
+}
+
+// syncDefaultRoutes routes all traffic through the device if one of the
+// peers is our exit node, and restores routing if it no longer is.
+func (prog *DeviceOwnerProgram) syncDefaultRoutes() error {
+	routes := defaultRoutes(prog.Config.Peers)
+	if reflect.DeepEqual(routes, prog.DefaultRoutes) {
+		return nil
+	}
+	if err := prog.Device.SetDefaultRoutes(routes, prog.routeTable()); err != nil {
+		return fmt.Errorf("failed to set default routes: %w", err)
+	}
+	prog.DefaultRoutes = routes
+	debug("Set default routes to %v", routes)
+	return nil
+}
+
+// syncExitNode forwards traffic from networks of device addresses if we are
+// an exit node, and stops if we no longer are.
+func (prog *DeviceOwnerProgram) syncExitNode() error {
+	var subnets []string
+	if prog.Network.ExitNode {
+		for _, addr := range prog.Addresses {
+			if _, ipNet, err := net.ParseCIDR(addr); err == nil {
+				subnets = append(subnets, ipNet.String())
+			}
+		}
+	}
+	if reflect.DeepEqual(subnets, prog.ExitSubnets) {
+		return nil
+	}
+	if err := prog.Device.SetExitNode(subnets); err != nil {
+		return fmt.Errorf("failed to set up exit node: %w", err)
+	}
+	prog.ExitSubnets = subnets
+	debug("Forwarding traffic from %v", subnets)
+	return nil
+}
+
+// handleNetworkMessage applies MTU and DNS settings from peers.json.
+func (prog *DeviceOwnerProgram) handleNetworkMessage(msg libpipe.PipeMsg) error {
+	var network libpipe.NetworkMsg
+	err := json.Unmarshal([]byte(msg.Payload), &network)
 	if err != nil {
+		return fmt.Errorf("failed to unmarshal: %w", err)
+	}
+
+	mtu, currentMTU := network.MTU, prog.Network.MTU
+	if mtu == 0 {
+		mtu = devowner.DefaultMTU
+	}
+	if currentMTU == 0 {
+		currentMTU = devowner.DefaultMTU
+	}
+	if mtu != currentMTU {
+		if err := prog.Device.SetMTU(mtu); err != nil {
+			return fmt.Errorf("failed to set MTU: %w", err)
+		}
+		debug("Set MTU to %d", mtu)
+	}
+	prog.Network.MTU = network.MTU
+
+	if !reflect.DeepEqual(network.DNS, prog.Network.DNS) {
+		if len(network.DNS) > 0 {
+			err = devowner.SetDNS(prog.Device.Name(), network.DNS)
+		} else {
+			err = devowner.ClearDNS(prog.Device.Name())
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set DNS: %w", err)
+		}
+		debug("Set DNS servers to %v", network.DNS)
+	}
+	prog.Network.DNS = network.DNS
+
+	prog.Network.ExitNode = network.ExitNode
+	return prog.syncExitNode()
+}
+
+// prepareKey generates key pair for scheduled rotation, without using it
+// yet, and returns its public key. Returns the same key until it's used.
+func (prog *DeviceOwnerProgram) prepareKey() (libwireguard.WireguardPubKey, error) {
+	if prog.NextKey.IsZero() {
+		privKey, err := libwireguard.GeneratePrivKey()
+		if err != nil {
+			return libwireguard.WireguardPubKey{}, err
+		}
+		prog.NextKey = privKey
+		debug(":: Prepared next key, pub key: %s", privKey.PublicKey())
+	}
+	return prog.NextKey.PublicKey(), nil
+}
+
+// rotateKey switches to key pair from `prepareKey`, or generates a new one,
+// applies it to the device, persists it and sends the new public key
+// upstream. Keeps the previous key if any of that fails.
+func (prog *DeviceOwnerProgram) rotateKey() error {
+	privKey := prog.NextKey
+	if privKey.IsZero() {
+		var err error
+		privKey, err = libwireguard.GeneratePrivKey()
+		if err != nil {
+			return err
+		}
+	}
+	// Device has to use the key before it's persisted, otherwise a failure
+	// would leave us with a key file that doesn't match the device.
+	prevKey := prog.Config.PrivateKey
+	prog.Config.PrivateKey = privKey
+	if err := prog.flushConfig(); err != nil {
+		prog.Config.PrivateKey = prevKey
 		return err
 	}
-	if _, err := cfgFile.Write([]byte(libwireguard.SerializeConfig(prog.Config))); err != nil {
-		return fmt.Errorf("failed to Write: %w", err)
+	if prog.KeyFilename != "" {
+		if err := devowner.SaveKey(prog.KeyFilename, privKey); err != nil {
+			// Go back to the key that's persisted and that peers know.
+			prog.Config.PrivateKey = prevKey
+			if err := prog.flushConfig(); err != nil {
+				debug("Failed to restore previous key: %s", err)
+			}
+			return err
+		}
 	}
+	pubKey := privKey.PublicKey()
+	prog.NextKey = libwireguard.WireguardPrivKey{}
+	debug(":: Rotated key, new pub key: %s", pubKey)
+	serializeToStdout("pubkey", pubKey)
+	return nil
+}
 
-	cfgFile.WriteString(fmt.Sprintf("\n# Config edited at: %s\n", time.Now().Local()))
+// Prefix lengths for addresses that come without one.
+const (
+	defaultPrefix4 = 24
+	defaultPrefix6 = 64
+)
 
-	if err := cfgFile.Close(); err != nil {
-		return fmt.Errorf("failed to Close: %w", err)
+// parseAddresses validates device addresses, adding default prefix length to
+// those that don't have one.
+func parseAddresses(addrs []string) (ret []string, err error) {
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", addr)
+			}
+			if ip.To4() != nil {
+				addr = fmt.Sprintf("%s/%d", addr, defaultPrefix4)
+			} else {
+				addr = fmt.Sprintf("%s/%d", addr, defaultPrefix6)
+			}
+		}
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+		}
+		ret = append(ret, addr)
 	}
+	return ret, nil
+}
 
-	_, err = sudoExec("wg", "syncconf", "kbwg0", prog.ConfigFilename)
+// handleAddressMessage replaces addresses of the device. Happens when
+// kb-wireguard has a dynamic address and it had to pick a new one.
+func (prog *DeviceOwnerProgram) handleAddressMessage(msg libpipe.PipeMsg) error {
+	var newAddresses []string
+	err := json.Unmarshal([]byte(msg.Payload), &newAddresses)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	newAddresses, err = parseAddresses(newAddresses)
+	if err != nil {
+		return err
+	}
+	err = prog.Device.SetAddresses(newAddresses)
 	if err != nil {
-		return fmt.Errorf("failed to 'wg syncconf': %w", err)
+		return fmt.Errorf("failed to set address: %w", err)
 	}
+	prog.Addresses = newAddresses
+	debug("Changed ip addresses to %v", newAddresses)
+	if err := prog.syncRoutes(); err != nil {
+		return err
+	}
+	return prog.syncExitNode()
+}
 
-	debug("syncconf successful")
+func (prog *DeviceOwnerProgram) flushConfig() error {
+	err := prog.Device.SetConfig(prog.Config)
+	if err != nil {
+		return err
+	}
+
+	debug("Config sync successful")
 	return nil
 }
 
+// makeDevice creates WireGuard device using `backend`. If netlink backend
+// doesn't work, falls back to the shell one.
+func makeDevice(backend string) (devowner.Device, error) {
+	dev, err := devowner.NewDevice(backend, deviceName)
+	if err == nil {
+		err = dev.Create()
+		if err == nil {
+			return dev, nil
+		}
+	}
+	if backend != "netlink" {
+		return nil, err
+	}
+	debug("Failed to use netlink device backend, falling back to shell: %s", err)
+	dev = devowner.NewShellDevice(deviceName)
+	if err := dev.Create(); err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
 func main() {
 	debug(`Hello from device runner ("run-dev"): %d %d`, os.Getuid(), os.Geteuid())
 	if os.Getuid() != 0 {
@@ -173,14 +578,47 @@ func main() {
 	}
 
 	var pipeFilename string
-	var initialIPAddress string
+	var initialAddresses string
 	var portArg int
+	var keyFilename string
+	var rotateKeyArg bool
+	var backendArg string
+	var launcherArg bool
 	flag.IntVar(&portArg, "port", 51820, "")
 	flag.StringVar(&pipeFilename, "pipe", "", "")
-	flag.StringVar(&initialIPAddress, "ip", "", "")
+	flag.StringVar(&initialAddresses, "ip", "", "Comma separated list of device addresses in CIDR notation. Addresses without prefix length get /24 (IPv4) or /64 (IPv6).")
+	flag.StringVar(&keyFilename, "keyfile", "", "")
+	flag.BoolVar(&rotateKeyArg, "rotate-key", false, "")
+	flag.StringVar(&deviceName, "dev", deviceName, "Name of WireGuard device to create.")
+	flag.StringVar(&backendArg, "backend", "netlink", "Device backend: netlink or shell (uses `ip` and `wg` commands)")
+	flag.BoolVar(&launcherArg, "launcher", false, "Don't create a device, start other run-dev processes when asked through the pipe instead.")
 	flag.Parse()
 
-	privKey, pubKey, err := devowner.WireguardGenKey()
+	if launcherArg {
+		if pipeFilename == "" {
+			fail("-launcher needs -pipe")
+		}
+		runLauncher(pipeFilename)
+		return
+	}
+
+	var addrs []string
+	var err error
+	if initialAddresses != "" {
+		addrs, err = parseAddresses(strings.Split(initialAddresses, ","))
+		if err != nil {
+			fail("%s", err)
+		}
+	}
+
+	var privKey libwireguard.WireguardPrivKey
+	var pubKey libwireguard.WireguardPubKey
+	if keyFilename != "" && !rotateKeyArg {
+		debug(":: Loading key from: %s", keyFilename)
+		privKey, pubKey, err = devowner.LoadOrGenerateKey(keyFilename)
+	} else {
+		privKey, pubKey, err = devowner.GenerateAndSaveKey(keyFilename)
+	}
 	if err != nil {
 		fail("%s", err)
 	}
@@ -191,6 +629,7 @@ func main() {
 	serializeToStdout("pubkey", pubKey)
 
 	prog := &DeviceOwnerProgram{}
+	prog.KeyFilename = keyFilename
 
 	var conf libwireguard.WireguardConfig
 	conf.PrivateKey = privKey
@@ -203,54 +642,32 @@ func main() {
 	prog.signals = make(chan os.Signal, 1)
 	signal.Notify(prog.signals, syscall.SIGINT, syscall.SIGTERM)
 
-	tmpfile, err := ioutil.TempFile("", fmt.Sprintf("%s.*.conf", deviceName))
-	if err != nil {
-		fail("%s", err)
-	}
-
-	prog.ConfigFilename = tmpfile.Name()
-
-	debug(":: Config filename: %s", tmpfile.Name())
-	defer os.Remove(tmpfile.Name())
-
-	if _, err := tmpfile.Write([]byte(libwireguard.SerializeConfig(conf))); err != nil {
-		fail("%s", err)
-	}
-	if err := tmpfile.Close(); err != nil {
-		fail("%s", err)
-	}
-
 	debug("Setting up device %s", deviceName)
 
-	_, err = sudoExec("ip", "link", "add", "dev", deviceName, "type", "wireguard")
+	prog.Device, err = makeDevice(backendArg)
 	if err != nil {
 		fail("%s", err)
 	}
 
-	_, err = sudoExec("wg", "setconf", "kbwg0", tmpfile.Name())
+	err = prog.Device.SetConfig(conf)
 	if err != nil {
-		// fail("%s", err)
-		debug("Failed to setconf: %s", err)
+		debug("Failed to set config: %s", err)
 	}
 
-	if initialIPAddress != "" {
-		ipAddr := initialIPAddress + "/24"
-		_, err = sudoExec("ip", "address", "add", "dev", deviceName, ipAddr)
+	if len(addrs) > 0 {
+		err = prog.Device.SetAddresses(addrs)
 		if err != nil {
 			debug("Failed to set ip: %s", err)
 		} else {
-			debug("Set ip address to %s", ipAddr)
-		}
-
-		_, err = sudoExec("ip", "link", "set", "up", "dev", deviceName)
-		if err != nil {
-			debug("failed to bring the interface up: %s", err)
+			prog.Addresses = addrs
+			debug("Set ip addresses to %v", addrs)
 		}
 	} else {
 		debug("-ip flag not provided, not setting ip address")
 	}
 
 	prog.msgCh = make(chan libpipe.PipeMsg)
+	prog.pipeClosedCh = make(chan struct{})
 	readCtx, cancelRead := context.WithCancel(context.Background())
 	if pipeFilename != "" {
 		go func() {
@@ -258,6 +675,7 @@ func main() {
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error from messageReaderTask: %s\n", err)
 			}
+			close(prog.pipeClosedCh)
 		}()
 	} else {
 		debug("Pipe filename not provided - no messages will be received, but continuing anyway.")
@@ -266,9 +684,24 @@ func main() {
 	prog.mainLoop()
 
 	cancelRead()
+	if len(prog.DefaultRoutes) > 0 {
+		if err := prog.Device.SetDefaultRoutes(nil, 0); err != nil {
+			debug("Failed to remove default routes: %s", err)
+		}
+	}
+	if len(prog.ExitSubnets) > 0 {
+		if err := prog.Device.SetExitNode(nil); err != nil {
+			debug("Failed to stop forwarding: %s", err)
+		}
+	}
+	if len(prog.Network.DNS) > 0 {
+		if err := devowner.ClearDNS(deviceName); err != nil {
+			debug("Failed to remove DNS servers: %s", err)
+		}
+	}
 	debug("Removing device %s", deviceName)
 
-	_, err = sudoExec("ip", "link", "delete", "dev", deviceName)
+	err = prog.Device.Delete()
 	if err != nil {
 		fail("%s", err)
 	}
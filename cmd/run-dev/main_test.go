@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zapu/kb-wireguard/devowner"
+	"github.com/zapu/kb-wireguard/libpipe"
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+func mustParsePubKey(str string) libwireguard.WireguardPubKey {
+	key, err := libwireguard.ParsePubKey(str)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+var (
+	testKey1 = mustParsePubKey("LhdznlMunOticjwvG+WdHk2f9aYGvXugcrDhG2MJeBA=")
+	testKey2 = mustParsePubKey("jc+Ipv9/W4B6WD/EuVsFMVQjMcBYFfiw5NJD28ffqzE=")
+)
+
+func makeTestProgram(t *testing.T) (*DeviceOwnerProgram, *devowner.FakeDevice) {
+	dev := devowner.NewFakeDevice(deviceName)
+	require.NoError(t, dev.Create())
+	privKey, err := libwireguard.GeneratePrivKey()
+	require.NoError(t, err)
+	prog := &DeviceOwnerProgram{
+		Device: dev,
+		Config: libwireguard.WireguardConfig{
+			ListenPort: 51820,
+			PrivateKey: privKey,
+		},
+	}
+	return prog, dev
+}
+
+func makePipeMsg(t *testing.T, id string, payload interface{}) (ret libpipe.PipeMsg) {
+	str, err := libpipe.SerializeMsgInterface(id, payload)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(str), &ret))
+	return ret
+}
+
+func TestHandlePeersMessage(t *testing.T) {
+	prog, dev := makeTestProgram(t)
+
+	peers := []libwireguard.WireguardPeer{
+		{PublicKey: testKey1, AllowedIPs: []string{"100.0.0.2/32", "fd00::2/128"}, Endpoint: "192.168.0.164:51820"},
+		{PublicKey: testKey2, AllowedIPs: []string{"100.0.0.3/32"}, Endpoint: "94.130.0.10:7321"},
+	}
+	err := prog.handlePeersMessage(makePipeMsg(t, "peers", peers))
+	require.NoError(t, err)
+
+	conf, ok := dev.LastConfig()
+	require.True(t, ok)
+	require.Equal(t, peers, conf.Peers)
+	// Interface part of config is kept.
+	require.Equal(t, uint16(51820), conf.ListenPort)
+	require.Equal(t, prog.Config.PrivateKey, conf.PrivateKey)
+
+	// Peer list is replaced, not merged.
+	err = prog.handlePeersMessage(makePipeMsg(t, "peers", peers[1:]))
+	require.NoError(t, err)
+	conf, _ = dev.LastConfig()
+	require.Equal(t, peers[1:], conf.Peers)
+	require.Len(t, dev.Configs, 2)
+
+	// Garbage is rejected without touching the device.
+	err = prog.handlePeersMessage(libpipe.PipeMsg{ID: "peers", Payload: "{not json"})
+	require.Error(t, err)
+	require.Len(t, dev.Configs, 2)
+
+	// So are malformed keys.
+	err = prog.handlePeersMessage(libpipe.PipeMsg{ID: "peers", Payload: `[{"PublicKey":"a2V5","AllowedIPs":["100.0.0.2/32"]}]`})
+	require.Error(t, err)
+	require.Len(t, dev.Configs, 2)
+}
+
+func TestFlushConfig(t *testing.T) {
+	prog, dev := makeTestProgram(t)
+
+	require.NoError(t, prog.flushConfig())
+	conf, ok := dev.LastConfig()
+	require.True(t, ok)
+	require.Empty(t, conf.Peers)
+
+	dev.SetConfigErr = errors.New("syncconf failed")
+	err := prog.flushConfig()
+	require.Error(t, err)
+	require.Len(t, dev.Configs, 1)
+
+	dev.SetConfigErr = nil
+	require.NoError(t, dev.Delete())
+	require.Error(t, prog.flushConfig())
+}
+
+func TestHandleAddressMessage(t *testing.T) {
+	prog, dev := makeTestProgram(t)
+
+	err := prog.handleAddressMessage(makePipeMsg(t, "address", []string{"100.0.0.5/16", "fd00::5"}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"100.0.0.5/16", "fd00::5/64"}, dev.Addresses)
+	require.Equal(t, dev.Addresses, prog.Addresses)
+
+	// Bare IPv4 address gets /24, like before prefix lengths were
+	// configurable.
+	err = prog.handleAddressMessage(makePipeMsg(t, "address", []string{"100.0.0.6"}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"100.0.0.6/24"}, dev.Addresses)
+
+	err = prog.handleAddressMessage(makePipeMsg(t, "address", []string{"100.0.0.7/99"}))
+	require.Error(t, err)
+	require.Equal(t, []string{"100.0.0.6/24"}, dev.Addresses)
+}
+
+func TestPeerRoutes(t *testing.T) {
+	prog, dev := makeTestProgram(t)
+	prog.Addresses = []string{"100.0.0.1/24", "fd00::1/64"}
+
+	peers := []libwireguard.WireguardPeer{
+		{PublicKey: testKey1, AllowedIPs: []string{"100.0.0.2/32", "fd00::2/128", "192.168.10.0/24"}},
+		{PublicKey: testKey2, AllowedIPs: []string{"100.0.1.3", "10.1.0.0/16", "fd01::/48"}},
+	}
+	require.NoError(t, prog.handlePeersMessage(makePipeMsg(t, "peers", peers)))
+	require.Equal(t, []string{"10.1.0.0/16", "100.0.1.3/32", "192.168.10.0/24", "fd01::/48"}, dev.Routes)
+
+	// Routes are replaced when peers go away.
+	require.NoError(t, prog.handlePeersMessage(makePipeMsg(t, "peers", peers[:1])))
+	require.Equal(t, []string{"192.168.10.0/24"}, dev.Routes)
+}
+
+func TestHandleNetworkMessage(t *testing.T) {
+	prog, dev := makeTestProgram(t)
+
+	err := prog.handleNetworkMessage(makePipeMsg(t, "network", libpipe.NetworkMsg{MTU: 1380}))
+	require.NoError(t, err)
+	require.Equal(t, 1380, dev.MTU)
+
+	err = prog.handleNetworkMessage(makePipeMsg(t, "network", libpipe.NetworkMsg{}))
+	require.NoError(t, err)
+	require.Equal(t, devowner.DefaultMTU, dev.MTU)
+}
+
+func TestReadStats(t *testing.T) {
+	prog, dev := makeTestProgram(t)
+
+	msg, err := prog.readStats()
+	require.NoError(t, err)
+	require.Empty(t, msg.Peers)
+
+	dev.PeerStats = []libwireguard.WireguardPeerStats{
+		{PublicKey: testKey1, Endpoint: "192.168.0.164:51820", LastHandshake: 1600000000, RxBytes: 1024, TxBytes: 2048},
+		{PublicKey: testKey2},
+	}
+	msg, err = prog.readStats()
+	require.NoError(t, err)
+	require.Equal(t, []libpipe.PeerStats{
+		{PublicKey: "LhdznlMunOticjwvG+WdHk2f9aYGvXugcrDhG2MJeBA=", Endpoint: "192.168.0.164:51820", LastHandshake: 1600000000, RxBytes: 1024, TxBytes: 2048},
+		{PublicKey: "jc+Ipv9/W4B6WD/EuVsFMVQjMcBYFfiw5NJD28ffqzE="},
+	}, msg.Peers)
+}
+
+func TestHandleMessage(t *testing.T) {
+	prog, dev := makeTestProgram(t)
+
+	reply, err := prog.handleMessage(makePipeMsg(t, "hello", libpipe.HelloMsg{Version: libpipe.ProtocolVersion}))
+	require.NoError(t, err)
+	require.Equal(t, libpipe.HelloMsg{Version: libpipe.ProtocolVersion}, reply)
+	_, err = prog.handleMessage(makePipeMsg(t, "hello", libpipe.HelloMsg{Version: libpipe.ProtocolVersion + 1}))
+	require.Error(t, err)
+
+	_, err = prog.handleMessage(makePipeMsg(t, "no-such-msg", nil))
+	require.Error(t, err)
+
+	// Failed syncconf is returned, so it can be sent back to kb-wireguard.
+	dev.SetConfigErr = errors.New("syncconf failed")
+	_, err = prog.handleMessage(makePipeMsg(t, "peers", []libwireguard.WireguardPeer{}))
+	require.EqualError(t, err, "syncconf failed")
+
+	// Reply carries the error with seq of the request.
+	str, err := libpipe.SerializeReply(7, nil, err)
+	require.NoError(t, err)
+	var msg libpipe.PipeMsg
+	require.NoError(t, json.Unmarshal([]byte(str), &msg))
+	require.Equal(t, libpipe.PipeMsg{ID: libpipe.ReplyID, Seq: 7, Error: "syncconf failed"}, msg)
+}
+
+func TestPrepareKey(t *testing.T) {
+	prog, dev := makeTestProgram(t)
+	oldPriv := prog.Config.PrivateKey
+
+	// Prepared key is not used until rotation, and stays the same.
+	reply, err := prog.handleMessage(makePipeMsg(t, "prepare-key", nil))
+	require.NoError(t, err)
+	nextPub := reply.(libwireguard.WireguardPubKey)
+	reply, err = prog.handleMessage(makePipeMsg(t, "prepare-key", nil))
+	require.NoError(t, err)
+	require.Equal(t, nextPub, reply)
+	require.Equal(t, oldPriv, prog.Config.PrivateKey)
+
+	_, err = prog.handleMessage(makePipeMsg(t, "rotate-key", nil))
+	require.NoError(t, err)
+	conf, ok := dev.LastConfig()
+	require.True(t, ok)
+	require.Equal(t, nextPub, conf.PrivateKey.PublicKey())
+	require.True(t, prog.NextKey.IsZero())
+
+	// Without prepared key, rotation generates a new one.
+	_, err = prog.handleMessage(makePipeMsg(t, "rotate-key", nil))
+	require.NoError(t, err)
+	conf, _ = dev.LastConfig()
+	require.NotEqual(t, nextPub, conf.PrivateKey.PublicKey())
+}
+
+func TestRotateKeyFailure(t *testing.T) {
+	prog, dev := makeTestProgram(t)
+	prog.KeyFilename = filepath.Join(t.TempDir(), "wg.key")
+	oldPriv := prog.Config.PrivateKey
+	require.NoError(t, devowner.SaveKey(prog.KeyFilename, oldPriv))
+	reply, err := prog.handleMessage(makePipeMsg(t, "prepare-key", nil))
+	require.NoError(t, err)
+	nextPub := reply.(libwireguard.WireguardPubKey)
+
+	// Device refuses the key, key file is not touched.
+	dev.SetConfigErr = errors.New("device is gone")
+	_, err = prog.handleMessage(makePipeMsg(t, "rotate-key", nil))
+	require.Error(t, err)
+	require.Equal(t, oldPriv, prog.Config.PrivateKey)
+	require.Equal(t, nextPub, prog.NextKey.PublicKey())
+	saved, err := os.ReadFile(prog.KeyFilename)
+	require.NoError(t, err)
+	require.Equal(t, oldPriv.Base64()+"\n", string(saved))
+	dev.SetConfigErr = nil
+
+	// Key can't be saved (parent is a file), device goes back to the
+	// previous key.
+	prog.KeyFilename = filepath.Join(prog.KeyFilename, "wg.key")
+	_, err = prog.handleMessage(makePipeMsg(t, "rotate-key", nil))
+	require.Error(t, err)
+	require.Equal(t, oldPriv, prog.Config.PrivateKey)
+	require.Equal(t, nextPub, prog.NextKey.PublicKey())
+	conf, ok := dev.LastConfig()
+	require.True(t, ok)
+	require.Equal(t, oldPriv, conf.PrivateKey)
+}
+
+func TestExitNode(t *testing.T) {
+	prog, dev := makeTestProgram(t)
+	prog.Addresses = []string{"100.0.0.1/24", "fd00::1/64"}
+
+	// Peer that is our exit node gets default routes, in a table marked
+	// with our listen port.
+	peers := []libwireguard.WireguardPeer{
+		{PublicKey: testKey1, AllowedIPs: []string{"100.0.0.2/32", "0.0.0.0/0", "::/0"}},
+		{PublicKey: testKey2, AllowedIPs: []string{"100.0.0.3/32", "10.1.0.0/16"}},
+	}
+	require.NoError(t, prog.handlePeersMessage(makePipeMsg(t, "peers", peers)))
+	require.Equal(t, []string{"10.1.0.0/16"}, dev.Routes)
+	require.Equal(t, []string{"0.0.0.0/0", "::/0"}, dev.DefaultRoutes)
+	require.Equal(t, uint32(51820), dev.RouteTable)
+	conf, _ := dev.LastConfig()
+	require.Equal(t, uint32(51820), conf.FwMark)
+
+	require.NoError(t, prog.handlePeersMessage(makePipeMsg(t, "peers", peers[1:])))
+	require.Empty(t, dev.DefaultRoutes)
+	conf, _ = dev.LastConfig()
+	require.Equal(t, uint32(0), conf.FwMark)
+
+	// Being an exit node forwards traffic from our networks.
+	err := prog.handleNetworkMessage(makePipeMsg(t, "network", libpipe.NetworkMsg{ExitNode: true}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"100.0.0.0/24", "fd00::/64"}, dev.ExitSubnets)
+
+	err = prog.handleAddressMessage(makePipeMsg(t, "address", []string{"100.0.5.1/16"}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"100.0.0.0/16"}, dev.ExitSubnets)
+
+	err = prog.handleNetworkMessage(makePipeMsg(t, "network", libpipe.NetworkMsg{}))
+	require.NoError(t, err)
+	require.Empty(t, dev.ExitSubnets)
+}
@@ -0,0 +1,59 @@
+package devowner
+
+import (
+	"fmt"
+
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+// Device is a WireGuard network device owned by run-dev. There are two
+// implementations: one that talks to the kernel over netlink, and one that
+// shells out to `ip` and `wg` commands.
+type Device interface {
+	// Name returns network interface name of the device.
+	Name() string
+	// Create creates the device.
+	Create() error
+	// SetAddresses assigns addresses (in CIDR notation) to the device,
+	// removing addresses previously set with `SetAddresses`, and brings the
+	// device up.
+	SetAddresses(cidrs []string) error
+	// SetRoutes routes `cidrs` through the device, removing routes previously
+	// set with `SetRoutes`. Networks of device addresses are routed already.
+	SetRoutes(cidrs []string) error
+	// SetDefaultRoutes routes all traffic of address families of `cidrs`
+	// (0.0.0.0/0 and ::/0) through the device, using routing table `table`
+	// for packets without fwmark `table`. WireGuard config has to have that
+	// fwmark, so encrypted packets still go out the usual way. Replaces
+	// routes from the previous call, empty `cidrs` restores routing.
+	SetDefaultRoutes(cidrs []string, table uint32) error
+	// SetExitNode forwards and masquerades traffic from `subnets` to other
+	// networks. Replaces subnets from the previous call, empty `subnets`
+	// turns it off and restores forwarding settings.
+	SetExitNode(subnets []string) error
+	// SetMTU changes MTU of the device.
+	SetMTU(mtu int) error
+	// SetConfig applies WireGuard configuration. Peers that are not in `conf`
+	// are removed, sessions with peers that stay are kept.
+	SetConfig(conf libwireguard.WireguardConfig) error
+	// Stats reads runtime state of all peers.
+	Stats() ([]libwireguard.WireguardPeerStats, error)
+	// Delete removes the device.
+	Delete() error
+}
+
+// DefaultMTU is MTU of WireGuard devices created by the kernel.
+const DefaultMTU = 1420
+
+// NewDevice returns Device for interface `name` using `backend`, which is
+// either "netlink" or "shell".
+func NewDevice(backend string, name string) (Device, error) {
+	switch backend {
+	case "netlink":
+		return NewNetlinkDevice(name)
+	case "shell":
+		return NewShellDevice(name), nil
+	default:
+		return nil, fmt.Errorf("unknown device backend %q", backend)
+	}
+}
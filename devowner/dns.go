@@ -0,0 +1,31 @@
+package devowner
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// SetDNS configures DNS servers for interface `iface` using `resolvconf`,
+// the same way wg-quick does.
+func SetDNS(iface string, servers []string) error {
+	var conf strings.Builder
+	for _, server := range servers {
+		conf.WriteString(fmt.Sprintf("nameserver %s\n", server))
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("resolvconf", "-a", iface, "-m", "0", "-x")
+	cmd.Stdin = strings.NewReader(conf.String())
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("resolvconf failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// ClearDNS removes DNS configuration set with SetDNS.
+func ClearDNS(iface string) error {
+	_, err := execCmd("resolvconf", "-d", iface, "-f")
+	return err
+}
@@ -0,0 +1,210 @@
+package devowner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Exit node support, shared by both device backends. When a peer is our exit
+// node, all traffic is routed through the device the same way wg-quick does
+// it: default route goes to a separate routing table, which is used for
+// packets without WireGuard's fwmark, so WireGuard's own packets still go out
+// through the main table. When we are the exit node, traffic of peers is
+// forwarded and masqueraded with iptables.
+//
+// Everything that was changed is remembered, so it can be undone.
+type exitRouting struct {
+	// Default routes (0.0.0.0/0, ::/0) routed through the device, and
+	// table and fwmark used for them.
+	defaultRoutes []string
+	table         uint32
+	// Subnets that are forwarded and masqueraded.
+	natSubnets []string
+	// Original values of sysctls that we changed, by key.
+	sysctls map[string]string
+}
+
+const procSys = "/proc/sys"
+
+const (
+	sysctlSrcValidMark = "net/ipv4/conf/all/src_valid_mark"
+	sysctlForward4     = "net/ipv4/ip_forward"
+	sysctlForward6     = "net/ipv6/conf/all/forwarding"
+)
+
+func isIPv6CIDR(cidr string) bool {
+	return strings.Contains(cidr, ":")
+}
+
+func ipFamilyFlag(cidr string) string {
+	if isIPv6CIDR(cidr) {
+		return "-6"
+	}
+	return "-4"
+}
+
+func (r *exitRouting) setDefaultRoutes(iface string, cidrs []string, table uint32) error {
+	var firstErr error
+	keepErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// Routes in our table go away with the device, rules have to be
+	// removed. Removal goes on after errors, so as much as possible is
+	// restored.
+	oldTable := strconv.FormatUint(uint64(r.table), 10)
+	for _, cidr := range r.defaultRoutes {
+		family := ipFamilyFlag(cidr)
+		_, err := execCmd("ip", family, "rule", "del", "not", "fwmark", oldTable, "table", oldTable)
+		keepErr(err)
+		_, err = execCmd("ip", family, "rule", "del", "table", "main", "suppress_prefixlength", "0")
+		keepErr(err)
+		_, err = execCmd("ip", family, "route", "del", cidr, "dev", iface, "table", oldTable)
+		keepErr(err)
+	}
+	r.defaultRoutes = nil
+	if firstErr != nil {
+		return fmt.Errorf("failed to remove default routes: %w", firstErr)
+	}
+
+	newTable := strconv.FormatUint(uint64(table), 10)
+	r.table = table
+	for _, cidr := range cidrs {
+		family := ipFamilyFlag(cidr)
+		if _, err := execCmd("ip", family, "route", "replace", cidr, "dev", iface, "table", newTable); err != nil {
+			return fmt.Errorf("failed to add default route: %w", err)
+		}
+		// Recorded before rules are added, so they are removed even if only
+		// some of them were added.
+		r.defaultRoutes = append(r.defaultRoutes, cidr)
+		if _, err := execCmd("ip", family, "rule", "add", "not", "fwmark", newTable, "table", newTable); err != nil {
+			return fmt.Errorf("failed to add routing rule: %w", err)
+		}
+		// Routes more specific than default ones (e.g. LAN) are still used
+		// from the main table.
+		if _, err := execCmd("ip", family, "rule", "add", "table", "main", "suppress_prefixlength", "0"); err != nil {
+			return fmt.Errorf("failed to add routing rule: %w", err)
+		}
+		if family == "-4" {
+			// Replies to marked packets pass reverse path filtering.
+			if err := r.setSysctl(sysctlSrcValidMark, "1"); err != nil {
+				return err
+			}
+		}
+	}
+	if !hasFamily(cidrs, false) {
+		return r.restoreSysctl(sysctlSrcValidMark)
+	}
+	return nil
+}
+
+// iptablesRules returns rules that forward and masquerade traffic from
+// `subnet` coming from `iface`, as arguments for iptables or ip6tables
+// without the command (-I/-D).
+func iptablesRules(iface string, subnet string) [][]string {
+	return [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", subnet, "!", "-o", iface, "-j", "MASQUERADE"},
+		{"-t", "filter", "FORWARD", "-i", iface, "-s", subnet, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-o", iface, "-d", subnet, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+}
+
+func iptables(op string, subnet string, rule []string) error {
+	cmd := "iptables"
+	if isIPv6CIDR(subnet) {
+		cmd = "ip6tables"
+	}
+	// Table goes before the command, chain right after it.
+	args := append([]string{rule[0], rule[1], op}, rule[2:]...)
+	_, err := execCmd(cmd, args...)
+	return err
+}
+
+func (r *exitRouting) setExitNode(iface string, subnets []string) error {
+	var firstErr error
+	for _, subnet := range r.natSubnets {
+		for _, rule := range iptablesRules(iface, subnet) {
+			if err := iptables("-D", subnet, rule); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	r.natSubnets = nil
+	if firstErr != nil {
+		return fmt.Errorf("failed to remove forwarding rules: %w", firstErr)
+	}
+
+	for _, subnet := range subnets {
+		r.natSubnets = append(r.natSubnets, subnet)
+		for _, rule := range iptablesRules(iface, subnet) {
+			if err := iptables("-I", subnet, rule); err != nil {
+				return fmt.Errorf("failed to add forwarding rule: %w", err)
+			}
+		}
+	}
+
+	for _, v := range []struct {
+		key  string
+		ipv6 bool
+	}{
+		{sysctlForward4, false},
+		{sysctlForward6, true},
+	} {
+		var err error
+		if hasFamily(subnets, v.ipv6) {
+			err = r.setSysctl(v.key, "1")
+		} else {
+			err = r.restoreSysctl(v.key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasFamily(cidrs []string, ipv6 bool) bool {
+	for _, cidr := range cidrs {
+		if isIPv6CIDR(cidr) == ipv6 {
+			return true
+		}
+	}
+	return false
+}
+
+// setSysctl changes sysctl `key`, remembering the original value.
+func (r *exitRouting) setSysctl(key string, value string) error {
+	path := filepath.Join(procSys, key)
+	if _, ok := r.sysctls[key]; !ok {
+		old, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read sysctl: %w", err)
+		}
+		if r.sysctls == nil {
+			r.sysctls = make(map[string]string)
+		}
+		r.sysctls[key] = strings.TrimSpace(string(old))
+	}
+	if err := ioutil.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to set sysctl: %w", err)
+	}
+	return nil
+}
+
+// restoreSysctl sets sysctl `key` back to its value from before `setSysctl`.
+func (r *exitRouting) restoreSysctl(key string) error {
+	old, ok := r.sysctls[key]
+	if !ok {
+		return nil
+	}
+	if err := ioutil.WriteFile(filepath.Join(procSys, key), []byte(old+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to restore sysctl: %w", err)
+	}
+	delete(r.sysctls, key)
+	return nil
+}
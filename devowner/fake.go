@@ -0,0 +1,130 @@
+package devowner
+
+import (
+	"fmt"
+
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+// FakeDevice is an in-memory Device for tests. It records everything that
+// was applied to it.
+type FakeDevice struct {
+	name string
+
+	Created bool
+	Deleted bool
+	// Addresses from the last SetAddresses call.
+	Addresses []string
+	// Routes from the last SetRoutes call.
+	Routes []string
+	// Default routes and their table from the last SetDefaultRoutes call.
+	DefaultRoutes []string
+	RouteTable    uint32
+	// Subnets from the last SetExitNode call.
+	ExitSubnets []string
+
+	MTU int
+	// Configs applied with SetConfig, oldest first.
+	Configs []libwireguard.WireguardConfig
+	// PeerStats is returned by Stats.
+	PeerStats []libwireguard.WireguardPeerStats
+
+	// SetConfigErr, if set, is returned by SetConfig and config is not
+	// recorded.
+	SetConfigErr error
+}
+
+var _ Device = (*FakeDevice)(nil)
+
+func NewFakeDevice(name string) *FakeDevice {
+	return &FakeDevice{name: name, MTU: DefaultMTU}
+}
+
+func (d *FakeDevice) Name() string {
+	return d.name
+}
+
+func (d *FakeDevice) Create() error {
+	if d.Created {
+		return fmt.Errorf("device %s already exists", d.name)
+	}
+	d.Created = true
+	return nil
+}
+
+func (d *FakeDevice) SetAddresses(cidrs []string) error {
+	if !d.Created || d.Deleted {
+		return fmt.Errorf("device %s does not exist", d.name)
+	}
+	d.Addresses = append([]string(nil), cidrs...)
+	return nil
+}
+
+func (d *FakeDevice) SetRoutes(cidrs []string) error {
+	if !d.Created || d.Deleted {
+		return fmt.Errorf("device %s does not exist", d.name)
+	}
+	d.Routes = append([]string(nil), cidrs...)
+	return nil
+}
+
+func (d *FakeDevice) SetDefaultRoutes(cidrs []string, table uint32) error {
+	if !d.Created || d.Deleted {
+		return fmt.Errorf("device %s does not exist", d.name)
+	}
+	d.DefaultRoutes = append([]string(nil), cidrs...)
+	d.RouteTable = table
+	return nil
+}
+
+func (d *FakeDevice) SetExitNode(subnets []string) error {
+	if !d.Created || d.Deleted {
+		return fmt.Errorf("device %s does not exist", d.name)
+	}
+	d.ExitSubnets = append([]string(nil), subnets...)
+	return nil
+}
+
+func (d *FakeDevice) SetMTU(mtu int) error {
+	if !d.Created || d.Deleted {
+		return fmt.Errorf("device %s does not exist", d.name)
+	}
+	d.MTU = mtu
+	return nil
+}
+
+func (d *FakeDevice) SetConfig(conf libwireguard.WireguardConfig) error {
+	if !d.Created || d.Deleted {
+		return fmt.Errorf("device %s does not exist", d.name)
+	}
+	if d.SetConfigErr != nil {
+		return d.SetConfigErr
+	}
+	// Copy peers so later changes by the caller are not recorded.
+	conf.Peers = append([]libwireguard.WireguardPeer(nil), conf.Peers...)
+	d.Configs = append(d.Configs, conf)
+	return nil
+}
+
+// LastConfig returns config applied by the last successful SetConfig.
+func (d *FakeDevice) LastConfig() (ret libwireguard.WireguardConfig, ok bool) {
+	if len(d.Configs) == 0 {
+		return ret, false
+	}
+	return d.Configs[len(d.Configs)-1], true
+}
+
+func (d *FakeDevice) Stats() ([]libwireguard.WireguardPeerStats, error) {
+	if !d.Created || d.Deleted {
+		return nil, fmt.Errorf("device %s does not exist", d.name)
+	}
+	return d.PeerStats, nil
+}
+
+func (d *FakeDevice) Delete() error {
+	if !d.Created || d.Deleted {
+		return fmt.Errorf("device %s does not exist", d.name)
+	}
+	d.Deleted = true
+	return nil
+}
@@ -0,0 +1,121 @@
+package devowner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+// Private keys can be persisted in files, so peers don't have to learn a new
+// public key every time we restart. Files are in the same format as output of
+// `wg genkey` and are only accessible by root.
+
+// KeyStoreDir is where run-dev keeps persistent private keys, see
+// `KeyFilePath`.
+const KeyStoreDir = "/var/lib/kb-wireguard/keys"
+
+var (
+	keyTeamRe     = regexp.MustCompile(`^[a-z0-9_]+(\.[a-z0-9_]+)*$`)
+	keyDeviceIDRe = regexp.MustCompile(`^[0-9a-f]{1,64}$`)
+)
+
+// KeyFilePath returns path of persistent private key file for given team and
+// Keybase device ID, in `KeyStoreDir`. Names are checked, so the path can't
+// point anywhere else.
+func KeyFilePath(team string, deviceID string) (string, error) {
+	team = strings.ToLower(team)
+	if !keyTeamRe.MatchString(team) {
+		return "", fmt.Errorf("invalid team name %q", team)
+	}
+	if !keyDeviceIDRe.MatchString(deviceID) {
+		return "", fmt.Errorf("invalid device ID %q", deviceID)
+	}
+	return filepath.Join(KeyStoreDir, team, deviceID+".key"), nil
+}
+
+// LoadKey reads private key from `filename`. Returns os.IsNotExist error if
+// the file does not exist. Refuses to use files that are not owned by root or
+// are accessible by other users.
+func LoadKey(filename string) (priv libwireguard.WireguardPrivKey, pub libwireguard.WireguardPubKey, err error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return priv, pub, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return priv, pub, fmt.Errorf("key file %s has too open permissions: %s", filename, info.Mode().Perm())
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 {
+		return priv, pub, fmt.Errorf("key file %s is not owned by root", filename)
+	}
+
+	privBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return priv, pub, fmt.Errorf("Failed to read key file: %w", err)
+	}
+	priv, err = libwireguard.ParsePrivKey(strings.TrimSpace(string(privBytes)))
+	if err != nil {
+		return priv, pub, fmt.Errorf("Failed to parse key from %s: %w", filename, err)
+	}
+	return priv, priv.PublicKey(), nil
+}
+
+// SaveKey writes private key to `filename`, creating parent directories if
+// needed. The file is replaced atomically, so we never end up with a
+// half-written key.
+func SaveKey(filename string, priv libwireguard.WireguardPrivKey) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Failed to create key directory: %w", err)
+	}
+	tmp, err := ioutil.TempFile(dir, ".key.*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.WriteString(priv.Base64() + "\n"); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to write key file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// LoadOrGenerateKey loads private key from `filename`, or generates a new one
+// and saves it there if the file does not exist yet.
+func LoadOrGenerateKey(filename string) (priv libwireguard.WireguardPrivKey, pub libwireguard.WireguardPubKey, err error) {
+	priv, pub, err = LoadKey(filename)
+	if err == nil {
+		return priv, pub, nil
+	}
+	if !os.IsNotExist(err) {
+		return priv, pub, err
+	}
+	return GenerateAndSaveKey(filename)
+}
+
+// GenerateAndSaveKey generates a new key pair. If `filename` is not empty,
+// private key is saved there, replacing the previous one.
+func GenerateAndSaveKey(filename string) (priv libwireguard.WireguardPrivKey, pub libwireguard.WireguardPubKey, err error) {
+	priv, err = libwireguard.GeneratePrivKey()
+	if err != nil {
+		return priv, pub, err
+	}
+	if filename != "" {
+		if err := SaveKey(filename, priv); err != nil {
+			return priv, pub, err
+		}
+	}
+	return priv, priv.PublicKey(), nil
+}
@@ -0,0 +1,700 @@
+package devowner
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+// NetlinkDevice manages WireGuard device by talking to the kernel directly:
+// rtnetlink for the network interface and addresses, and generic netlink
+// "wireguard" family for WireGuard configuration. It does not need iproute2
+// or wireguard-tools to be installed.
+type NetlinkDevice struct {
+	name      string
+	addresses []*net.IPNet
+	routes    []*net.IPNet
+	// Exit node routing is done with `ip` and `iptables`, see `exitRouting`.
+	exit exitRouting
+
+	route *netlinkConn
+	genl  *netlinkConn
+	// Generic netlink family ID of "wireguard", resolved lazily because
+	// the kernel module may only get loaded when we create the device.
+	wgFamily uint16
+}
+
+var _ Device = (*NetlinkDevice)(nil)
+
+// Constants from linux/wireguard.h, linux/genetlink.h and linux/if_link.h
+// that are not in syscall package.
+const (
+	nlaFNested         = 1 << 15
+	nlaTypeMask        = ^uint16(nlaFNested | 1<<14)
+	genlIDCtrl         = 0x10
+	genlHdrLen         = 4
+	ctrlCmdGetFamily   = 3
+	ctrlAttrFamilyID   = 1
+	ctrlAttrFamilyName = 2
+	iflaInfoKind       = 1
+
+	wgGenlName    = "wireguard"
+	wgGenlVersion = 1
+
+	wgCmdGetDevice = 0
+	wgCmdSetDevice = 1
+
+	wgDeviceAIfname     = 2
+	wgDeviceAPrivateKey = 3
+	wgDeviceAListenPort = 6
+	wgDeviceAFwmark     = 7
+	wgDeviceAPeers      = 8
+
+	wgPeerAPublicKey           = 1
+	wgPeerAPresharedKey        = 2
+	wgPeerAFlags               = 3
+	wgPeerAEndpoint            = 4
+	wgPeerAPersistentKeepalive = 5
+	wgPeerALastHandshakeTime   = 6
+	wgPeerARxBytes             = 7
+	wgPeerATxBytes             = 8
+	wgPeerAAllowedIPs          = 9
+
+	wgPeerFRemoveMe          = 1
+	wgPeerFReplaceAllowedIPs = 2
+	wgPeerFUpdateOnly        = 4
+
+	wgAllowedIPAFamily   = 1
+	wgAllowedIPAIPAddr   = 2
+	wgAllowedIPACidrMask = 3
+)
+
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+func NewNetlinkDevice(name string) (*NetlinkDevice, error) {
+	route, err := dialNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rtnetlink socket: %w", err)
+	}
+	genl, err := dialNetlink(syscall.NETLINK_GENERIC)
+	if err != nil {
+		route.Close()
+		return nil, fmt.Errorf("failed to open generic netlink socket: %w", err)
+	}
+	return &NetlinkDevice{
+		name:  name,
+		route: route,
+		genl:  genl,
+	}, nil
+}
+
+func (d *NetlinkDevice) Name() string {
+	return d.name
+}
+
+func (d *NetlinkDevice) ifindex() (int32, error) {
+	iface, err := net.InterfaceByName(d.name)
+	if err != nil {
+		return 0, err
+	}
+	return int32(iface.Index), nil
+}
+
+func (d *NetlinkDevice) Create() error {
+	var linkInfo nlAttrs
+	linkInfo.addString(iflaInfoKind, "wireguard")
+	var attrs nlAttrs
+	attrs.addString(syscall.IFLA_IFNAME, d.name)
+	attrs.addNested(syscall.IFLA_LINKINFO, linkInfo)
+
+	msg := append(ifInfoMsg(0, 0, 0), attrs...)
+	_, err := d.route.request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, msg)
+	if err != nil {
+		return fmt.Errorf("failed to create link %s: %w", d.name, err)
+	}
+	return nil
+}
+
+func (d *NetlinkDevice) SetAddresses(cidrs []string) error {
+	index, err := d.ifindex()
+	if err != nil {
+		return err
+	}
+
+	var newAddrs []*net.IPNet
+	for _, cidr := range cidrs {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		ipNet.IP = ip
+		newAddrs = append(newAddrs, ipNet)
+	}
+
+	for _, addr := range d.addresses {
+		_, err := d.route.request(syscall.RTM_DELADDR, 0, ifAddrMsg(addr, index))
+		if err != nil && err != syscall.EADDRNOTAVAIL {
+			return fmt.Errorf("failed to remove address %s: %w", addr, err)
+		}
+	}
+	d.addresses = nil
+	for _, addr := range newAddrs {
+		_, err := d.route.request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, ifAddrMsg(addr, index))
+		if err != nil {
+			return fmt.Errorf("failed to add address %s: %w", addr, err)
+		}
+		d.addresses = append(d.addresses, addr)
+	}
+
+	_, err = d.route.request(syscall.RTM_NEWLINK, 0, ifInfoMsg(index, syscall.IFF_UP, syscall.IFF_UP))
+	if err != nil {
+		return fmt.Errorf("failed to bring the interface up: %w", err)
+	}
+	return nil
+}
+
+func (d *NetlinkDevice) SetRoutes(cidrs []string) error {
+	index, err := d.ifindex()
+	if err != nil {
+		return err
+	}
+
+	var newRoutes []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		newRoutes = append(newRoutes, ipNet)
+	}
+
+	for _, route := range d.routes {
+		_, err := d.route.request(syscall.RTM_DELROUTE, 0, rtMsg(route, index))
+		if err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to remove route %s: %w", route, err)
+		}
+	}
+	d.routes = nil
+	for _, route := range newRoutes {
+		_, err := d.route.request(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, rtMsg(route, index))
+		if err != nil {
+			return fmt.Errorf("failed to add route %s: %w", route, err)
+		}
+		d.routes = append(d.routes, route)
+	}
+	return nil
+}
+
+func (d *NetlinkDevice) SetDefaultRoutes(cidrs []string, table uint32) error {
+	return d.exit.setDefaultRoutes(d.name, cidrs, table)
+}
+
+func (d *NetlinkDevice) SetExitNode(subnets []string) error {
+	return d.exit.setExitNode(d.name, subnets)
+}
+
+func (d *NetlinkDevice) SetMTU(mtu int) error {
+	index, err := d.ifindex()
+	if err != nil {
+		return err
+	}
+	var attrs nlAttrs
+	attrs.addU32(syscall.IFLA_MTU, uint32(mtu))
+	msg := append(ifInfoMsg(index, 0, 0), attrs...)
+	_, err = d.route.request(syscall.RTM_NEWLINK, 0, msg)
+	if err != nil {
+		return fmt.Errorf("failed to set MTU of %s: %w", d.name, err)
+	}
+	return nil
+}
+
+func (d *NetlinkDevice) SetConfig(conf libwireguard.WireguardConfig) error {
+	family, err := d.family()
+	if err != nil {
+		return err
+	}
+
+	current, err := d.Stats()
+	if err != nil {
+		return err
+	}
+
+	// Remove peers that are gone. Others are updated in place, so their
+	// sessions survive.
+	wanted := make(map[libwireguard.WireguardPubKey]bool, len(conf.Peers))
+	for _, peer := range conf.Peers {
+		wanted[peer.PublicKey] = true
+	}
+	var remove []libwireguard.WireguardPubKey
+	for _, peer := range current {
+		if !wanted[peer.PublicKey] {
+			remove = append(remove, peer.PublicKey)
+		}
+	}
+
+	msgs, err := wgSetDeviceMsgs(d.name, conf, remove)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if _, err := d.genl.request(family, 0, msg); err != nil {
+			return fmt.Errorf("failed to set WireGuard config: %w", err)
+		}
+	}
+	return nil
+}
+
+// wgMaxMsgSize limits size of WG_CMD_SET_DEVICE messages, the kernel rejects
+// messages that don't fit in its receive buffer. Same as wg(8) uses.
+const wgMaxMsgSize = 8192
+
+// wgSetDeviceMsgs encodes `conf` as WG_CMD_SET_DEVICE messages (without
+// netlink header), removing peers in `remove`. Like wg(8), peers are split
+// across as many messages as needed: the first message carries device
+// attributes, and a peer whose allowed IPs don't fit is continued in the next
+// message with WGPEER_F_UPDATE_ONLY, adding the rest of its allowed IPs.
+func wgSetDeviceMsgs(name string, conf libwireguard.WireguardConfig, remove []libwireguard.WireguardPubKey) (ret [][]byte, err error) {
+	var device, peers nlAttrs
+	startMsg := func() {
+		device, peers = nil, nil
+		device.addString(wgDeviceAIfname, name)
+		if len(ret) == 0 {
+			device.add(wgDeviceAPrivateKey, conf.PrivateKey[:])
+			device.addU16(wgDeviceAListenPort, conf.ListenPort)
+			device.addU32(wgDeviceAFwmark, conf.FwMark)
+		}
+	}
+	finishMsg := func() {
+		if len(peers) > 0 {
+			device.addNested(wgDeviceAPeers, peers)
+		}
+		ret = append(ret, append(genlMsgHdr(wgCmdSetDevice, wgGenlVersion), device...))
+	}
+	// Space left for a peer in the current message, excluding its nested
+	// attribute header.
+	room := func() int {
+		return wgMaxMsgSize - syscall.NLMSG_HDRLEN - genlHdrLen - len(device) -
+			syscall.SizeofRtAttr - len(peers) - syscall.SizeofRtAttr
+	}
+
+	startMsg()
+	for _, peer := range conf.Peers {
+		attrs, allowedIPs, err := wgPeerAttrs(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %q: %w", peer.Label, err)
+		}
+		for {
+			// Allowed IPs that fit in this message along with the peer.
+			avail := room() - len(attrs) - syscall.SizeofRtAttr
+			n, size := 0, 0
+			for n < len(allowedIPs) && size+len(allowedIPs[n]) <= avail {
+				size += len(allowedIPs[n])
+				n++
+			}
+			if avail < 0 || (n == 0 && len(allowedIPs) > 0) {
+				if len(peers) == 0 {
+					return nil, fmt.Errorf("peer %q does not fit in netlink message", peer.Label)
+				}
+				finishMsg()
+				startMsg()
+				continue
+			}
+			var nested nlAttrs
+			for _, allowedIP := range allowedIPs[:n] {
+				nested = append(nested, allowedIP...)
+			}
+			peerAttrs := append(nlAttrs(nil), attrs...)
+			peerAttrs.addNested(wgPeerAAllowedIPs, nested)
+			peers.addNested(0, peerAttrs)
+			allowedIPs = allowedIPs[n:]
+			if len(allowedIPs) == 0 {
+				break
+			}
+			// Rest of allowed IPs are added to the peer in the next message.
+			finishMsg()
+			startMsg()
+			attrs = nil
+			attrs.add(wgPeerAPublicKey, peer.PublicKey[:])
+			attrs.addU32(wgPeerAFlags, wgPeerFUpdateOnly)
+		}
+	}
+	for _, pubKey := range remove {
+		var peerAttrs nlAttrs
+		peerAttrs.add(wgPeerAPublicKey, pubKey[:])
+		peerAttrs.addU32(wgPeerAFlags, wgPeerFRemoveMe)
+		if room() < len(peerAttrs) {
+			finishMsg()
+			startMsg()
+		}
+		peers.addNested(0, peerAttrs)
+	}
+	finishMsg()
+	return ret, nil
+}
+
+// wgPeerAttrs returns attributes of `peer` other than allowed IPs, and its
+// allowed IPs, each one as a nested attribute.
+func wgPeerAttrs(peer libwireguard.WireguardPeer) (ret nlAttrs, allowedIPs []nlAttrs, err error) {
+	ret.add(wgPeerAPublicKey, peer.PublicKey[:])
+	ret.addU32(wgPeerAFlags, wgPeerFReplaceAllowedIPs)
+	// All zeros key removes preshared key.
+	ret.add(wgPeerAPresharedKey, peer.PresharedKey[:])
+	if endpoint := libwireguard.ParseHostPort(peer.Endpoint); endpoint.Exists() {
+		ret.add(wgPeerAEndpoint, sockaddr(endpoint))
+	}
+	ret.addU16(wgPeerAPersistentKeepalive, uint16(peer.PersistentKeepalive))
+
+	for _, v := range peer.AllowedIPs {
+		ipNet, err := libwireguard.ParseAllowedIP(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid allowed IP %q: %w", v, err)
+		}
+		var allowedIP nlAttrs
+		ones, _ := ipNet.Mask.Size()
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			allowedIP.addU16(wgAllowedIPAFamily, syscall.AF_INET)
+			allowedIP.add(wgAllowedIPAIPAddr, ip4)
+		} else {
+			allowedIP.addU16(wgAllowedIPAFamily, syscall.AF_INET6)
+			allowedIP.add(wgAllowedIPAIPAddr, ipNet.IP.To16())
+		}
+		allowedIP.add(wgAllowedIPACidrMask, []byte{byte(ones)})
+		var nested nlAttrs
+		nested.addNested(0, allowedIP)
+		allowedIPs = append(allowedIPs, nested)
+	}
+	return ret, allowedIPs, nil
+}
+
+func (d *NetlinkDevice) Stats() (ret []libwireguard.WireguardPeerStats, err error) {
+	family, err := d.family()
+	if err != nil {
+		return nil, err
+	}
+	var attrs nlAttrs
+	attrs.addString(wgDeviceAIfname, d.name)
+	msg := append(genlMsgHdr(wgCmdGetDevice, wgGenlVersion), attrs...)
+	replies, err := d.genl.request(family, syscall.NLM_F_DUMP, msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get WireGuard device: %w", err)
+	}
+
+	// Peers can be split between multiple messages of the dump.
+	for _, reply := range replies {
+		if len(reply) < genlHdrLen {
+			continue
+		}
+		for _, attr := range parseAttrs(reply[genlHdrLen:]) {
+			if attr.typ != wgDeviceAPeers {
+				continue
+			}
+			for _, peerAttr := range parseAttrs(attr.data) {
+				ret = append(ret, parsePeerStats(peerAttr.data))
+			}
+		}
+	}
+	return ret, nil
+}
+
+func parsePeerStats(data []byte) (ret libwireguard.WireguardPeerStats) {
+	for _, attr := range parseAttrs(data) {
+		switch attr.typ {
+		case wgPeerAPublicKey:
+			copy(ret.PublicKey[:], attr.data)
+		case wgPeerAEndpoint:
+			if hp := parseSockaddr(attr.data); hp.Exists() {
+				ret.Endpoint = hp.String()
+			}
+		case wgPeerALastHandshakeTime:
+			// struct __kernel_timespec
+			if len(attr.data) >= 8 {
+				ret.LastHandshake = int64(nativeEndian.Uint64(attr.data))
+			}
+		case wgPeerARxBytes:
+			if len(attr.data) >= 8 {
+				ret.RxBytes = nativeEndian.Uint64(attr.data)
+			}
+		case wgPeerATxBytes:
+			if len(attr.data) >= 8 {
+				ret.TxBytes = nativeEndian.Uint64(attr.data)
+			}
+		}
+	}
+	return ret
+}
+
+func (d *NetlinkDevice) Delete() error {
+	defer d.route.Close()
+	defer d.genl.Close()
+
+	index, err := d.ifindex()
+	if err != nil {
+		return err
+	}
+	_, err = d.route.request(syscall.RTM_DELLINK, 0, ifInfoMsg(index, 0, 0))
+	if err != nil {
+		return fmt.Errorf("failed to delete link %s: %w", d.name, err)
+	}
+	return nil
+}
+
+// family resolves generic netlink family ID of WireGuard.
+func (d *NetlinkDevice) family() (uint16, error) {
+	if d.wgFamily != 0 {
+		return d.wgFamily, nil
+	}
+	var attrs nlAttrs
+	attrs.addString(ctrlAttrFamilyName, wgGenlName)
+	msg := append(genlMsgHdr(ctrlCmdGetFamily, 1), attrs...)
+	replies, err := d.genl.request(genlIDCtrl, 0, msg)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve %q generic netlink family: %w", wgGenlName, err)
+	}
+	for _, reply := range replies {
+		if len(reply) < genlHdrLen {
+			continue
+		}
+		for _, attr := range parseAttrs(reply[genlHdrLen:]) {
+			if attr.typ == ctrlAttrFamilyID && len(attr.data) >= 2 {
+				d.wgFamily = nativeEndian.Uint16(attr.data)
+				return d.wgFamily, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("kernel did not return %q family ID", wgGenlName)
+}
+
+// sockaddr serializes endpoint to struct sockaddr_in or sockaddr_in6.
+func sockaddr(hp libwireguard.HostPort) []byte {
+	if ip4 := hp.Host.To4(); ip4 != nil {
+		b := make([]byte, 16)
+		nativeEndian.PutUint16(b[0:], syscall.AF_INET)
+		binary.BigEndian.PutUint16(b[2:], hp.Port)
+		copy(b[4:], ip4)
+		return b
+	}
+	b := make([]byte, 28)
+	nativeEndian.PutUint16(b[0:], syscall.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:], hp.Port)
+	copy(b[8:], hp.Host.To16())
+	return b
+}
+
+func parseSockaddr(b []byte) (ret libwireguard.HostPort) {
+	if len(b) < 4 {
+		return ret
+	}
+	switch nativeEndian.Uint16(b) {
+	case syscall.AF_INET:
+		if len(b) >= 8 {
+			ret.Host = net.IP(append([]byte(nil), b[4:8]...))
+		}
+	case syscall.AF_INET6:
+		if len(b) >= 24 {
+			ret.Host = net.IP(append([]byte(nil), b[8:24]...))
+		}
+	}
+	ret.Port = binary.BigEndian.Uint16(b[2:])
+	return ret
+}
+
+// struct ifinfomsg
+func ifInfoMsg(index int32, flags uint32, change uint32) []byte {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	b[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(b[4:], uint32(index))
+	nativeEndian.PutUint32(b[8:], flags)
+	nativeEndian.PutUint32(b[12:], change)
+	return b
+}
+
+// struct ifaddrmsg followed by address attributes
+func ifAddrMsg(addr *net.IPNet, index int32) []byte {
+	b := make([]byte, syscall.SizeofIfAddrmsg)
+	ip := addr.IP.To4()
+	b[0] = syscall.AF_INET
+	if ip == nil {
+		ip = addr.IP.To16()
+		b[0] = syscall.AF_INET6
+	}
+	ones, _ := addr.Mask.Size()
+	b[1] = byte(ones)
+	nativeEndian.PutUint32(b[4:], uint32(index))
+	var attrs nlAttrs
+	attrs.add(syscall.IFA_LOCAL, ip)
+	attrs.add(syscall.IFA_ADDRESS, ip)
+	return append(b, attrs...)
+}
+
+// struct rtmsg followed by route attributes, for a link scope route to
+// `dst` through interface `index`.
+func rtMsg(dst *net.IPNet, index int32) []byte {
+	b := make([]byte, syscall.SizeofRtMsg)
+	ip := dst.IP.To4()
+	b[0] = syscall.AF_INET
+	if ip == nil {
+		ip = dst.IP.To16()
+		b[0] = syscall.AF_INET6
+	}
+	ones, _ := dst.Mask.Size()
+	b[1] = byte(ones)
+	b[4] = syscall.RT_TABLE_MAIN
+	b[5] = syscall.RTPROT_BOOT
+	b[6] = syscall.RT_SCOPE_LINK
+	b[7] = syscall.RTN_UNICAST
+	var attrs nlAttrs
+	attrs.add(syscall.RTA_DST, ip)
+	attrs.addU32(syscall.RTA_OIF, uint32(index))
+	return append(b, attrs...)
+}
+
+// struct genlmsghdr
+func genlMsgHdr(cmd uint8, version uint8) []byte {
+	return []byte{cmd, version, 0, 0}
+}
+
+// nlAttrs is a buffer of serialized netlink attributes.
+type nlAttrs []byte
+
+func nlAlign(n int) int {
+	return (n + syscall.NLA_ALIGNTO - 1) &^ (syscall.NLA_ALIGNTO - 1)
+}
+
+func (a *nlAttrs) add(typ uint16, data []byte) {
+	hdr := make([]byte, syscall.SizeofRtAttr)
+	nativeEndian.PutUint16(hdr[0:], uint16(syscall.SizeofRtAttr+len(data)))
+	nativeEndian.PutUint16(hdr[2:], typ)
+	*a = append(*a, hdr...)
+	*a = append(*a, data...)
+	*a = append(*a, make([]byte, nlAlign(len(data))-len(data))...)
+}
+
+func (a *nlAttrs) addString(typ uint16, v string) {
+	a.add(typ, append([]byte(v), 0))
+}
+
+func (a *nlAttrs) addU16(typ uint16, v uint16) {
+	b := make([]byte, 2)
+	nativeEndian.PutUint16(b, v)
+	a.add(typ, b)
+}
+
+func (a *nlAttrs) addU32(typ uint16, v uint32) {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	a.add(typ, b)
+}
+
+func (a *nlAttrs) addNested(typ uint16, nested nlAttrs) {
+	a.add(typ|nlaFNested, nested)
+}
+
+type nlAttr struct {
+	typ  uint16
+	data []byte
+}
+
+func parseAttrs(b []byte) (ret []nlAttr) {
+	for len(b) >= syscall.SizeofRtAttr {
+		length := int(nativeEndian.Uint16(b[0:]))
+		typ := nativeEndian.Uint16(b[2:])
+		if length < syscall.SizeofRtAttr || length > len(b) {
+			break
+		}
+		ret = append(ret, nlAttr{
+			typ:  typ & nlaTypeMask,
+			data: b[syscall.SizeofRtAttr:length],
+		})
+		if nlAlign(length) >= len(b) {
+			break
+		}
+		b = b[nlAlign(length):]
+	}
+	return ret
+}
+
+// netlinkConn is a netlink socket doing synchronous requests.
+type netlinkConn struct {
+	fd  int
+	seq uint32
+}
+
+func dialNetlink(proto int) (*netlinkConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &netlinkConn{fd: fd}, nil
+}
+
+func (c *netlinkConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// request sends netlink message and collects payloads of replies. Requests
+// are acknowledged, so errors from the kernel are returned as syscall.Errno.
+func (c *netlinkConn) request(msgType uint16, flags uint16, payload []byte) ([][]byte, error) {
+	c.seq++
+	seq := c.seq
+	flags |= syscall.NLM_F_REQUEST | syscall.NLM_F_ACK
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(payload))
+	nativeEndian.PutUint32(msg[0:], uint32(syscall.NLMSG_HDRLEN+len(payload)))
+	nativeEndian.PutUint16(msg[4:], msgType)
+	nativeEndian.PutUint16(msg[6:], flags)
+	nativeEndian.PutUint32(msg[8:], seq)
+	msg = append(msg, payload...)
+
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var replies [][]byte
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("short netlink error message")
+				}
+				if errno := int32(nativeEndian.Uint32(m.Data)); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				// Acknowledgement. Dumps end with NLMSG_DONE instead.
+				if flags&syscall.NLM_F_DUMP != syscall.NLM_F_DUMP {
+					return replies, nil
+				}
+			default:
+				replies = append(replies, append([]byte(nil), m.Data...))
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package devowner
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+func TestWgSetDeviceMsgs(t *testing.T) {
+	privKey, err := libwireguard.GeneratePrivKey()
+	require.NoError(t, err)
+	conf := libwireguard.WireguardConfig{PrivateKey: privKey, ListenPort: 51820}
+	// Enough peers and routes for many messages, and one peer with more
+	// allowed IPs than fit in a single message.
+	wantIPs := make(map[libwireguard.WireguardPubKey]int)
+	for i := 0; i < 300; i++ {
+		var peer libwireguard.WireguardPeer
+		peer.PublicKey[0], peer.PublicKey[1] = byte(i), byte(i>>8)
+		peer.Endpoint = fmt.Sprintf("198.51.100.%d:51820", i%250+1)
+		peer.AllowedIPs = []string{fmt.Sprintf("100.0.%d.%d/32", i/250, i%250+1), "fd00::/64"}
+		if i == 7 {
+			for j := 0; j < 1000; j++ {
+				peer.AllowedIPs = append(peer.AllowedIPs, fmt.Sprintf("10.%d.%d.0/24", j/256, j%256))
+			}
+		}
+		conf.Peers = append(conf.Peers, peer)
+		wantIPs[peer.PublicKey] = len(peer.AllowedIPs)
+	}
+	var removed libwireguard.WireguardPubKey
+	removed[31] = 1
+
+	msgs, err := wgSetDeviceMsgs("kbwg0", conf, []libwireguard.WireguardPubKey{removed})
+	require.NoError(t, err)
+	require.True(t, len(msgs) > 1)
+
+	gotIPs := make(map[libwireguard.WireguardPubKey]int)
+	seen := make(map[libwireguard.WireguardPubKey]bool)
+	var removes int
+	for i, msg := range msgs {
+		require.True(t, syscall.NLMSG_HDRLEN+len(msg) <= wgMaxMsgSize, "message %d is too long", i)
+		var hasPrivKey bool
+		for _, attr := range parseAttrs(msg[genlHdrLen:]) {
+			switch attr.typ {
+			case wgDeviceAPrivateKey:
+				hasPrivKey = true
+			case wgDeviceAPeers:
+				for _, peerAttr := range parseAttrs(attr.data) {
+					var pubKey libwireguard.WireguardPubKey
+					var flags uint32
+					for _, a := range parseAttrs(peerAttr.data) {
+						switch a.typ {
+						case wgPeerAPublicKey:
+							copy(pubKey[:], a.data)
+						case wgPeerAFlags:
+							flags = nativeEndian.Uint32(a.data)
+						case wgPeerAAllowedIPs:
+							gotIPs[pubKey] += len(parseAttrs(a.data))
+						}
+					}
+					switch {
+					case flags == wgPeerFRemoveMe:
+						require.Equal(t, removed, pubKey)
+						removes++
+					case seen[pubKey]:
+						// Continuation of a peer from previous message.
+						require.Equal(t, uint32(wgPeerFUpdateOnly), flags)
+					default:
+						require.Equal(t, uint32(wgPeerFReplaceAllowedIPs), flags)
+					}
+					seen[pubKey] = true
+				}
+			}
+		}
+		// Device attributes are set once.
+		require.Equal(t, i == 0, hasPrivKey, "message %d", i)
+	}
+	require.Equal(t, wantIPs, gotIPs)
+	require.Equal(t, 1, removes)
+}
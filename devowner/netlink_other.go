@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package devowner
+
+import (
+	"fmt"
+
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+// NetlinkDevice is only available on Linux.
+type NetlinkDevice struct{}
+
+func NewNetlinkDevice(name string) (*NetlinkDevice, error) {
+	return nil, fmt.Errorf("netlink device backend is only supported on Linux")
+}
+
+func (d *NetlinkDevice) Name() string                                        { return "" }
+func (d *NetlinkDevice) Create() error                                       { return nil }
+func (d *NetlinkDevice) SetAddresses(cidrs []string) error                   { return nil }
+func (d *NetlinkDevice) SetRoutes(cidrs []string) error                      { return nil }
+func (d *NetlinkDevice) SetDefaultRoutes(cidrs []string, table uint32) error { return nil }
+func (d *NetlinkDevice) SetExitNode(subnets []string) error                  { return nil }
+func (d *NetlinkDevice) SetMTU(mtu int) error                                { return nil }
+func (d *NetlinkDevice) SetConfig(libwireguard.WireguardConfig) error        { return nil }
+func (d *NetlinkDevice) Stats() ([]libwireguard.WireguardPeerStats, error)   { return nil, nil }
+func (d *NetlinkDevice) Delete() error                                       { return nil }
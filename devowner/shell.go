@@ -0,0 +1,182 @@
+package devowner
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+// ShellDevice manages WireGuard device using `ip` and `wg` commands from
+// iproute2 and wireguard-tools. Configuration is passed to `wg` through a
+// temporary config file.
+type ShellDevice struct {
+	name      string
+	addresses []string
+	routes    []string
+	exit      exitRouting
+
+	configFilename string
+}
+
+var _ Device = (*ShellDevice)(nil)
+
+func NewShellDevice(name string) *ShellDevice {
+	return &ShellDevice{name: name}
+}
+
+func execCmd(name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		cmdStr := fmt.Sprintf("%s %s", name, strings.Join(args, " "))
+		fmt.Fprintf(os.Stderr, "Command %q stderr:\n%s\n", cmdStr, stderr.String())
+		return nil, fmt.Errorf("exec %q: %w", cmdStr, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+func (d *ShellDevice) Name() string {
+	return d.name
+}
+
+func (d *ShellDevice) Create() error {
+	tmpfile, err := ioutil.TempFile("", fmt.Sprintf("%s.*.conf", d.name))
+	if err != nil {
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+	d.configFilename = tmpfile.Name()
+
+	_, err = execCmd("ip", "link", "add", "dev", d.name, "type", "wireguard")
+	return err
+}
+
+func (d *ShellDevice) SetAddresses(cidrs []string) error {
+	for _, addr := range d.addresses {
+		if _, err := execCmd("ip", "address", "del", "dev", d.name, addr); err != nil {
+			return fmt.Errorf("failed to remove address: %w", err)
+		}
+	}
+	d.addresses = nil
+	for _, addr := range cidrs {
+		if _, err := execCmd("ip", "address", "add", "dev", d.name, addr); err != nil {
+			return fmt.Errorf("failed to add address: %w", err)
+		}
+		d.addresses = append(d.addresses, addr)
+	}
+	if _, err := execCmd("ip", "link", "set", "up", "dev", d.name); err != nil {
+		return fmt.Errorf("failed to bring the interface up: %w", err)
+	}
+	return nil
+}
+
+func (d *ShellDevice) SetRoutes(cidrs []string) error {
+	for _, route := range d.routes {
+		if _, err := execCmd("ip", "route", "del", route, "dev", d.name); err != nil {
+			return fmt.Errorf("failed to remove route: %w", err)
+		}
+	}
+	d.routes = nil
+	for _, route := range cidrs {
+		if _, err := execCmd("ip", "route", "replace", route, "dev", d.name); err != nil {
+			return fmt.Errorf("failed to add route: %w", err)
+		}
+		d.routes = append(d.routes, route)
+	}
+	return nil
+}
+
+func (d *ShellDevice) SetDefaultRoutes(cidrs []string, table uint32) error {
+	return d.exit.setDefaultRoutes(d.name, cidrs, table)
+}
+
+func (d *ShellDevice) SetExitNode(subnets []string) error {
+	return d.exit.setExitNode(d.name, subnets)
+}
+
+func (d *ShellDevice) SetMTU(mtu int) error {
+	_, err := execCmd("ip", "link", "set", "mtu", strconv.Itoa(mtu), "dev", d.name)
+	return err
+}
+
+func (d *ShellDevice) SetConfig(conf libwireguard.WireguardConfig) error {
+	cfgFile, err := os.OpenFile(d.configFilename, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := cfgFile.Write([]byte(libwireguard.SerializeConfig(conf.StripWgQuick()))); err != nil {
+		cfgFile.Close()
+		return fmt.Errorf("failed to Write: %w", err)
+	}
+
+	cfgFile.WriteString(fmt.Sprintf("\n# Config edited at: %s\n", time.Now().Local()))
+
+	if err := cfgFile.Close(); err != nil {
+		return fmt.Errorf("failed to Close: %w", err)
+	}
+
+	_, err = execCmd("wg", "syncconf", d.name, d.configFilename)
+	if err != nil {
+		return fmt.Errorf("failed to 'wg syncconf': %w", err)
+	}
+	return nil
+}
+
+// Stats parses output of `wg show <device> dump`.
+func (d *ShellDevice) Stats() (ret []libwireguard.WireguardPeerStats, err error) {
+	out, err := execCmd("wg", "show", d.name, "dump")
+	if err != nil {
+		return nil, err
+	}
+	return parseWgDump(string(out))
+}
+
+func parseWgDump(dump string) (ret []libwireguard.WireguardPeerStats, err error) {
+	lines := strings.Split(strings.TrimSpace(dump), "\n")
+	// First line is the interface: private-key, public-key, listen-port,
+	// fwmark. Then peers: public-key, preshared-key, endpoint, allowed-ips,
+	// latest-handshake, transfer-rx, transfer-tx, persistent-keepalive.
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 8 {
+			return nil, fmt.Errorf("unexpected `wg show dump` line: %q", line)
+		}
+		var stats libwireguard.WireguardPeerStats
+		if stats.PublicKey, err = libwireguard.ParsePubKey(fields[0]); err != nil {
+			return nil, err
+		}
+		if fields[2] != "(none)" {
+			stats.Endpoint = fields[2]
+		}
+		if stats.LastHandshake, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+			return nil, fmt.Errorf("failed to parse handshake time %q: %w", fields[4], err)
+		}
+		if stats.RxBytes, err = strconv.ParseUint(fields[5], 10, 64); err != nil {
+			return nil, fmt.Errorf("failed to parse rx bytes %q: %w", fields[5], err)
+		}
+		if stats.TxBytes, err = strconv.ParseUint(fields[6], 10, 64); err != nil {
+			return nil, fmt.Errorf("failed to parse tx bytes %q: %w", fields[6], err)
+		}
+		ret = append(ret, stats)
+	}
+	return ret, nil
+}
+
+func (d *ShellDevice) Delete() error {
+	if d.configFilename != "" {
+		os.Remove(d.configFilename)
+	}
+	_, err := execCmd("ip", "link", "delete", "dev", d.name)
+	return err
+}
@@ -0,0 +1,242 @@
+package kbwg
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// Devices that are not listed in peers.json can still join the network, but
+// they have to pick an address themselves. There is no central authority to
+// assign them, so each device picks a random free address in team's subnet and
+// announces it. If two devices claim the same address, the one whose claim
+// (first announcement with that address) has lower chat MessageID wins. Loser
+// notices that and picks another address. Addresses of peers in peers.json are
+// reserved and can't be claimed.
+//
+// Message IDs are assigned by Keybase, so peers can't pick them. Claim IDs
+// that peers put in their announcements are only hints for those of us who
+// did not see the first announcement, and are checked against chat history
+// (see `claimID`).
+
+// DefaultSubnet is used when team subnet is not configured.
+const DefaultSubnet = "100.0.0.0/24"
+
+// AllocateAddress picks random address in IPv4 `subnet` that is not in `used`
+// (keyed by `net.IP.String()`). Network and broadcast addresses are never
+// picked.
+func AllocateAddress(subnet *net.IPNet, used map[string]bool) (net.IP, error) {
+	base := subnet.IP.To4()
+	if base == nil {
+		return nil, fmt.Errorf("only IPv4 subnets are supported, got %s", subnet)
+	}
+	ones, bits := subnet.Mask.Size()
+	hostBits := uint(bits - ones)
+	if hostBits < 2 || hostBits > 30 {
+		return nil, fmt.Errorf("subnet %s is too small or too large", subnet)
+	}
+	size := uint32(1) << hostBits
+	baseInt := binary.BigEndian.Uint32(base.Mask(subnet.Mask))
+	ipAt := func(offset uint32) net.IP {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, baseInt+offset)
+		return ip
+	}
+
+	// Skip network (offset 0) and broadcast (offset size-1) addresses. Try
+	// random offsets first, subnet should be mostly empty.
+	for i := 0; i < 64; i++ {
+		offset, err := randUint32n(size - 2)
+		if err != nil {
+			return nil, err
+		}
+		ip := ipAt(1 + offset)
+		if !used[ip.String()] {
+			return ip, nil
+		}
+	}
+	// Then do a full scan from random starting point.
+	start, err := randUint32n(size - 2)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < size-2; i++ {
+		ip := ipAt(1 + (start+i)%(size-2))
+		if !used[ip.String()] {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no free addresses left in %s", subnet)
+}
+
+// randUint32n returns random number in [0, n). Uses crypto/rand, so devices
+// that start at the same time don't pick the same addresses.
+func randUint32n(n uint32) (uint32, error) {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate random number: %w", err)
+	}
+	return uint32(v.Int64()), nil
+}
+
+// reservedAddresses returns addresses of static peers (from peers.json),
+// including us if we are a static peer.
+func reservedAddresses(prog *Program) map[string]bool {
+	ret := make(map[string]bool)
+	if !prog.SelfPeer.Dynamic && prog.SelfPeer.IP != nil {
+		ret[prog.SelfPeer.IP.String()] = true
+	}
+	for _, peer := range prog.KeybasePeers {
+		if !peer.Dynamic {
+			ret[peer.IP.String()] = true
+		}
+	}
+	return ret
+}
+
+// AllocateSelfAddress picks new dynamic address for us, avoiding addresses
+// reserved in peers.json and addresses claimed by other dynamic peers.
+func AllocateSelfAddress(mctx MetaContext) error {
+	used := reservedAddresses(mctx.Prog)
+	for _, peer := range mctx.Prog.KeybasePeers {
+		if peer.Dynamic && peer.Active && !peer.AddressLost {
+			used[peer.IP.String()] = true
+		}
+	}
+	if mctx.Prog.SelfPeer.IP != nil {
+		// Don't pick the same one if we are re-rolling.
+		used[mctx.Prog.SelfPeer.IP.String()] = true
+	}
+	ip, err := AllocateAddress(mctx.Prog.Subnet, used)
+	if err != nil {
+		return err
+	}
+	mctx.Prog.SelfPeer.Dynamic = true
+	mctx.Prog.SelfPeer.IP = ip
+	mctx.Prog.SelfPeer.ClaimID = 0
+	return nil
+}
+
+// canClaimAddress checks if a dynamic peer can claim address `ip`.
+func canClaimAddress(prog *Program, ip net.IP) bool {
+	if ip == nil || prog.Subnet == nil || !prog.Subnet.Contains(ip) {
+		return false
+	}
+	return !reservedAddresses(prog)[ip.String()]
+}
+
+// claimID returns ID of the first announcement in which sender of `msg`
+// claimed address of announcement `parsed`. Claim ID that the sender put in
+// the announcement is used only if chat history confirms it (see
+// `claimConfirmed`), otherwise `msg` is the claim.
+func claimID(mctx MetaContext, msg chat1.MsgSummary, parsed AnnounceMsg) chat1.MessageID {
+	if parsed.ClaimID == 0 || parsed.ClaimID >= msg.Id {
+		return msg.Id
+	}
+	messages, err := mctx.API().GetTextMessages(mctx.Prog.AnnounceChannel, false /* unreadOnly */)
+	if err != nil {
+		fmt.Printf("! Failed to read announcements to check claim of %s: %s\n", msg.Sender.Username, err)
+		return msg.Id
+	}
+	if !claimConfirmed(messages, msg, parsed) {
+		fmt.Printf("! %s (%s) claims %s since msg ID %d, but chat history does not confirm it, using msg ID %d\n",
+			msg.Sender.Username, msg.Sender.DeviceName, parsed.IP, parsed.ClaimID, msg.Id)
+		return msg.Id
+	}
+	return parsed.ClaimID
+}
+
+// claimConfirmed checks claim of announcement `parsed` from `msg` against
+// chat history `messages`: message with the claim ID was sent by the same
+// device, claims the same address, and the device did not announce other
+// address (or say goodbye) since.
+func claimConfirmed(messages []chat1.MsgSummary, msg chat1.MsgSummary, parsed AnnounceMsg) bool {
+	confirmed := false
+	for _, v := range messages {
+		if v.Id < parsed.ClaimID || v.Id >= msg.Id || v.Content.Text == nil ||
+			v.Sender.Username != msg.Sender.Username || v.Sender.DeviceID != msg.Sender.DeviceID {
+			continue
+		}
+		announced, ok := ParseAnnounceMsg(v.Content.Text.Body)
+		if !ok {
+			continue
+		}
+		if announced.Goodbye || !announced.IP.Equal(parsed.IP) {
+			return false
+		}
+		if v.Id == parsed.ClaimID {
+			confirmed = true
+		}
+	}
+	return confirmed
+}
+
+// claimWins returns true if claim `a` wins with claim `b`. Claim ID 0 means
+// the address was not announced yet, so it loses to everything.
+func claimWins(a, b chat1.MessageID) bool {
+	if a == 0 {
+		return false
+	}
+	return b == 0 || a < b
+}
+
+// ResolveAddressConflicts finds dynamic peers claiming the same address, or
+// an address that is now reserved in peers.json, and marks the losers with
+// `AddressLost`, so they are not added to WireGuard config. Returns true if
+// we lost our address and have to re-roll.
+func ResolveAddressConflicts(mctx MetaContext) (selfLost bool) {
+	reserved := reservedAddresses(mctx.Prog)
+	winners := make(map[string]KeybasePeer)
+	if mctx.Prog.SelfPeer.Dynamic {
+		winners[mctx.Prog.SelfPeer.IP.String()] = mctx.Prog.SelfPeer
+	}
+	for _, peer := range mctx.Prog.KeybasePeers {
+		if !peer.Dynamic || !peer.Active {
+			continue
+		}
+		key := peer.IP.String()
+		current, ok := winners[key]
+		if !ok || claimWins(peer.ClaimID, current.ClaimID) {
+			winners[key] = peer
+		}
+	}
+
+	for kbdev, peer := range mctx.Prog.KeybasePeers {
+		if !peer.Dynamic || !peer.Active {
+			continue
+		}
+		if reserved[peer.IP.String()] {
+			if !peer.AddressLost {
+				fmt.Printf("! %v claimed address %s that is reserved in peers.json\n", kbdev, peer.IP)
+			}
+			peer.AddressLost = true
+			mctx.Prog.KeybasePeers[kbdev] = peer
+			continue
+		}
+		lost := winners[peer.IP.String()].Device != kbdev
+		if lost && !peer.AddressLost {
+			fmt.Printf("! %v lost address %s (claim %d) to %v\n", kbdev, peer.IP,
+				peer.ClaimID, winners[peer.IP.String()].Device)
+		}
+		peer.AddressLost = lost
+		mctx.Prog.KeybasePeers[kbdev] = peer
+	}
+
+	if mctx.Prog.SelfPeer.Dynamic {
+		if reserved[mctx.Prog.SelfPeer.IP.String()] {
+			fmt.Printf("! Our address %s is now reserved in peers.json\n", mctx.Prog.SelfPeer.IP)
+			return true
+		}
+		winner := winners[mctx.Prog.SelfPeer.IP.String()]
+		if winner.Device != mctx.Prog.SelfPeer.Device {
+			fmt.Printf("! We lost address %s (claim %d) to %v (claim %d)\n", mctx.Prog.SelfPeer.IP,
+				mctx.Prog.SelfPeer.ClaimID, winner.Device, winner.ClaimID)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package kbwg
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+func TestAllocateAddress(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("100.0.0.0/29")
+	require.NoError(t, err)
+
+	// Only 100.0.0.5 is free, .0 and .7 are network and broadcast.
+	used := map[string]bool{
+		"100.0.0.1": true, "100.0.0.2": true, "100.0.0.3": true,
+		"100.0.0.4": true, "100.0.0.6": true,
+	}
+	for i := 0; i < 10; i++ {
+		ip, err := AllocateAddress(subnet, used)
+		require.NoError(t, err)
+		require.Equal(t, "100.0.0.5", ip.String())
+	}
+
+	used["100.0.0.5"] = true
+	_, err = AllocateAddress(subnet, used)
+	require.Error(t, err)
+}
+
+func TestResolveAddressConflicts(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("100.0.0.0/24")
+	require.NoError(t, err)
+
+	alice := KBDev{Username: "alice", Device: "laptop"}
+	bob := KBDev{Username: "bob", Device: "phone"}
+	server := KBDev{Username: "alice", Device: "server"}
+	prog := &Program{
+		Subnet: subnet,
+		SelfPeer: KeybasePeer{
+			Device:  KBDev{Username: "carol", Device: "desktop"},
+			Dynamic: true,
+			IP:      net.ParseIP("100.0.0.10"),
+			ClaimID: 20,
+		},
+		KeybasePeers: map[KBDev]KeybasePeer{
+			server: {Device: server, IP: net.ParseIP("100.0.0.1"), Active: true},
+			alice:  {Device: alice, Dynamic: true, Active: true, IP: net.ParseIP("100.0.0.10"), ClaimID: 30},
+			bob:    {Device: bob, Dynamic: true, Active: true, IP: net.ParseIP("100.0.0.11"), ClaimID: 40},
+		},
+	}
+	mctx := prog.MCtxTODO()
+
+	// We claimed first.
+	require.False(t, ResolveAddressConflicts(mctx))
+	require.True(t, prog.KeybasePeers[alice].AddressLost)
+	require.False(t, prog.KeybasePeers[bob].AddressLost)
+	require.Len(t, SerializeWireGuardPeerList(mctx), 2)
+
+	// Bob claimed the same address before us.
+	peer := prog.KeybasePeers[bob]
+	peer.IP = net.ParseIP("100.0.0.10")
+	peer.ClaimID = 10
+	prog.KeybasePeers[bob] = peer
+	require.True(t, ResolveAddressConflicts(mctx))
+
+	require.NoError(t, AllocateSelfAddress(mctx))
+	require.True(t, subnet.Contains(prog.SelfPeer.IP))
+	require.NotEqual(t, "100.0.0.10", prog.SelfPeer.IP.String())
+	require.NotEqual(t, "100.0.0.1", prog.SelfPeer.IP.String())
+	require.Zero(t, prog.SelfPeer.ClaimID)
+
+	// Static addresses can't be claimed.
+	require.False(t, canClaimAddress(prog, net.ParseIP("100.0.0.1")))
+	require.False(t, canClaimAddress(prog, net.ParseIP("10.0.0.1")))
+	require.True(t, canClaimAddress(prog, net.ParseIP("100.0.0.50")))
+}
+
+func TestClaimConfirmed(t *testing.T) {
+	bob := chat1.MsgSender{Username: "bob", DeviceName: "phone", DeviceID: "b0b"}
+	mallory := chat1.MsgSender{Username: "mallory", DeviceName: "laptop", DeviceID: "bad"}
+	announcement := func(id chat1.MessageID, sender chat1.MsgSender, ip string, claimID chat1.MessageID) chat1.MsgSummary {
+		text, err := FormatAnnounceMsg(AnnounceMsg{
+			Endpoints: []libwireguard.HostPort{libwireguard.ParseHostPort("94.130.0.10:51820")},
+			PublicKey: testPubKey(sender.Username),
+			IP:        net.ParseIP(ip),
+			ClaimID:   claimID,
+			ExpiresAt: time.Now().Add(AnnounceTTL),
+		})
+		require.NoError(t, err)
+		return chat1.MsgSummary{
+			Id:      id,
+			Sender:  sender,
+			Content: chat1.MsgContent{Text: &chat1.MessageText{Body: text}},
+		}
+	}
+	messages := []chat1.MsgSummary{
+		announcement(20, bob, "100.0.0.10", 10),
+		announcement(15, mallory, "100.0.0.10", 0),
+		announcement(10, bob, "100.0.0.10", 0),
+		announcement(5, bob, "100.0.0.11", 0),
+	}
+	check := func(msg chat1.MsgSummary) bool {
+		parsed, ok := ParseAnnounceMsg(msg.Content.Text.Body)
+		require.True(t, ok)
+		return claimConfirmed(messages, msg, parsed)
+	}
+
+	require.True(t, check(messages[0]))
+	// Mallory claims an ID of bob's message.
+	require.False(t, check(announcement(20, mallory, "100.0.0.10", 10)))
+	// Bob claims an ID of message that announced other address.
+	require.False(t, check(announcement(20, bob, "100.0.0.10", 5)))
+	// Bob said goodbye since the claim.
+	text, err := FormatAnnounceMsg(AnnounceMsg{PublicKey: testPubKey("bob"), Goodbye: true})
+	require.NoError(t, err)
+	goodbye := chat1.MsgSummary{
+		Id:      12,
+		Sender:  bob,
+		Content: chat1.MsgContent{Text: &chat1.MessageText{Body: text}},
+	}
+	require.False(t, claimConfirmed(append(messages, goodbye), messages[0], AnnounceMsg{IP: net.ParseIP("100.0.0.10"), ClaimID: 10}))
+	// Bob announced other address since the claim.
+	messages = append(messages, announcement(12, bob, "100.0.0.11", 0))
+	require.False(t, check(messages[0]))
+}
@@ -1,8 +1,12 @@
 package kbwg
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
@@ -11,34 +15,327 @@ import (
 )
 
 type AnnounceMsg struct {
-	// Peer announces their endpoint, should be ip:port.
+	// Version of the announcement format. 1 is the legacy `ANNOUNCE` line.
+	Version int
+	// Peer announces their endpoint, should be ip:port. This is the first
+	// (preferred) candidate from `Endpoints`.
 	Endpoint libwireguard.HostPort
+	// All endpoint candidates announced by peer, in order of preference.
+	Endpoints []libwireguard.HostPort
 	// Public key
 	PublicKey libwireguard.WireguardPubKey
+	// Key the peer switches to at `NextKeyAt`, during scheduled key
+	// rotation. Zero if no rotation is pending.
+	NextPublicKey libwireguard.WireguardPubKey
+	NextKeyAt     time.Time
+	// Port WireGuard device of the peer is listening on. Not known for legacy
+	// announcements.
+	ListenPort uint16
+	// Capabilities of the announcing peer, see `Cap*` constants.
+	Capabilities []string
+	// Address claimed by a dynamic peer (one that is not in peers.json).
+	IP net.IP
+	// MessageID of the first announcement that claimed `IP`, as told by the
+	// sender. Zero if this announcement is the first one. Not trusted, see
+	// `claimID`.
+	ClaimID chat1.MessageID
+	// Announcement should not be used after that time. Legacy announcements
+	// do not carry it, they expire `AnnounceTTL` after being sent.
+	ExpiresAt time.Time
+	// Peer is going away. Goodbye messages carry only the public key of the
+	// peer that is leaving.
+	Goodbye bool
+	// When the announcement was made, according to the peer. Zero for
+	// legacy announcements.
+	Timestamp time.Time
+	// Sequence number, grows with every announcement of the device. Older
+	// sequence numbers than the last seen one are rejected. Zero for
+	// legacy announcements.
+	Seq uint64
+	// Announcement was signed with a device key of the sender, and the
+	// signature was verified.
+	Signed bool
+	// Signature from the chat message, checked by `verifyAnnounceMsg`.
+	signature string
+
 	SentAt    time.Time
 	MessageID chat1.MessageID
 }
 
+// HasCapability returns true if peer advertised capability `capability` in
+// the announcement.
+func (a AnnounceMsg) HasCapability(capability string) bool {
+	for _, v := range a.Capabilities {
+		if v == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// PublicKeyAt returns public key the peer uses at `now`.
+func (a AnnounceMsg) PublicKeyAt(now time.Time) libwireguard.WireguardPubKey {
+	if !a.NextPublicKey.IsZero() && !now.Before(a.NextKeyAt) {
+		return a.NextPublicKey
+	}
+	return a.PublicKey
+}
+
+// IsExpired returns true if announcement had an expiry time that has passed.
+func (a AnnounceMsg) IsExpired(now time.Time) bool {
+	return !a.ExpiresAt.IsZero() && now.After(a.ExpiresAt)
+}
+
 const AnnounceChatName = "announce"
 
-// ANNOUNCE ip_addr pub_key
-var announceChatMsgRxp = regexp.MustCompile(`ANNOUNCE ([0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}\.[0-9]{1,3}:[0-9]{1,5}) ([a-zA-Z0-9+/]+=?)`)
+// AnnounceVersion is the announcement format version we send.
+const AnnounceVersion = 2
+
+// AnnounceTTL is how long our announcements are valid for. Has to be longer
+// than the interval of periodic announcements in `SelfAnnouncementBgTask`.
+const AnnounceTTL = 1 * time.Hour
+
+const (
+	// CapMultiEndpoint - peer announces more than one endpoint candidate.
+	CapMultiEndpoint = "multi-endpoint"
+	// CapIPv6 - peer understands IPv6 endpoints.
+	CapIPv6 = "ipv6"
+	// CapSigned - peer signs announcements and checks signatures of others.
+	CapSigned = "signed"
+	// CapPSK - peer uses preshared keys with other peers that have this
+	// capability, see `psk.go`.
+	CapPSK = "psk"
+)
+
+// announceCapabilities are capabilities we advertise in our announcements.
+var announceCapabilities = []string{CapMultiEndpoint, CapIPv6, CapSigned, CapPSK}
+
+// maxAnnounceClockSkew is how far the signed timestamp of announcement can
+// be from the time chat message was sent. Stops old signed announcements from
+// being posted again.
+const maxAnnounceClockSkew = 10 * time.Minute
+
+// ANNOUNCE ip_addr:port pub_key, IPv6 address has to be in brackets.
+var announceChatMsgRxp = regexp.MustCompile(`ANNOUNCE ([0-9.]+:[0-9]{1,5}|\[[0-9a-fA-F:.]+\]:[0-9]{1,5}) ([a-zA-Z0-9+/]{43}=)`)
+
+// KBWG/<version> {json payload}
+var announceVersionedMsgRxp = regexp.MustCompile(`^KBWG/([0-9]+) (\{.*\})\s*$`)
+
+// announcePayload is the JSON part of versioned announcement.
+type announcePayload struct {
+	Endpoints []string `json:"endpoints"`
+	PublicKey string   `json:"public_key"`
+	NextKey   string   `json:"next_key,omitempty"`
+	// Unix timestamp in seconds.
+	NextKeyAt    int64    `json:"next_key_at,omitempty"`
+	ListenPort   uint16   `json:"listen_port,omitempty"`
+	Capabilities []string `json:"caps,omitempty"`
+	// Unix timestamp in seconds.
+	ExpiresAt int64           `json:"expires_at,omitempty"`
+	IP        string          `json:"ip,omitempty"`
+	ClaimID   chat1.MessageID `json:"claim,omitempty"`
+	Goodbye   bool            `json:"goodbye,omitempty"`
+	// Unix timestamp in seconds of when the announcement was made.
+	Timestamp int64  `json:"ts,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"`
+	// Saltpack signature of `signedAnnouncement` with this payload, made
+	// with device key of the sender. Has the signed payload attached.
+	Signature string `json:"sig,omitempty"`
+}
+
+// signedAnnouncement is what the announcing device signs. Team and device ID
+// bind the announcement to the device that made it, so it can't be posted
+// by another device or in another team.
+type signedAnnouncement struct {
+	Team     string `json:"team"`
+	DeviceID string `json:"device_id"`
+	announcePayload
+}
+
+// FormatAnnounceMsg serializes announcement to a chat message in current
+// (`AnnounceVersion`) format, without signature.
+func FormatAnnounceMsg(msg AnnounceMsg) (string, error) {
+	return formatAnnouncePayload(makeAnnouncePayload(msg))
+}
+
+// formatSignedAnnounceMsg serializes announcement like `FormatAnnounceMsg`,
+// and signs it with our device key.
+func formatSignedAnnounceMsg(mctx MetaContext, msg AnnounceMsg) (string, error) {
+	payload := makeAnnouncePayload(msg)
+	signedBytes, err := json.Marshal(signedAnnouncement{
+		Team:            mctx.Prog.KeybaseTeam,
+		DeviceID:        mctx.Prog.SelfDeviceID,
+		announcePayload: payload,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload.Signature, err = mctx.API().SignMessage(signedBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign announcement: %w", err)
+	}
+	return formatAnnouncePayload(payload)
+}
+
+func formatAnnouncePayload(payload announcePayload) (string, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("KBWG/%d %s", AnnounceVersion, payloadBytes), nil
+}
+
+func makeAnnouncePayload(msg AnnounceMsg) announcePayload {
+	payload := announcePayload{
+		PublicKey:    msg.PublicKey.Base64(),
+		ListenPort:   msg.ListenPort,
+		Capabilities: msg.Capabilities,
+		ClaimID:      msg.ClaimID,
+		Goodbye:      msg.Goodbye,
+	}
+	if msg.IP != nil {
+		payload.IP = msg.IP.String()
+	}
+	for _, endpoint := range msg.Endpoints {
+		payload.Endpoints = append(payload.Endpoints, endpoint.String())
+	}
+	if !msg.ExpiresAt.IsZero() {
+		payload.ExpiresAt = msg.ExpiresAt.Unix()
+	}
+	if !msg.Timestamp.IsZero() {
+		payload.Timestamp = msg.Timestamp.Unix()
+	}
+	if !msg.NextPublicKey.IsZero() {
+		payload.NextKey = msg.NextPublicKey.Base64()
+		payload.NextKeyAt = msg.NextKeyAt.Unix()
+	}
+	payload.Seq = msg.Seq
+	return payload
+}
 
 func ParseAnnounceMsg(msg string) (ret AnnounceMsg, ok bool) {
-	matches := announceChatMsgRxp.FindStringSubmatch(msg)
 	fmt.Printf("+ Parsing %s\n", msg)
+	if matches := announceVersionedMsgRxp.FindStringSubmatch(msg); len(matches) > 0 {
+		return parseVersionedAnnounceMsg(matches[1], matches[2])
+	}
+
+	matches := announceChatMsgRxp.FindStringSubmatch(msg)
 	if len(matches) > 0 {
 		endpoint := libwireguard.ParseHostPort(matches[1])
 		if endpoint.IsNil() {
 			return ret, false
 		}
+		ret.Version = 1
 		ret.Endpoint = endpoint
-		ret.PublicKey = libwireguard.WireguardPubKey(matches[2])
+		ret.Endpoints = []libwireguard.HostPort{endpoint}
+		pubKey, err := libwireguard.ParsePubKey(matches[2])
+		if err != nil {
+			return ret, false
+		}
+		ret.PublicKey = pubKey
 		return ret, true
 	}
 	return ret, false
 }
 
+func parseVersionedAnnounceMsg(versionStr string, payloadStr string) (ret AnnounceMsg, ok bool) {
+	version, err := strconv.Atoi(versionStr)
+	if err != nil || version < 2 {
+		return ret, false
+	}
+	// Newer versions are expected to only add fields to the payload, so we
+	// parse what we understand.
+	var payload announcePayload
+	if err := json.Unmarshal([]byte(payloadStr), &payload); err != nil {
+		return ret, false
+	}
+	return announceMsgFromPayload(version, payload)
+}
+
+func announceMsgFromPayload(version int, payload announcePayload) (ret AnnounceMsg, ok bool) {
+	pubKey, err := libwireguard.ParsePubKey(payload.PublicKey)
+	if err != nil {
+		return ret, false
+	}
+	for _, v := range payload.Endpoints {
+		endpoint := libwireguard.ParseHostPort(v)
+		if endpoint.IsNil() {
+			// Skip candidates we don't understand, maybe others are fine.
+			continue
+		}
+		ret.Endpoints = append(ret.Endpoints, endpoint)
+	}
+	ret.Goodbye = payload.Goodbye
+	if len(ret.Endpoints) == 0 && !ret.Goodbye {
+		return ret, false
+	}
+	ret.Version = version
+	if len(ret.Endpoints) > 0 {
+		ret.Endpoint = ret.Endpoints[0]
+	}
+	ret.PublicKey = pubKey
+	ret.ListenPort = payload.ListenPort
+	ret.Capabilities = payload.Capabilities
+	if payload.IP != "" {
+		ret.IP = net.ParseIP(payload.IP)
+		if ret.IP == nil {
+			return ret, false
+		}
+	}
+	ret.ClaimID = payload.ClaimID
+	if payload.ExpiresAt != 0 {
+		ret.ExpiresAt = time.Unix(payload.ExpiresAt, 0)
+	}
+	if payload.Timestamp != 0 {
+		ret.Timestamp = time.Unix(payload.Timestamp, 0)
+	}
+	if payload.NextKey != "" {
+		ret.NextPublicKey, err = libwireguard.ParsePubKey(payload.NextKey)
+		if err != nil || payload.NextKeyAt == 0 {
+			return ret, false
+		}
+		ret.NextKeyAt = time.Unix(payload.NextKeyAt, 0)
+	}
+	ret.Seq = payload.Seq
+	ret.signature = payload.Signature
+	return ret, true
+}
+
+// verifyAnnounceMsg checks signature of announcement `parsed` from chat
+// message `msg` against sigchain of the sender. Returns announcement made
+// from the signed payload, so nothing that was not signed is used.
+func verifyAnnounceMsg(mctx MetaContext, msg chat1.MsgSummary, parsed AnnounceMsg) (ret AnnounceMsg, err error) {
+	signedBytes, err := mctx.API().VerifyMessage(parsed.signature, msg.Sender.Username)
+	if err != nil {
+		return ret, err
+	}
+	var signed signedAnnouncement
+	if err := json.Unmarshal(signedBytes, &signed); err != nil {
+		return ret, fmt.Errorf("failed to unmarshal signed announcement: %w", err)
+	}
+	if signed.Team != mctx.Prog.KeybaseTeam {
+		return ret, fmt.Errorf("signed for team %q", signed.Team)
+	}
+	if signed.DeviceID != string(msg.Sender.DeviceID) {
+		return ret, fmt.Errorf("signed for device ID %q, but sent from %q", signed.DeviceID, msg.Sender.DeviceID)
+	}
+	signed.Signature = ""
+	ret, ok := announceMsgFromPayload(parsed.Version, signed.announcePayload)
+	if !ok {
+		return ret, fmt.Errorf("signed announcement is invalid")
+	}
+	sentAt := time.Unix(msg.SentAt, 0)
+	skew := sentAt.Sub(ret.Timestamp)
+	if skew < 0 {
+		skew = -skew
+	}
+	if ret.Timestamp.IsZero() || skew > maxAnnounceClockSkew {
+		return ret, fmt.Errorf("signed at %s, but sent at %s", ret.Timestamp, sentAt)
+	}
+	ret.Signed = true
+	return ret, nil
+}
+
 func AnnounceFindChat(mctx MetaContext) (ret chat1.ConvSummary, err error) {
 	list, err := mctx.API().GetConversations(false)
 	if err != nil {
@@ -54,104 +351,499 @@ func AnnounceFindChat(mctx MetaContext) (ret chat1.ConvSummary, err error) {
 	return ret, fmt.Errorf("Failed to find chat @%s#%s", mctx.Prog.KeybaseTeam, AnnounceChatName)
 }
 
-// FindAnnouncements queries chat for peer announcement. Call with
-// unreadOnly=false initially to get all recent (not older than 1 hour)
-// announcements. Then periodically call with unreadOnly=true to get new
-// announcements as they are being posted.
-func FindAnnouncements(mctx MetaContext, unreadOnly bool) (newAnncs bool, err error) {
-	messages, err := mctx.API().GetTextMessages(mctx.Prog.AnnounceChannel, unreadOnly)
+// FindAnnouncements reads announcements that were sent after
+// `LastAnnounceMsgID`. Used on start and to backfill messages that we might
+// have missed while not subscribed to the announce channel.
+func FindAnnouncements(mctx MetaContext) (newAnncs bool, err error) {
+	messages, err := mctx.API().GetTextMessages(mctx.Prog.AnnounceChannel, false /* unreadOnly */)
 	if err != nil {
 		return false, err
 	}
 	// Do not read anything older than hour.
 	cutoff := time.Now().Add(-1 * time.Hour)
+	localNets := localNetworks()
+	lastMsgID := mctx.Prog.LastAnnounceMsgID
 	for _, msg := range messages {
-		sentAt := time.Unix(msg.SentAt, 0)
-		if sentAt.Before(cutoff) {
+		if msg.Id <= lastMsgID || time.Unix(msg.SentAt, 0).Before(cutoff) {
 			break
 		}
-		kbdev := KBDev{
-			Device:   msg.Sender.DeviceName,
-			Username: msg.Sender.Username,
+		if handleAnnouncement(mctx, msg, localNets) {
+			newAnncs = true
 		}
-		peer, ok := mctx.Prog.KeybasePeers[kbdev]
-		if !ok {
-			// Sender is not a peer
-			continue
+		if msg.Id > mctx.Prog.LastAnnounceMsgID {
+			mctx.Prog.LastAnnounceMsgID = msg.Id
 		}
+	}
+	return newAnncs, nil
+}
 
-		if peer.Active && msg.Id <= peer.LastAnnouncement.MessageID {
-			// We've already seen this one.
-			continue
+// parseAnnouncement parses and verifies announcement from chat message
+// `msg`. Returns false if it's not an announcement we can use.
+func parseAnnouncement(mctx MetaContext, msg chat1.MsgSummary, kbdev KBDev) (parsed AnnounceMsg, ok bool) {
+	parsed, ok = ParseAnnounceMsg(msg.Content.Text.Body)
+	if !ok {
+		return parsed, false
+	}
+	if parsed.signature != "" {
+		verified, err := verifyAnnounceMsg(mctx, msg, parsed)
+		if err != nil {
+			fmt.Printf("! Ignoring announcement from %v with invalid signature (msg ID: %d): %s\n", kbdev, msg.Id, err)
+			return parsed, false
 		}
+		parsed = verified
+	} else if !mctx.Prog.AllowUnsigned {
+		fmt.Printf("! Ignoring unsigned announcement from %v (msg ID: %d)\n", kbdev, msg.Id)
+		return parsed, false
+	}
+	parsed.SentAt = time.Unix(msg.SentAt, 0)
+	parsed.MessageID = msg.Id
+	if parsed.ExpiresAt.IsZero() {
+		parsed.ExpiresAt = parsed.SentAt.Add(AnnounceTTL)
+	}
+	return parsed, true
+}
 
-		parsed, ok := ParseAnnounceMsg(msg.Content.Text.Body)
-		if !ok {
-			continue
+// handleAnnouncement updates sender peer if `msg` is a valid announcement.
+// Returns true if it was.
+func handleAnnouncement(mctx MetaContext, msg chat1.MsgSummary, localNets []*net.IPNet) bool {
+	if msg.Content.TypeName != "text" || msg.Content.Text == nil {
+		return false
+	}
+	kbdev := KBDev{
+		Device:   msg.Sender.DeviceName,
+		Username: msg.Sender.Username,
+	}
+	if kbdev == mctx.Prog.Self {
+		// Continue our sequence numbers from where the previous session
+		// left off, even if the clock went back.
+		if parsed, ok := parseAnnouncement(mctx, msg, kbdev); ok && parsed.Signed && parsed.Seq > mctx.Prog.AnnounceSeq {
+			mctx.Prog.AnnounceSeq = parsed.Seq
 		}
-		parsed.SentAt = sentAt
-		parsed.MessageID = msg.Id
+		return false
+	}
+	peer, ok := mctx.Prog.KeybasePeers[kbdev]
+	if !ok {
+		// Sender is not in peers.json, but they can still be a dynamic
+		// peer if they announce an address.
+		peer = KeybasePeer{
+			Device:  kbdev,
+			Dynamic: true,
+		}
+	}
 
-		peer.Active = true
-		peer.Endpoint = parsed.Endpoint
-		peer.PublicKey = parsed.PublicKey
+	if msg.Id <= peer.LastAnnouncement.MessageID {
+		// We've already seen this one, or something newer.
+		return false
+	}
 
+	parsed, ok := parseAnnouncement(mctx, msg, kbdev)
+	if !ok {
+		return false
+	}
+	if last := peer.LastAnnouncement; last.Seq != 0 && parsed.Seq <= last.Seq {
+		fmt.Printf("! Ignoring announcement from %v with sequence number %d, already seen %d (msg ID: %d)\n",
+			kbdev, parsed.Seq, last.Seq, msg.Id)
+		return false
+	}
+	if parsed.IsExpired(time.Now()) {
+		return false
+	}
+
+	if parsed.Goodbye {
+		if !peer.Active || peer.PublicKey != parsed.PublicKey {
+			// Goodbye from a previous session of that peer, or from a peer
+			// we don't know about.
+			return false
+		}
+		peer.Active = false
 		peer.LastAnnouncement = parsed
 		mctx.Prog.KeybasePeers[kbdev] = peer
+		fmt.Printf("- %v said goodbye (msg ID: %d)\n", kbdev, msg.Id)
+		return true
+	}
 
-		fmt.Printf("+ %v is announcing %q (msg ID: %d)\n", kbdev, msg.Content.Text.Body, msg.Id)
-		newAnncs = true
+	if peer.Dynamic {
+		if !canClaimAddress(mctx.Prog, parsed.IP) {
+			fmt.Printf("! %v is announcing address %v that can't be claimed (msg ID: %d)\n", kbdev, parsed.IP, msg.Id)
+			return false
+		}
+		if !parsed.IP.Equal(peer.IP) || peer.ClaimID == 0 {
+			peer.IP = parsed.IP
+			peer.ClaimID = claimID(mctx, msg, parsed)
+			peer.AddressLost = false
+		}
 	}
-	return newAnncs, nil
+
+	peer.Active = true
+	peer.PublicKey = parsed.PublicKeyAt(time.Now())
+	peer.LastAnnouncement = parsed
+	peer.SetCandidates(peer.endpointCandidates(localNets), time.Now())
+	mctx.Prog.KeybasePeers[kbdev] = peer
+
+	fmt.Printf("+ %v is announcing %q (msg ID: %d)\n", kbdev, msg.Content.Text.Body, msg.Id)
+	return true
 }
 
 func SendAnnouncement(mctx MetaContext) error {
-	text := fmt.Sprintf("ANNOUNCE %s %s", mctx.Prog.Endpoint, mctx.Prog.SelfPeer.PublicKey)
-	_, err := mctx.API().SendMessage(mctx.Prog.AnnounceChannel, text)
+	self := &mctx.Prog.SelfPeer
+	msg := AnnounceMsg{
+		Endpoints:    mctx.Prog.Endpoints,
+		PublicKey:    self.PublicKey,
+		ListenPort:   mctx.Prog.ListenPort,
+		Capabilities: announceCapabilities,
+		ExpiresAt:    time.Now().Add(AnnounceTTL),
+		Timestamp:    time.Now(),
+		Seq:          mctx.Prog.nextAnnounceSeq(),
+	}
+	if !mctx.Prog.NextKey.IsZero() {
+		msg.NextPublicKey = mctx.Prog.NextKey
+		msg.NextKeyAt = mctx.Prog.NextKeyAt
+	}
+	if self.Dynamic {
+		msg.IP = self.IP
+		msg.ClaimID = self.ClaimID
+	}
+	text, err := formatSignedAnnounceMsg(mctx, msg)
+	if err != nil {
+		return fmt.Errorf("SendAnnouncement couldn't format message: %w", err)
+	}
+	res, err := mctx.API().SendMessage(mctx.Prog.AnnounceChannel, text)
 	if err != nil {
 		return fmt.Errorf("SendAnnouncement couldn't SendMessage: %w", err)
 	}
+	if self.Dynamic && self.ClaimID == 0 && res.Result.MessageID != nil {
+		// This was the first announcement with our address.
+		self.ClaimID = *res.Result.MessageID
+		fmt.Printf(":: Claimed address %s with msg ID: %d\n", self.IP, self.ClaimID)
+	}
+	return nil
+}
+
+// SendGoodbye tells other peers that we are going away, so they can remove us
+// from their peer lists without waiting for our announcement to expire.
+func SendGoodbye(mctx MetaContext) error {
+	text, err := formatSignedAnnounceMsg(mctx, AnnounceMsg{
+		PublicKey: mctx.Prog.SelfPeer.PublicKey,
+		Goodbye:   true,
+		Timestamp: time.Now(),
+		Seq:       mctx.Prog.nextAnnounceSeq(),
+	})
+	if err != nil {
+		return fmt.Errorf("SendGoodbye couldn't format message: %w", err)
+	}
+	if _, err := mctx.API().SendMessage(mctx.Prog.AnnounceChannel, text); err != nil {
+		return fmt.Errorf("SendGoodbye couldn't SendMessage: %w", err)
+	}
 	return nil
 }
 
+// ExpirePeers deactivates peers whose last announcement expired. Returns true
+// if any peer was deactivated.
+func ExpirePeers(mctx MetaContext, now time.Time) (changed bool) {
+	for kbdev, peer := range mctx.Prog.KeybasePeers {
+		if !peer.Active || !peer.LastAnnouncement.IsExpired(now) {
+			continue
+		}
+		fmt.Printf("- %v announcement expired at %s\n", kbdev, peer.LastAnnouncement.ExpiresAt)
+		peer.Active = false
+		mctx.Prog.KeybasePeers[kbdev] = peer
+		changed = true
+	}
+	return changed
+}
+
+// SendNetworkSettings sends network settings from peers.json to run-dev.
+func SendNetworkSettings(mctx MetaContext) {
+	err := mctx.Prog.DevRunner.SetNetwork(libpipe.NetworkMsg{
+		MTU:      mctx.Prog.Network.MTU,
+		DNS:      mctx.Prog.Network.DNS,
+		ExitNode: mctx.Prog.SelfPeer.ExitNode,
+	})
+	if err != nil {
+		fmt.Printf("! Failed to apply network settings: %s\n", err)
+	}
+}
+
+// syncPeers sends current peer list to run-dev.
+func syncPeers(mctx MetaContext, reason string) {
+	LoadPSKSeeds(mctx)
+	wgPeers := SerializeWireGuardPeerList(mctx)
+	fmt.Printf("%s, syncing peer list with %d peer(s).\n", reason, len(wgPeers))
+	diff := libwireguard.DiffConfigs(
+		libwireguard.WireguardConfig{Peers: mctx.Prog.syncedPeers},
+		libwireguard.WireguardConfig{Peers: wgPeers})
+	if !diff.IsEmpty() {
+		fmt.Println(diff)
+	}
+	if err := mctx.Prog.DevRunner.SetPeers(wgPeers); err != nil {
+		fmt.Printf("! Failed to sync peer list: %s\n", err)
+		return
+	}
+	mctx.Prog.syncedPeers = wgPeers
+}
+
+// rerollAddress picks new dynamic address for us after we lost the previous
+// one, updates the device and announces the new address.
+func rerollAddress(mctx MetaContext) error {
+	err := AllocateSelfAddress(mctx)
+	if err != nil {
+		return fmt.Errorf("failed to allocate new address: %w", err)
+	}
+	fmt.Printf(":: Picked new address: %s\n", mctx.Prog.SelfPeer.IP)
+	return selfAddressChanged(mctx)
+}
+
+// selfAddressChanged updates addresses of the device and announces the
+// change.
+func selfAddressChanged(mctx MetaContext) error {
+	if err := mctx.Prog.DevRunner.SetAddresses(mctx.Prog.SelfAddresses()); err != nil {
+		return fmt.Errorf("failed to change device addresses: %w", err)
+	}
+	return SendAnnouncement(mctx)
+}
+
+// announcementsChanged resolves address conflicts after new announcements
+// and resyncs peers.
+func announcementsChanged(mctx MetaContext, reason string) error {
+	if ResolveAddressConflicts(mctx) {
+		if err := rerollAddress(mctx); err != nil {
+			return err
+		}
+	}
+	syncPeers(mctx, reason)
+	return nil
+}
+
+// processAnnouncements reads announcements and resyncs peers if anything
+// changed, or always if `alwaysSync` is set. Has to be called with Program
+// locked.
+func processAnnouncements(mctx MetaContext, alwaysSync bool, reason string) error {
+	new, err := FindAnnouncements(mctx)
+	if err != nil {
+		return err
+	}
+	if !new && !alwaysSync {
+		return nil
+	}
+	return announcementsChanged(mctx, reason)
+}
+
+// processAnnouncementMsg handles message that came from announce channel
+// subscription. Has to be called with Program locked.
+func processAnnouncementMsg(mctx MetaContext, msg chat1.MsgSummary) error {
+	if msg.Id <= mctx.Prog.LastAnnounceMsgID {
+		return nil
+	}
+	mctx.Prog.LastAnnounceMsgID = msg.Id
+	var changed bool
+	switch msg.Content.TypeName {
+	case "edit":
+		handleAnnouncementEdit(mctx, msg)
+	case "delete":
+		changed = handleAnnouncementDelete(mctx, msg)
+	default:
+		changed = handleAnnouncement(mctx, msg, localNetworks())
+	}
+	if !changed {
+		return nil
+	}
+	return announcementsChanged(mctx, "Got new announcement")
+}
+
+// sameChannel returns true if `a` and `b` are the same conversation. Team
+// names are case insensitive.
+func sameChannel(a, b chat1.ChatChannel) bool {
+	return strings.EqualFold(a.Name, b.Name) &&
+		a.TopicName == b.TopicName &&
+		a.MembersType == b.MembersType
+}
+
+// handleAnnouncementEdit handles edit of a message in announce channel.
+// Edits are never used as announcements, peers post new announcements
+// instead, so we keep what was originally announced.
+func handleAnnouncementEdit(mctx MetaContext, msg chat1.MsgSummary) {
+	if msg.Content.Edit == nil {
+		return
+	}
+	for kbdev, peer := range mctx.Prog.KeybasePeers {
+		if peer.LastAnnouncement.MessageID == msg.Content.Edit.MessageID {
+			fmt.Printf("! %s edited announcement of %v (msg ID: %d), ignoring the edit\n",
+				msg.Sender.Username, kbdev, msg.Content.Edit.MessageID)
+		}
+	}
+}
+
+// handleAnnouncementDelete deactivates peers whose current announcement was
+// deleted by the announcing user. Team admins can delete messages of others,
+// but they can't take peers off the network that way. Returns true if any
+// peer was deactivated.
+func handleAnnouncementDelete(mctx MetaContext, msg chat1.MsgSummary) (changed bool) {
+	if msg.Content.Delete == nil {
+		return false
+	}
+	for _, msgID := range msg.Content.Delete.MessageIDs {
+		for kbdev, peer := range mctx.Prog.KeybasePeers {
+			if !peer.Active || peer.LastAnnouncement.MessageID != msgID {
+				continue
+			}
+			if msg.Sender.Username != kbdev.Username {
+				fmt.Printf("! %s deleted announcement of %v (msg ID: %d), ignoring\n", msg.Sender.Username, kbdev, msgID)
+				continue
+			}
+			// Keep the last announcement, so older ones can't bring the
+			// peer back.
+			peer.Active = false
+			mctx.Prog.KeybasePeers[kbdev] = peer
+			fmt.Printf("- %s deleted announcement of %v (msg ID: %d)\n", msg.Sender.Username, kbdev, msgID)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// subscribeAnnouncements starts listening for new messages in the announce
+// channel. Messages are passed to `msgCh` until the subscription fails, then
+// the error is passed to `errCh`.
+func subscribeAnnouncements(mctx MetaContext, msgCh chan<- chat1.MsgSummary, errCh chan<- error) (MessageSubscription, error) {
+	sub, err := mctx.API().ListenNewMessages()
+	if err != nil {
+		return nil, err
+	}
+	// Subscription gets messages from all conversations of the user.
+	announceChannel := mctx.Prog.AnnounceChannel
+	go func() {
+		for {
+			subMsg, err := sub.Read()
+			if err != nil {
+				select {
+				case errCh <- err:
+				case <-mctx.Ctx.Done():
+				}
+				return
+			}
+			if !sameChannel(subMsg.Message.Channel, announceChannel) {
+				continue
+			}
+			select {
+			case msgCh <- subMsg.Message:
+			case <-mctx.Ctx.Done():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// How often to try to subscribe to announce channel again after the
+// subscription failed. Messages that were missed in the meantime are read
+// after subscribing.
+const resubscribeInterval = 5 * time.Second
+
+// How often to look for peers whose announcements expired.
+const peerSweepInterval = 1 * time.Minute
+
 func AnnouncementsBgTask(mctx MetaContext) error {
-	_, err := FindAnnouncements(mctx, false /* unreadOnly */)
+	msgCh := make(chan chat1.MsgSummary)
+	errCh := make(chan error)
+	// Subscribe before the initial sync, so nothing is missed between the
+	// two.
+	sub, err := subscribeAnnouncements(mctx, msgCh, errCh)
+	if err != nil {
+		fmt.Printf("! Failed to subscribe to announcements: %s\n", err)
+	}
+	defer func() {
+		if sub != nil {
+			sub.Shutdown()
+		}
+	}()
+
+	mctx.Prog.Lock()
+	err = processAnnouncements(mctx, true /* alwaysSync */, "Doing initial sync")
+	mctx.Prog.Unlock()
 	if err != nil {
 		return err
 	}
 
-	wgPeers := SerializeWireGuardPeerList(mctx)
-	fmt.Printf("Doing initial sync for peer list with %d peer(s).\n", len(wgPeers))
-	peersMsg, _ := libpipe.SerializeMsgInterface("peers", wgPeers)
-	mctx.Prog.DevRunner.WriteLine(peersMsg)
+	resubscribeTicker := time.NewTicker(resubscribeInterval)
+	defer resubscribeTicker.Stop()
+	probeTicker := time.NewTicker(5 * time.Second)
+	defer probeTicker.Stop()
+	sweepTicker := time.NewTicker(peerSweepInterval)
+	defer sweepTicker.Stop()
 
 loop:
 	for {
 		select {
-		case <-time.After(5 * time.Second):
+		case msg := <-msgCh:
+			mctx.Prog.Lock()
+			err := processAnnouncementMsg(mctx, msg)
+			mctx.Prog.Unlock()
+			if err != nil {
+				return err
+			}
+		case err := <-errCh:
+			fmt.Printf("! Announcements subscription failed: %s\n", err)
+			sub.Shutdown()
+			sub = nil
+		case <-resubscribeTicker.C:
+			if sub != nil {
+				continue
+			}
+			sub, err = subscribeAnnouncements(mctx, msgCh, errCh)
+			if err != nil {
+				fmt.Printf("! Failed to subscribe to announcements: %s\n", err)
+				continue
+			}
+			fmt.Printf(":: Subscribed to announcements again, reading missed messages\n")
+			mctx.Prog.Lock()
+			err := processAnnouncements(mctx, false /* alwaysSync */, "Got missed announcements")
+			mctx.Prog.Unlock()
+			if err != nil {
+				return err
+			}
+		case stats := <-mctx.Prog.DevRunner.StatsCh:
+			mctx.Prog.Lock()
+			UpdatePeerStats(mctx, stats)
+			mctx.Prog.Unlock()
+		case <-probeTicker.C:
+			mctx.Prog.Lock()
+			if SwitchPeerKeys(mctx, time.Now()) {
+				syncPeers(mctx, "Peer keys rotated")
+			}
+			if ProbeEndpoints(mctx, time.Now()) {
+				syncPeers(mctx, "Peer endpoints changed")
+			}
+			if RecheckPSKSeeds(mctx, time.Now()) {
+				syncPeers(mctx, "Preshared key seeds changed")
+			}
+			mctx.Prog.Unlock()
+		case <-sweepTicker.C:
+			mctx.Prog.Lock()
+			if ExpirePeers(mctx, time.Now()) {
+				syncPeers(mctx, "Peer announcements expired")
+			}
+			mctx.Prog.Unlock()
 		case <-mctx.Ctx.Done():
 			break loop
 		}
-
-		new, err := FindAnnouncements(mctx, true /* unreadOnly */)
-		if err != nil {
-			return err
-		}
-
-		if new {
-			wgPeers := SerializeWireGuardPeerList(mctx)
-			fmt.Printf("Got new announcements, syncing peer list with %d peer(s).\n", len(wgPeers))
-			peersMsg, _ := libpipe.SerializeMsgInterface("peers", wgPeers)
-			mctx.Prog.DevRunner.WriteLine(peersMsg)
-		}
 	}
 
 	fmt.Printf("[X] AnnouncementsBgTask stopping\n")
 	return nil
 }
 
+func sendAnnouncementLocked(mctx MetaContext) error {
+	mctx.Prog.Lock()
+	defer mctx.Prog.Unlock()
+	if mctx.Ctx.Err() != nil {
+		// We are stopping and might have said goodbye already.
+		return nil
+	}
+	return SendAnnouncement(mctx)
+}
+
 func SelfAnnouncementBgTask(mctx MetaContext) error {
-	err := SendAnnouncement(mctx)
+	err := sendAnnouncementLocked(mctx)
 	if err != nil {
 		return fmt.Errorf("failed to SendAnnouncement: %w", err)
 	}
@@ -159,7 +851,7 @@ func SelfAnnouncementBgTask(mctx MetaContext) error {
 	for {
 		select {
 		case <-time.After(30 * time.Minute):
-			err := SendAnnouncement(mctx)
+			err := sendAnnouncementLocked(mctx)
 			if err != nil {
 				return fmt.Errorf("failed to SendAnnouncement: %w", err)
 			}
@@ -168,3 +860,22 @@ func SelfAnnouncementBgTask(mctx MetaContext) error {
 		}
 	}
 }
+
+// PubKeyBgTask handles public keys sent by run-dev after the initial one (when
+// the key was rotated) and announces the new key to peers.
+func PubKeyBgTask(mctx MetaContext) error {
+	for {
+		select {
+		case pubKey := <-mctx.Prog.DevRunner.PubKeyCh:
+			mctx.Prog.Lock()
+			err := selfKeyChanged(mctx, pubKey, time.Now())
+			mctx.Prog.Unlock()
+			if err != nil {
+				return fmt.Errorf("failed to announce new key: %w", err)
+			}
+			fmt.Printf(":: Announced new public key: %s\n", pubKey)
+		case <-mctx.Ctx.Done():
+			return mctx.Ctx.Err()
+		}
+	}
+}
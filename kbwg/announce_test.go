@@ -2,14 +2,93 @@ package kbwg
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/zapu/kb-wireguard/libwireguard"
 )
 
 func TestParse(t *testing.T) {
 	msg := "ANNOUNCE 192.168.0.164:51820 LhdznlMunOticjwvG+WdHk2f9aYGvXugcrDhG2MJeBA="
 	ann, ok := ParseAnnounceMsg(msg)
 	require.True(t, ok)
-	require.Equal(t, "192.168.0.164:51820", ann.Endpoint)
-	require.Equal(t, "LhdznlMunOticjwvG+WdHk2f9aYGvXugcrDhG2MJeBA=", ann.PublicKey)
+	require.Equal(t, 1, ann.Version)
+	require.Equal(t, "192.168.0.164:51820", ann.Endpoint.String())
+	require.Len(t, ann.Endpoints, 1)
+	require.Equal(t, "LhdznlMunOticjwvG+WdHk2f9aYGvXugcrDhG2MJeBA=", ann.PublicKey.String())
+	require.True(t, ann.ExpiresAt.IsZero())
+
+	ann, ok = ParseAnnounceMsg("ANNOUNCE [2001:db8::1]:51820 LhdznlMunOticjwvG+WdHk2f9aYGvXugcrDhG2MJeBA=")
+	require.True(t, ok)
+	require.Equal(t, "[2001:db8::1]:51820", ann.Endpoint.String())
+
+	_, ok = ParseAnnounceMsg("ANNOUNCE 2001:db8::1:51820 LhdznlMunOticjwvG+WdHk2f9aYGvXugcrDhG2MJeBA=")
+	require.False(t, ok)
+
+	// Keys have to be 32 bytes.
+	_, ok = ParseAnnounceMsg("ANNOUNCE 192.168.0.164:51820 a2V5")
+	require.False(t, ok)
+	_, ok = ParseAnnounceMsg("ANNOUNCE 192.168.0.164:51820 LhdznlMunOticjwvG+WdHk2f9aYGvXugcrDhG2MJeBA")
+	require.False(t, ok)
+}
+
+func TestParseVersioned(t *testing.T) {
+	expires := time.Unix(1600000000, 0)
+	text, err := FormatAnnounceMsg(AnnounceMsg{
+		Endpoints: []libwireguard.HostPort{
+			libwireguard.ParseHostPort("94.130.0.10:7321"),
+			libwireguard.ParseHostPort("[2001:db8::1]:51820"),
+		},
+		PublicKey:    mustParsePubKey("jc+Ipv9/W4B6WD/EuVsFMVQjMcBYFfiw5NJD28ffqzE="),
+		ListenPort:   51820,
+		Capabilities: []string{CapMultiEndpoint, CapIPv6},
+		ExpiresAt:    expires,
+	})
+	require.NoError(t, err)
+	require.Contains(t, text, "KBWG/2 {")
+
+	ann, ok := ParseAnnounceMsg(text)
+	require.True(t, ok)
+	require.Equal(t, AnnounceVersion, ann.Version)
+	require.Equal(t, "94.130.0.10:7321", ann.Endpoint.String())
+	require.Len(t, ann.Endpoints, 2)
+	require.Equal(t, "[2001:db8::1]:51820", ann.Endpoints[1].String())
+	require.Equal(t, "jc+Ipv9/W4B6WD/EuVsFMVQjMcBYFfiw5NJD28ffqzE=", ann.PublicKey.String())
+	require.Equal(t, uint16(51820), ann.ListenPort)
+	require.True(t, ann.HasCapability(CapIPv6))
+	require.True(t, ann.ExpiresAt.Equal(expires))
+	require.True(t, ann.IsExpired(expires.Add(time.Second)))
+	require.False(t, ann.IsExpired(expires.Add(-time.Second)))
+
+	// Unknown fields from future versions are ignored.
+	ann, ok = ParseAnnounceMsg(`KBWG/3 {"endpoints":["10.0.0.1:1"],"public_key":"jc+Ipv9/W4B6WD/EuVsFMVQjMcBYFfiw5NJD28ffqzE=","new_field":1}`)
+	require.True(t, ok)
+	require.Equal(t, 3, ann.Version)
+
+	_, ok = ParseAnnounceMsg(`KBWG/2 {"endpoints":[],"public_key":"jc+Ipv9/W4B6WD/EuVsFMVQjMcBYFfiw5NJD28ffqzE="}`)
+	require.False(t, ok)
+	_, ok = ParseAnnounceMsg(`KBWG/2 {"endpoints":["10.0.0.1:1"]}`)
+	require.False(t, ok)
+	_, ok = ParseAnnounceMsg(`KBWG/1 {"endpoints":["10.0.0.1:1"],"public_key":"jc+Ipv9/W4B6WD/EuVsFMVQjMcBYFfiw5NJD28ffqzE="}`)
+	require.False(t, ok)
+	// Malformed keys are rejected.
+	_, ok = ParseAnnounceMsg(`KBWG/2 {"endpoints":["10.0.0.1:1"],"public_key":"a2V5"}`)
+	require.False(t, ok)
+
+	// Goodbye does not need endpoints.
+	text, err = FormatAnnounceMsg(AnnounceMsg{PublicKey: testPubKey("bob"), Goodbye: true})
+	require.NoError(t, err)
+	ann, ok = ParseAnnounceMsg(text)
+	require.True(t, ok)
+	require.True(t, ann.Goodbye)
+	require.Equal(t, testPubKey("bob"), ann.PublicKey)
+	require.Empty(t, ann.Endpoints)
+}
+
+func mustParsePubKey(str string) libwireguard.WireguardPubKey {
+	key, err := libwireguard.ParsePubKey(str)
+	if err != nil {
+		panic(err)
+	}
+	return key
 }
@@ -0,0 +1,45 @@
+package kbwg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultRoutes are added to allowed IPs of our exit node, so run-dev routes
+// all traffic through it.
+var DefaultRoutes = []string{"0.0.0.0/0", "::/0"}
+
+// FindExitNode returns peer that `-exit-node` refers to, by "device" or
+// "username/device". It has to be marked as `exit_node` in peers.json.
+// Returns zero KBDev and no error if we don't use an exit node.
+func FindExitNode(prog *Program) (ret KBDev, err error) {
+	if prog.ExitNode == "" {
+		return ret, nil
+	}
+	username, device := "", prog.ExitNode
+	if i := strings.Index(prog.ExitNode, "/"); i != -1 {
+		username, device = prog.ExitNode[:i], prog.ExitNode[i+1:]
+	}
+	matches := func(kbdev KBDev) bool {
+		return kbdev.Device == device && (username == "" || kbdev.Username == username)
+	}
+
+	if matches(prog.Self) {
+		return ret, fmt.Errorf("exit node %q is this device", prog.ExitNode)
+	}
+	var found []KBDev
+	for kbdev, peer := range prog.KeybasePeers {
+		if matches(kbdev) && !peer.Dynamic {
+			found = append(found, kbdev)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return ret, fmt.Errorf("exit node %q is not in peers.json", prog.ExitNode)
+	case len(found) > 1:
+		return ret, fmt.Errorf("exit node %q is ambiguous, use username/device", prog.ExitNode)
+	case !prog.KeybasePeers[found[0]].ExitNode:
+		return ret, fmt.Errorf("%v is not an exit node in peers.json", found[0])
+	}
+	return found[0], nil
+}
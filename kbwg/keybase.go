@@ -1,12 +1,106 @@
 package kbwg
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
 
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 )
 
+// KeybaseClient is what we need from Keybase: chat and reading from KBFS. It
+// is implemented by `*kbchat.API` wrapper from `NewKeybaseClient`, and by
+// `FakeKeybase` in tests.
+type KeybaseClient interface {
+	GetConversations(unreadOnly bool) ([]chat1.ConvSummary, error)
+	GetTextMessages(channel chat1.ChatChannel, unreadOnly bool) ([]chat1.MsgSummary, error)
+	SendMessage(channel chat1.ChatChannel, body string, args ...interface{}) (kbchat.SendResponse, error)
+	// ListenNewMessages subscribes to new messages in all conversations of
+	// the user, callers have to filter the ones they need.
+	ListenNewMessages() (MessageSubscription, error)
+
+	// LoggedInStatus returns user and device that we are logged in as.
+	LoggedInStatus() (StatusJSONPart, error)
+	// ReadKBFS reads whole file from KBFS. Error wraps `os.ErrNotExist` if
+	// the file doesn't exist.
+	ReadKBFS(path string) ([]byte, error)
+	// WriteKBFS creates or replaces file in KBFS.
+	WriteKBFS(path string, contents []byte) error
+	// TeamMembers returns usernames of all members of `team`.
+	TeamMembers(team string) ([]string, error)
+	// UserDevices returns names of active devices of user `username`.
+	UserDevices(username string) ([]string, error)
+	// SignMessage signs `msg` with our device key. Returned signature has
+	// the message attached.
+	SignMessage(msg []byte) (string, error)
+	// VerifyMessage checks that `signed` was signed by a device of user
+	// `signer`, and returns the signed message.
+	VerifyMessage(signed string, signer string) ([]byte, error)
+}
+
+// MessageSubscription is a stream of new chat messages.
+// `*kbchat.NewSubscription` implements it.
+type MessageSubscription interface {
+	Read() (kbchat.SubscriptionMessage, error)
+	Shutdown()
+}
+
+type kbchatClient struct {
+	*kbchat.API
+}
+
+var _ KeybaseClient = kbchatClient{}
+
+// NewKeybaseClient returns KeybaseClient talking to running Keybase service
+// through `api`.
+func NewKeybaseClient(api *kbchat.API) KeybaseClient {
+	return kbchatClient{API: api}
+}
+
+func (c kbchatClient) ListenNewMessages() (MessageSubscription, error) {
+	sub, err := c.API.Listen(kbchat.ListenOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (c kbchatClient) LoggedInStatus() (StatusJSONPart, error) {
+	return KeybaseGetLoggedInStatus(c.API)
+}
+
+func (c kbchatClient) ReadKBFS(path string) ([]byte, error) {
+	return KeybaseReadKBFS(c.API, path)
+}
+
+func (c kbchatClient) WriteKBFS(path string, contents []byte) error {
+	return KeybaseWriteKBFS(c.API, path, contents)
+}
+
+func (c kbchatClient) TeamMembers(team string) ([]string, error) {
+	return KeybaseTeamMembers(c.API, team)
+}
+
+func (c kbchatClient) UserDevices(username string) ([]string, error) {
+	return KeybaseUserDevices(username)
+}
+
+func (c kbchatClient) SignMessage(msg []byte) (string, error) {
+	return KeybaseSign(c.API, msg)
+}
+
+func (c kbchatClient) VerifyMessage(signed string, signer string) ([]byte, error) {
+	return KeybaseVerify(c.API, signed, signer)
+}
+
 type StatusJSONPart struct {
 	Username string `json:"Username"`
 	Device   struct {
@@ -35,7 +129,149 @@ func KeybaseReadKBFS(api *kbchat.API, path string) (contents []byte, err error)
 	cmd := api.Command("fs", "read", path)
 	outBytes, err := cmd.Output()
 	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && strings.Contains(string(exitErr.Stderr), "does not exist") {
+			return nil, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+		}
 		return nil, fmt.Errorf("Failed to run `keybase fs read` for %q: %w", path, err)
 	}
 	return outBytes, nil
 }
+
+func KeybaseWriteKBFS(api *kbchat.API, path string, contents []byte) error {
+	cmd := api.Command("fs", "write", path)
+	cmd.Stdin = bytes.NewReader(contents)
+	if _, err := cmd.Output(); err != nil {
+		return fmt.Errorf("Failed to run `keybase fs write` for %q: %s", path, commandError(err))
+	}
+	return nil
+}
+
+func KeybaseTeamMembers(api *kbchat.API, team string) (members []string, err error) {
+	input, err := json.Marshal(map[string]interface{}{
+		"method": "list-team-memberships",
+		"params": map[string]interface{}{
+			"options": map[string]interface{}{"team": team},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	cmd := api.Command("team", "api", "-m", string(input))
+	outBytes, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to run `keybase team api` for %q: %w", team, err)
+	}
+
+	var res struct {
+		Result struct {
+			// Role (owners, admins, writers, ...) to members.
+			Members map[string][]struct {
+				Username string `json:"username"`
+			} `json:"members"`
+		} `json:"result"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(outBytes, &res); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal team members: %w", err)
+	}
+	if res.Error != nil {
+		return nil, fmt.Errorf("Failed to list members of %q: %s", team, res.Error.Message)
+	}
+	for _, roleMembers := range res.Result.Members {
+		for _, member := range roleMembers {
+			members = append(members, member.Username)
+		}
+	}
+	return members, nil
+}
+
+// keybaseLookupURL is Keybase API endpoint that returns public information
+// about users, including their devices from the sigchain. Variable so tests
+// can point it to a local server.
+var keybaseLookupURL = "https://keybase.io/_/api/1.0/user/lookup.json"
+
+// keybaseHTTPClient is used for Keybase API calls that don't go through
+// Keybase service.
+var keybaseHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// Device status in user lookup. Revoked devices are "defunct".
+const keybaseDeviceStatusActive = 1
+
+func KeybaseUserDevices(username string) (devices []string, err error) {
+	query := url.Values{}
+	query.Set("usernames", username)
+	query.Set("fields", "devices")
+	resp, err := keybaseHTTPClient.Get(keybaseLookupURL + "?" + query.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to look up user %q: %w", username, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to look up user %q: %s", username, resp.Status)
+	}
+
+	var res struct {
+		Status struct {
+			Code int    `json:"code"`
+			Desc string `json:"desc"`
+		} `json:"status"`
+		Them []*struct {
+			Devices map[string]struct {
+				Name   string `json:"name"`
+				Status int    `json:"status"`
+			} `json:"devices"`
+		} `json:"them"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal lookup of user %q: %w", username, err)
+	}
+	if res.Status.Code != 0 {
+		return nil, fmt.Errorf("Failed to look up user %q: %s", username, res.Status.Desc)
+	}
+	if len(res.Them) == 0 || res.Them[0] == nil {
+		return nil, fmt.Errorf("user %q: %w", username, ErrUserNotFound)
+	}
+	for _, device := range res.Them[0].Devices {
+		if device.Status == keybaseDeviceStatusActive {
+			devices = append(devices, device.Name)
+		}
+	}
+	return devices, nil
+}
+
+// ErrUserNotFound is returned by `UserDevices` for users that don't exist.
+var ErrUserNotFound = errors.New("user not found")
+
+// commandError adds stderr of failed command to `err`, Keybase CLI explains
+// what went wrong there.
+func commandError(err error) string {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+		return fmt.Sprintf("%s: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err.Error()
+}
+
+// KeybaseSign makes attached saltpack signature of `msg` with our device key.
+func KeybaseSign(api *kbchat.API, msg []byte) (string, error) {
+	cmd := api.Command("sign", "-m", string(msg))
+	outBytes, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to run `keybase sign`: %s", commandError(err))
+	}
+	return strings.TrimSpace(string(outBytes)), nil
+}
+
+// KeybaseVerify verifies attached saltpack signature made by one of the
+// devices of `signer`, and returns the signed message.
+func KeybaseVerify(api *kbchat.API, signed string, signer string) ([]byte, error) {
+	cmd := api.Command("verify", "-S", signer, "-m", signed)
+	outBytes, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to run `keybase verify` for %q: %s", signer, commandError(err))
+	}
+	return outBytes, nil
+}
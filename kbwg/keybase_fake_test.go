@@ -0,0 +1,448 @@
+package kbwg
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+)
+
+// FakeKeybase simulates Keybase chat and KBFS in memory, so multiple
+// `Program`s can talk to each other in tests. Each `Program` gets its own
+// client from `Client`, acting as one device of one user.
+type FakeKeybase struct {
+	sync.Mutex
+
+	lastMsgID chat1.MessageID
+	convs     []*fakeConv
+	// Team name to member usernames.
+	teams map[string]map[string]bool
+	// Username to device names.
+	devices map[string]map[string]bool
+	files   map[string][]byte
+	subs    []*fakeSubscription
+}
+
+type fakeConv struct {
+	summary chat1.ConvSummary
+	// Newest last.
+	messages []chat1.MsgSummary
+	// Last read message per device.
+	readUpTo map[KBDev]chat1.MessageID
+}
+
+// fakeSubscription gets new messages from all conversations of `username`.
+type fakeSubscription struct {
+	username   string
+	msgCh      chan kbchat.SubscriptionMessage
+	errCh      chan error
+	shutdownCh chan struct{}
+	failed     bool
+}
+
+var _ MessageSubscription = (*fakeSubscription)(nil)
+
+func (s *fakeSubscription) Read() (kbchat.SubscriptionMessage, error) {
+	// Messages that were delivered before failure go first.
+	select {
+	case msg := <-s.msgCh:
+		return msg, nil
+	default:
+	}
+	select {
+	case msg := <-s.msgCh:
+		return msg, nil
+	case err := <-s.errCh:
+		return kbchat.SubscriptionMessage{}, err
+	case <-s.shutdownCh:
+		return kbchat.SubscriptionMessage{}, fmt.Errorf("subscription shutdown")
+	}
+}
+
+func (s *fakeSubscription) Shutdown() {
+	select {
+	case <-s.shutdownCh:
+	default:
+		close(s.shutdownCh)
+	}
+}
+
+// fail makes `Read` return error, but only after messages that were already
+// delivered.
+func (s *fakeSubscription) fail(err error) {
+	if !s.failed {
+		s.failed = true
+		s.errCh <- err
+	}
+}
+
+func NewFakeKeybase() *FakeKeybase {
+	return &FakeKeybase{
+		teams:   make(map[string]map[string]bool),
+		devices: make(map[string]map[string]bool),
+		files:   make(map[string][]byte),
+	}
+}
+
+// AddTeam creates team with #general and #announce channels.
+func (f *FakeKeybase) AddTeam(team string, members ...string) {
+	f.Lock()
+	defer f.Unlock()
+	f.teams[team] = make(map[string]bool)
+	for _, member := range members {
+		f.teams[team][member] = true
+		if f.devices[member] == nil {
+			f.devices[member] = make(map[string]bool)
+		}
+	}
+	for _, topic := range []string{"general", AnnounceChatName} {
+		f.convs = append(f.convs, &fakeConv{
+			summary: chat1.ConvSummary{
+				Id: chat1.ConvIDStr(fmt.Sprintf("conv-%d", len(f.convs))),
+				Channel: chat1.ChatChannel{
+					Name:        team,
+					MembersType: "team",
+					TopicType:   "chat",
+					TopicName:   topic,
+				},
+			},
+			readUpTo: make(map[KBDev]chat1.MessageID),
+		})
+	}
+}
+
+// WriteKBFS stores file that can be later read with `ReadKBFS`.
+func (f *FakeKeybase) WriteKBFS(path string, contents []byte) {
+	f.Lock()
+	defer f.Unlock()
+	f.files[path] = contents
+}
+
+// AddDevice adds device to user's sigchain. Devices of clients returned by
+// `Client` are added automatically.
+func (f *FakeKeybase) AddDevice(username string, device string) {
+	f.Lock()
+	defer f.Unlock()
+	f.addDeviceLocked(username, device)
+}
+
+func (f *FakeKeybase) addDeviceLocked(username string, device string) {
+	if f.devices[username] == nil {
+		f.devices[username] = make(map[string]bool)
+	}
+	f.devices[username][device] = true
+}
+
+// Client returns KeybaseClient for device `device` of user `username`.
+func (f *FakeKeybase) Client(username string, device string) KeybaseClient {
+	f.AddDevice(username, device)
+	return &fakeKeybaseClient{
+		fake:     f,
+		dev:      KBDev{Username: username, Device: device},
+		deviceID: fmt.Sprintf("%x", username+"/"+device),
+	}
+}
+
+// BreakSubscriptions fails all current subscriptions, like when connection
+// to Keybase service is lost.
+func (f *FakeKeybase) BreakSubscriptions() {
+	f.Lock()
+	defer f.Unlock()
+	for _, sub := range f.subs {
+		sub.fail(fmt.Errorf("connection lost"))
+	}
+	f.subs = nil
+}
+
+func (f *FakeKeybase) findConv(channel chat1.ChatChannel) (*fakeConv, error) {
+	for _, conv := range f.convs {
+		ch := conv.summary.Channel
+		if ch.Name == channel.Name && ch.TopicName == channel.TopicName && ch.MembersType == channel.MembersType {
+			return conv, nil
+		}
+	}
+	return nil, fmt.Errorf("conversation %s#%s not found", channel.Name, channel.TopicName)
+}
+
+func (f *FakeKeybase) isMember(conv *fakeConv, username string) bool {
+	return f.teams[conv.summary.Channel.Name][username]
+}
+
+type fakeKeybaseClient struct {
+	fake     *FakeKeybase
+	dev      KBDev
+	deviceID string
+}
+
+var _ KeybaseClient = (*fakeKeybaseClient)(nil)
+
+func (c *fakeKeybaseClient) GetConversations(unreadOnly bool) (ret []chat1.ConvSummary, err error) {
+	c.fake.Lock()
+	defer c.fake.Unlock()
+	for _, conv := range c.fake.convs {
+		if !c.fake.isMember(conv, c.dev.Username) {
+			continue
+		}
+		summary := conv.summary
+		summary.Unread = len(conv.messages) > 0 &&
+			conv.messages[len(conv.messages)-1].Id > conv.readUpTo[c.dev]
+		if unreadOnly && !summary.Unread {
+			continue
+		}
+		ret = append(ret, summary)
+	}
+	return ret, nil
+}
+
+// GetTextMessages returns text messages newest first, like the real API, and
+// marks them as read. Edited messages have the edited body, deleted messages
+// are not returned.
+func (c *fakeKeybaseClient) GetTextMessages(channel chat1.ChatChannel, unreadOnly bool) (ret []chat1.MsgSummary, err error) {
+	c.fake.Lock()
+	defer c.fake.Unlock()
+	conv, err := c.fake.findConv(channel)
+	if err != nil {
+		return nil, err
+	}
+	if !c.fake.isMember(conv, c.dev.Username) {
+		return nil, fmt.Errorf("%s is not a member of %s", c.dev.Username, channel.Name)
+	}
+	readUpTo := conv.readUpTo[c.dev]
+	for i := len(conv.messages) - 1; i >= 0; i-- {
+		msg := conv.messages[i]
+		if unreadOnly && msg.Id <= readUpTo {
+			break
+		}
+		if msg.Content.TypeName != "text" {
+			continue
+		}
+		msg.Unread = msg.Id > readUpTo
+		ret = append(ret, msg)
+	}
+	if len(conv.messages) > 0 {
+		conv.readUpTo[c.dev] = conv.messages[len(conv.messages)-1].Id
+	}
+	return ret, nil
+}
+
+func (c *fakeKeybaseClient) SendMessage(channel chat1.ChatChannel, body string, args ...interface{}) (ret kbchat.SendResponse, err error) {
+	c.fake.Lock()
+	defer c.fake.Unlock()
+	conv, err := c.fake.findConv(channel)
+	if err != nil {
+		return ret, err
+	}
+	if !c.fake.isMember(conv, c.dev.Username) {
+		return ret, fmt.Errorf("%s is not a member of %s", c.dev.Username, channel.Name)
+	}
+	if len(args) > 0 {
+		body = fmt.Sprintf(body, args...)
+	}
+	msgID := c.postLocked(conv, chat1.MsgContent{
+		TypeName: "text",
+		Text:     &chat1.MessageText{Body: body},
+	})
+	ret.Result.Message = "message sent"
+	ret.Result.MessageID = &msgID
+	return ret, nil
+}
+
+// EditMessage edits our message `msgID`, like editing it in Keybase app.
+func (c *fakeKeybaseClient) EditMessage(channel chat1.ChatChannel, msgID chat1.MessageID, body string) error {
+	c.fake.Lock()
+	defer c.fake.Unlock()
+	conv, err := c.fake.findConv(channel)
+	if err != nil {
+		return err
+	}
+	for i, msg := range conv.messages {
+		if msg.Id == msgID && msg.Content.Text != nil {
+			conv.messages[i].Content.Text = &chat1.MessageText{Body: body}
+		}
+	}
+	c.postLocked(conv, chat1.MsgContent{
+		TypeName: "edit",
+		Edit:     &chat1.MessageEdit{MessageID: msgID, Body: body},
+	})
+	return nil
+}
+
+// DeleteMessage deletes message `msgID`, like deleting it in Keybase app.
+// Like team admins, anyone can delete any message.
+func (c *fakeKeybaseClient) DeleteMessage(channel chat1.ChatChannel, msgID chat1.MessageID) error {
+	c.fake.Lock()
+	defer c.fake.Unlock()
+	conv, err := c.fake.findConv(channel)
+	if err != nil {
+		return err
+	}
+	var messages []chat1.MsgSummary
+	for _, msg := range conv.messages {
+		if msg.Id != msgID {
+			messages = append(messages, msg)
+		}
+	}
+	conv.messages = messages
+	c.postLocked(conv, chat1.MsgContent{
+		TypeName: "delete",
+		Delete:   &chat1.MessageDelete{MessageIDs: []chat1.MessageID{msgID}},
+	})
+	return nil
+}
+
+// postLocked adds message with `content` from us to `conv`, and delivers it
+// to subscribers.
+func (c *fakeKeybaseClient) postLocked(conv *fakeConv, content chat1.MsgContent) chat1.MessageID {
+	c.fake.lastMsgID++
+	msgID := c.fake.lastMsgID
+	now := time.Now()
+	msg := chat1.MsgSummary{
+		Id:      msgID,
+		ConvID:  conv.summary.Id,
+		Channel: conv.summary.Channel,
+		Sender: chat1.MsgSender{
+			Username:   c.dev.Username,
+			DeviceName: c.dev.Device,
+			DeviceID:   keybase1.DeviceID(c.deviceID),
+		},
+		SentAt:   now.Unix(),
+		SentAtMs: now.UnixNano() / int64(time.Millisecond),
+		Content:  content,
+	}
+	conv.messages = append(conv.messages, msg)
+	var subs []*fakeSubscription
+	for _, sub := range c.fake.subs {
+		if !c.fake.isMember(conv, sub.username) {
+			subs = append(subs, sub)
+			continue
+		}
+		select {
+		case sub.msgCh <- kbchat.SubscriptionMessage{Message: msg, Conversation: conv.summary}:
+			subs = append(subs, sub)
+		default:
+			sub.fail(fmt.Errorf("subscriber too slow"))
+		}
+	}
+	c.fake.subs = subs
+	// Own messages are never unread.
+	conv.readUpTo[c.dev] = msgID
+	return msgID
+}
+
+func (c *fakeKeybaseClient) ListenNewMessages() (MessageSubscription, error) {
+	c.fake.Lock()
+	defer c.fake.Unlock()
+	sub := &fakeSubscription{
+		username:   c.dev.Username,
+		msgCh:      make(chan kbchat.SubscriptionMessage, 100),
+		errCh:      make(chan error, 1),
+		shutdownCh: make(chan struct{}),
+	}
+	c.fake.subs = append(c.fake.subs, sub)
+	return sub, nil
+}
+
+func (c *fakeKeybaseClient) LoggedInStatus() (ret StatusJSONPart, err error) {
+	ret.Username = c.dev.Username
+	ret.Device.Name = c.dev.Device
+	ret.Device.Type = "desktop"
+	ret.Device.DeviceID = c.deviceID
+	return ret, nil
+}
+
+func (c *fakeKeybaseClient) ReadKBFS(path string) ([]byte, error) {
+	c.fake.Lock()
+	defer c.fake.Unlock()
+	if !c.canAccessLocked(path) {
+		return nil, fmt.Errorf("%s can't read %s: %w", c.dev.Username, path, os.ErrPermission)
+	}
+	contents, ok := c.fake.files[path]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+	}
+	return contents, nil
+}
+
+func (c *fakeKeybaseClient) WriteKBFS(path string, contents []byte) error {
+	c.fake.Lock()
+	defer c.fake.Unlock()
+	if !c.canAccessLocked(path) {
+		return fmt.Errorf("%s can't write %s: %w", c.dev.Username, path, os.ErrPermission)
+	}
+	c.fake.files[path] = contents
+	return nil
+}
+
+// canAccessLocked checks if we are a member of team of team folder, or one of
+// the users of private folder `path` is in.
+func (c *fakeKeybaseClient) canAccessLocked(path string) bool {
+	switch {
+	case strings.HasPrefix(path, "/keybase/team/"):
+		team := strings.SplitN(strings.TrimPrefix(path, "/keybase/team/"), "/", 2)[0]
+		return c.fake.teams[team][c.dev.Username]
+	case strings.HasPrefix(path, "/keybase/private/"):
+		folder := strings.SplitN(strings.TrimPrefix(path, "/keybase/private/"), "/", 2)[0]
+		for _, user := range strings.Split(folder, ",") {
+			if user == c.dev.Username {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (c *fakeKeybaseClient) TeamMembers(team string) (ret []string, err error) {
+	c.fake.Lock()
+	defer c.fake.Unlock()
+	members, ok := c.fake.teams[team]
+	if !ok || !members[c.dev.Username] {
+		return nil, fmt.Errorf("team %q not found", team)
+	}
+	for member := range members {
+		ret = append(ret, member)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (c *fakeKeybaseClient) UserDevices(username string) (ret []string, err error) {
+	c.fake.Lock()
+	defer c.fake.Unlock()
+	devices, ok := c.fake.devices[username]
+	if !ok {
+		return nil, fmt.Errorf("user %q: %w", username, ErrUserNotFound)
+	}
+	for device := range devices {
+		ret = append(ret, device)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// fakeSignaturePrefix starts signatures made by `SignMessage` of fake
+// clients. They are not real signatures, but `VerifyMessage` checks that the
+// signer is who the caller expects, like the real one does.
+const fakeSignaturePrefix = "FAKESIG "
+
+func (c *fakeKeybaseClient) SignMessage(msg []byte) (string, error) {
+	return fakeSignaturePrefix + c.dev.Username + " " + base64.StdEncoding.EncodeToString(msg), nil
+}
+
+func (c *fakeKeybaseClient) VerifyMessage(signed string, signer string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(signed, fakeSignaturePrefix), " ")
+	if !strings.HasPrefix(signed, fakeSignaturePrefix) || len(parts) != 2 {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	if parts[0] != signer {
+		return nil, fmt.Errorf("signed by %q, not %q", parts[0], signer)
+	}
+	return base64.StdEncoding.DecodeString(parts[1])
+}
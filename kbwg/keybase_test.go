@@ -0,0 +1,41 @@
+package kbwg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeybaseUserDevices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("usernames") {
+		case "alice":
+			fmt.Fprint(w, `{"status":{"code":0},"them":[{"devices":{
+				"01":{"name":"laptop","status":1},
+				"02":{"name":"old phone","status":2}}}]}`)
+		case "nobody":
+			fmt.Fprint(w, `{"status":{"code":0},"them":[null]}`)
+		default:
+			http.Error(w, "<html>rate limited</html>", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	defer func(url string) { keybaseLookupURL = url }(keybaseLookupURL)
+	keybaseLookupURL = server.URL
+
+	devices, err := KeybaseUserDevices("alice")
+	require.NoError(t, err)
+	require.Equal(t, []string{"laptop"}, devices)
+
+	_, err = KeybaseUserDevices("nobody")
+	require.True(t, errors.Is(err, ErrUserNotFound))
+
+	// Error pages are not taken for lookup results.
+	_, err = KeybaseUserDevices("bob")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "503")
+}
@@ -0,0 +1,878 @@
+package kbwg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+	"github.com/stretchr/testify/require"
+	"github.com/zapu/kb-wireguard/libpipe"
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+const testTeam = "wgteam"
+
+type testNode struct {
+	t    *testing.T
+	prog *Program
+	// Everything written to run-dev pipe.
+	pipe *fakeRunDev
+}
+
+// fakeRunDev records everything written to run-dev pipe, and replies to
+// requests the way run-dev does.
+type fakeRunDev struct {
+	bytes.Buffer
+	runner *DevRunnerProcess
+	// Requests with this ID get error reply.
+	failID string
+	// Public key returned for `prepare-key`.
+	nextKey libwireguard.WireguardPubKey
+	// If set, requests fail while this Program is locked.
+	unlocked *Program
+	// Incomplete line from previous write.
+	partial []byte
+}
+
+func (f *fakeRunDev) Write(p []byte) (int, error) {
+	n, err := f.Buffer.Write(p)
+	f.partial = append(f.partial, p...)
+	for {
+		i := bytes.IndexByte(f.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := f.partial[:i]
+		f.partial = f.partial[i+1:]
+		var msg libpipe.PipeMsg
+		if json.Unmarshal(line, &msg) != nil || msg.Seq == 0 {
+			continue
+		}
+		var payload interface{}
+		var replyErr error
+		if msg.ID == f.failID {
+			replyErr = fmt.Errorf("%s failed", msg.ID)
+		} else if f.unlocked != nil && !f.unlocked.TryLock() {
+			replyErr = fmt.Errorf("%s sent with Program locked", msg.ID)
+		} else if msg.ID == "hello" {
+			payload = libpipe.HelloMsg{Version: libpipe.ProtocolVersion}
+		} else if msg.ID == "prepare-key" {
+			payload = f.nextKey
+		}
+		if f.unlocked != nil && replyErr == nil {
+			f.unlocked.Unlock()
+		}
+		reply, err := libpipe.SerializeReply(msg.Seq, payload, replyErr)
+		if err != nil {
+			return n, err
+		}
+		var replyMsg libpipe.PipeMsg
+		if err := json.Unmarshal([]byte(reply), &replyMsg); err != nil {
+			return n, err
+		}
+		if err := f.runner.handleDevRunnerControlMsg(replyMsg); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func newFakeRunDev() *fakeRunDev {
+	f := &fakeRunDev{}
+	f.runner = &DevRunnerProcess{
+		PipeWriter: bufio.NewWriter(f),
+		StatsCh:    make(chan map[libwireguard.WireguardPubKey]PeerStats, 1),
+	}
+	return f
+}
+
+func (n *testNode) mctx() MetaContext {
+	return n.prog.MCtxTODO()
+}
+
+// read processes new announcements. Has to be called with Program locked.
+func (n *testNode) read() {
+	require.NoError(n.t, processAnnouncements(n.mctx(), false /* alwaysSync */, "Got new announcements"))
+}
+
+// lastPeers returns the last peer list sent to run-dev.
+func (n *testNode) lastPeers() (ret []libwireguard.WireguardPeer) {
+	t := n.t
+	require.NoError(t, n.prog.DevRunner.PipeWriter.Flush())
+	lines := strings.Split(strings.TrimSpace(n.pipe.String()), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		var msg libpipe.PipeMsg
+		require.NoError(t, json.Unmarshal([]byte(lines[i]), &msg))
+		if msg.ID == "peers" {
+			require.NoError(t, json.Unmarshal([]byte(msg.Payload), &ret))
+			return ret
+		}
+	}
+	t.Fatalf("no peers message was sent")
+	return nil
+}
+
+func testPubKey(name string) (key libwireguard.WireguardPubKey) {
+	copy(key[:], name)
+	return key
+}
+
+// startTestNode does what kb-wireguard does on start, but with Keybase faked
+// and run-dev pipe going to a buffer.
+func startTestNode(t *testing.T, fake *FakeKeybase, username, device string, port uint16) *testNode {
+	_, subnet, err := net.ParseCIDR(DefaultSubnet)
+	require.NoError(t, err)
+
+	pipe := newFakeRunDev()
+	prog := &Program{
+		API:         fake.Client(username, device),
+		KeybaseTeam: testTeam,
+		Subnet:      subnet,
+		ListenPort:  port,
+		DevRunner:   pipe.runner,
+	}
+	node := &testNode{t: t, prog: prog, pipe: pipe}
+	mctx := node.mctx()
+
+	require.NoError(t, prog.LoadSelf(mctx.Ctx))
+	conv, err := AnnounceFindChat(mctx)
+	require.NoError(t, err)
+	prog.AnnounceChannel = conv.Channel
+
+	peerList, err := LoadPeerList(mctx)
+	require.NoError(t, err)
+	prog.Network = peerList.Network
+	foundSelf, err := prog.SetPeerList(peerList.Peers)
+	require.NoError(t, err)
+	if !foundSelf {
+		prog.SelfPeer.Device = prog.Self
+		_, err := FindAnnouncements(mctx)
+		require.NoError(t, err)
+		ResolveAddressConflicts(mctx)
+		require.NoError(t, AllocateSelfAddress(mctx))
+	}
+
+	prog.SelfPeer.PublicKey = testPubKey(username + "/" + device)
+	prog.Endpoints = []libwireguard.HostPort{
+		{Host: net.IPv4(203, 0, 113, 1), Port: port},
+	}
+
+	prog.Lock()
+	defer prog.Unlock()
+	require.NoError(t, processAnnouncements(mctx, true /* alwaysSync */, "Initial sync"))
+	require.NoError(t, SendAnnouncement(mctx))
+	return node
+}
+
+// testMesh is a team network for tests: fake Keybase with team `testTeam`
+// and nodes that were started in it.
+type testMesh struct {
+	t     *testing.T
+	fake  *FakeKeybase
+	nodes []*testNode
+}
+
+// newTestMesh creates team `testTeam` with `members`, and `peersJSON` as its
+// peers.json.
+func newTestMesh(t *testing.T, peersJSON string, members ...string) *testMesh {
+	fake := NewFakeKeybase()
+	fake.AddTeam(testTeam, members...)
+	fake.WriteKBFS(fmt.Sprintf("/keybase/team/%s/peers.json", testTeam), []byte(peersJSON))
+	return &testMesh{t: t, fake: fake}
+}
+
+// start starts a node for `device` of `username`, see `startTestNode`.
+// Nodes listen on consecutive ports, starting with 51820.
+func (m *testMesh) start(username, device string) *testNode {
+	node := startTestNode(m.t, m.fake, username, device, uint16(51820+len(m.nodes)))
+	m.nodes = append(m.nodes, node)
+	return node
+}
+
+// program returns Program for `device` of `username` that is not running,
+// for posting messages as that device.
+func (m *testMesh) program(username, device string) *Program {
+	prog := &Program{API: m.fake.Client(username, device), KeybaseTeam: testTeam}
+	require.NoError(m.t, prog.LoadSelf(context.TODO()))
+	conv, err := AnnounceFindChat(prog.MCtxTODO())
+	require.NoError(m.t, err)
+	prog.AnnounceChannel = conv.Channel
+	return prog
+}
+
+// readAll makes every node read new announcements.
+func (m *testMesh) readAll() {
+	for _, node := range m.nodes {
+		node.prog.Lock()
+		node.read()
+		node.prog.Unlock()
+	}
+}
+
+func TestPeersConverge(t *testing.T) {
+	m := newTestMesh(t, `[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+		{ "username": "alice", "device": "server", "ip": "100.0.0.2" },
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.3" }
+	]`, "alice", "bob", "carol")
+	m.fake.AddTeam("otherteam", "mallory")
+
+	// Nodes start one after another, last one is not in peers.json and needs
+	// a dynamic address.
+	nodes := []*testNode{
+		m.start("alice", "laptop"),
+		m.start("alice", "server"),
+		m.start("bob", "desktop"),
+		m.start("carol", "phone"),
+	}
+	m.readAll()
+
+	carol := nodes[3].prog.SelfPeer
+	require.True(t, carol.Dynamic)
+	require.NotZero(t, carol.ClaimID)
+
+	for i, node := range nodes {
+		peers := node.lastPeers()
+		require.Len(t, peers, len(nodes)-1, "node %v", node.prog.Self)
+
+		byKey := make(map[libwireguard.WireguardPubKey]libwireguard.WireguardPeer)
+		for _, peer := range peers {
+			byKey[peer.PublicKey] = peer
+		}
+		for j, other := range nodes {
+			if i == j {
+				continue
+			}
+			peer, ok := byKey[other.prog.SelfPeer.PublicKey]
+			require.True(t, ok, "%v should have %v as a peer", node.prog.Self, other.prog.Self)
+			require.Equal(t, []string{other.prog.SelfPeer.IP.String() + "/32"}, peer.AllowedIPs)
+			require.Equal(t, other.prog.Endpoints[0].String(), peer.Endpoint)
+		}
+	}
+
+	// Mallory is not in the team, can't read peers.json.
+	mallory := &Program{API: m.fake.Client("mallory", "laptop"), KeybaseTeam: testTeam}
+	_, err := LoadPeerList(mallory.MCtxTODO())
+	require.Error(t, err)
+}
+
+func TestAnnouncementsSubscription(t *testing.T) {
+	m := newTestMesh(t, `[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.2" }
+	]`, "alice", "bob")
+	alice := m.start("alice", "laptop")
+	bob := m.start("bob", "desktop")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bobMctx := MetaContext{Prog: bob.prog, Ctx: ctx}
+	msgCh := make(chan chat1.MsgSummary)
+	errCh := make(chan error)
+	sub, err := subscribeAnnouncements(bobMctx, msgCh, errCh)
+	require.NoError(t, err)
+	defer func() { sub.Shutdown() }()
+
+	aliceDev := alice.prog.Self
+	announceEndpoint := func(port uint16) {
+		alice.prog.Endpoints = []libwireguard.HostPort{
+			{Host: net.IPv4(203, 0, 113, 1), Port: port},
+		}
+		require.NoError(t, SendAnnouncement(alice.mctx()))
+	}
+	requireEndpoint := func(expected string) {
+		require.Equal(t, expected, bob.prog.KeybasePeers[aliceDev].Endpoint.String())
+	}
+
+	// Messages from other conversations are not passed.
+	general := alice.prog.AnnounceChannel
+	general.TopicName = "general"
+	_, err = alice.prog.API.SendMessage(general, "hello")
+	require.NoError(t, err)
+
+	announceEndpoint(40000)
+	bob.prog.Lock()
+	require.NoError(t, processAnnouncementMsg(bobMctx, <-msgCh))
+	bob.prog.Unlock()
+	requireEndpoint("203.0.113.1:40000")
+
+	// Messages that came through the subscription were not marked as read.
+	convs, err := bob.prog.API.GetConversations(true /* unreadOnly */)
+	require.NoError(t, err)
+	unread := false
+	for _, conv := range convs {
+		unread = unread || sameChannel(conv.Channel, bob.prog.AnnounceChannel)
+	}
+	require.True(t, unread)
+
+	// Announcement sent while bob is not subscribed is read after
+	// subscribing again.
+	m.fake.BreakSubscriptions()
+	require.Error(t, <-errCh)
+	announceEndpoint(40001)
+
+	sub, err = subscribeAnnouncements(bobMctx, msgCh, errCh)
+	require.NoError(t, err)
+	bob.prog.Lock()
+	require.NoError(t, processAnnouncements(bobMctx, false /* alwaysSync */, "Got missed announcements"))
+	bob.prog.Unlock()
+	requireEndpoint("203.0.113.1:40001")
+}
+
+func TestPeerDeparture(t *testing.T) {
+	m := newTestMesh(t, `[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.2" }
+	]`, "alice", "bob", "carol")
+	alice := m.start("alice", "laptop")
+	bob := m.start("bob", "desktop")
+	carol := m.start("carol", "phone")
+
+	alice.prog.Lock()
+	defer alice.prog.Unlock()
+	mctx := alice.mctx()
+	alice.read()
+	require.Len(t, alice.lastPeers(), 2)
+
+	// Goodbye with a key from previous session of bob is ignored.
+	text, err := formatSignedAnnounceMsg(bob.mctx(), AnnounceMsg{
+		PublicKey: testPubKey("old key"),
+		Goodbye:   true,
+		Timestamp: time.Now(),
+	})
+	require.NoError(t, err)
+	_, err = bob.prog.API.SendMessage(bob.prog.AnnounceChannel, text)
+	require.NoError(t, err)
+	alice.read()
+	require.True(t, alice.prog.KeybasePeers[bob.prog.Self].Active)
+
+	require.NoError(t, SendGoodbye(bob.mctx()))
+	alice.read()
+	require.False(t, alice.prog.KeybasePeers[bob.prog.Self].Active)
+	peers := alice.lastPeers()
+	require.Len(t, peers, 1)
+	require.Equal(t, carol.prog.SelfPeer.PublicKey, peers[0].PublicKey)
+
+	// Announcement from before the goodbye does not bring bob back after
+	// restart.
+	alice.prog.LastAnnounceMsgID = 0
+	alice.read()
+	require.False(t, alice.prog.KeybasePeers[bob.prog.Self].Active)
+
+	// Carol's announcement expires, which also frees her dynamic address.
+	carolDev := carol.prog.Self
+	require.False(t, ExpirePeers(mctx, time.Now()))
+	expiresAt := alice.prog.KeybasePeers[carolDev].LastAnnouncement.ExpiresAt
+	require.True(t, ExpirePeers(mctx, expiresAt.Add(time.Second)))
+	require.False(t, alice.prog.KeybasePeers[carolDev].Active)
+	require.True(t, canClaimAddress(alice.prog, carol.prog.SelfPeer.IP))
+}
+
+func TestPeerListReload(t *testing.T) {
+	m := newTestMesh(t, `[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.2" }
+	]`, "alice", "bob", "carol")
+	alice := m.start("alice", "laptop")
+	bob := m.start("bob", "desktop")
+	carol := m.start("carol", "phone")
+	require.True(t, carol.prog.SelfPeer.Dynamic)
+
+	alice.prog.Lock()
+	defer alice.prog.Unlock()
+	mctx := alice.mctx()
+	alice.read()
+	bobDev := bob.prog.Self
+	bobEndpoint := alice.prog.KeybasePeers[bobDev].Endpoint
+
+	reload := func(peersJSON string) {
+		list, err := ParsePeerList([]byte(peersJSON))
+		require.NoError(t, err)
+		require.NoError(t, reloadPeerList(mctx, list))
+	}
+	pipeMsgCount := func() int {
+		require.NoError(t, alice.prog.DevRunner.PipeWriter.Flush())
+		return strings.Count(alice.pipe.String(), "\n")
+	}
+
+	// Bob and alice get new addresses, carol gets a static one.
+	reload(`[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.11", "ip6": "fd00::11" },
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.12" },
+		{ "username": "carol", "device": "phone", "ip": "100.0.0.13" }
+	]`)
+	require.Equal(t, []string{"100.0.0.11/24", "fd00::11/64"}, alice.prog.SelfAddresses())
+	bobPeer := alice.prog.KeybasePeers[bobDev]
+	require.True(t, bobPeer.Active)
+	require.Equal(t, bobEndpoint, bobPeer.Endpoint)
+	carolPeer := alice.prog.KeybasePeers[carol.prog.Self]
+	require.False(t, carolPeer.Dynamic)
+	require.True(t, carolPeer.Active)
+
+	peers := alice.lastPeers()
+	require.Len(t, peers, 2)
+	allowedIPs := make(map[libwireguard.WireguardPubKey][]string)
+	for _, peer := range peers {
+		allowedIPs[peer.PublicKey] = peer.AllowedIPs
+	}
+	require.Equal(t, []string{"100.0.0.12/32"}, allowedIPs[bob.prog.SelfPeer.PublicKey])
+	require.Equal(t, []string{"100.0.0.13/32"}, allowedIPs[carol.prog.SelfPeer.PublicKey])
+
+	// Same list again does not resync run-dev.
+	count := pipeMsgCount()
+	reload(`[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.11", "ip6": "fd00::11" },
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.12" },
+		{ "username": "carol", "device": "phone", "ip": "100.0.0.13" }
+	]`)
+	require.Equal(t, count, pipeMsgCount())
+
+	// Bob is removed, and we are too, so we pick a dynamic address.
+	reload(`[
+		{ "username": "carol", "device": "phone", "ip": "100.0.0.13" }
+	]`)
+	_, ok := alice.prog.KeybasePeers[bobDev]
+	require.False(t, ok)
+	require.True(t, alice.prog.SelfPeer.Dynamic)
+	require.NotZero(t, alice.prog.SelfPeer.ClaimID)
+	require.Nil(t, alice.prog.SelfPeer.IP6)
+	peers = alice.lastPeers()
+	require.Len(t, peers, 1)
+	require.Equal(t, carol.prog.SelfPeer.PublicKey, peers[0].PublicKey)
+
+	// Bob is back, his earlier announcement is found again.
+	reload(`[
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.12" },
+		{ "username": "carol", "device": "phone", "ip": "100.0.0.13" }
+	]`)
+	require.True(t, alice.prog.KeybasePeers[bobDev].Active)
+	require.Len(t, alice.lastPeers(), 2)
+}
+
+func TestSignedAnnouncements(t *testing.T) {
+	m := newTestMesh(t, `[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.2" },
+		{ "username": "bob", "device": "phone", "ip": "100.0.0.3" }
+	]`, "alice", "bob")
+	m.fake.AddTeam("otherteam", "bob")
+
+	alice := m.start("alice", "laptop")
+	bobPhone := m.start("bob", "phone")
+	bobDesktop := m.program("bob", "desktop")
+
+	alice.prog.Lock()
+	defer alice.prog.Unlock()
+	alice.read()
+	require.True(t, alice.prog.KeybasePeers[bobPhone.prog.Self].LastAnnouncement.Signed)
+
+	bobDesktopDev := bobDesktop.Self
+	announce := func(prog *Program, text string) {
+		_, err := prog.API.SendMessage(prog.AnnounceChannel, text)
+		require.NoError(t, err)
+		alice.read()
+	}
+	msg := AnnounceMsg{
+		Endpoints: []libwireguard.HostPort{libwireguard.ParseHostPort("198.51.100.1:51820")},
+		PublicKey: testPubKey("bob/desktop"),
+		Timestamp: time.Now(),
+	}
+
+	// Unsigned announcement is ignored, unless we allow them.
+	text, err := FormatAnnounceMsg(msg)
+	require.NoError(t, err)
+	announce(bobDesktop, text)
+	require.False(t, alice.prog.KeybasePeers[bobDesktopDev].Active)
+
+	// Announcement signed by bob's phone can't be posted by bob's desktop.
+	text, err = formatSignedAnnounceMsg(bobPhone.mctx(), msg)
+	require.NoError(t, err)
+	announce(bobDesktop, text)
+	require.False(t, alice.prog.KeybasePeers[bobDesktopDev].Active)
+
+	// Signed for another team.
+	bobDesktop.KeybaseTeam = "otherteam"
+	text, err = formatSignedAnnounceMsg(bobDesktop.MCtxTODO(), msg)
+	require.NoError(t, err)
+	bobDesktop.KeybaseTeam = testTeam
+	announce(bobDesktop, text)
+	require.False(t, alice.prog.KeybasePeers[bobDesktopDev].Active)
+
+	// Old announcement posted again.
+	old := msg
+	old.Timestamp = time.Now().Add(-time.Hour)
+	text, err = formatSignedAnnounceMsg(bobDesktop.MCtxTODO(), old)
+	require.NoError(t, err)
+	announce(bobDesktop, text)
+	require.False(t, alice.prog.KeybasePeers[bobDesktopDev].Active)
+
+	// Fields outside of the signed payload are not used.
+	text, err = formatSignedAnnounceMsg(bobDesktop.MCtxTODO(), msg)
+	require.NoError(t, err)
+	announce(bobDesktop, strings.Replace(text, "198.51.100.1", "198.51.100.66", 1))
+	peer := alice.prog.KeybasePeers[bobDesktopDev]
+	require.True(t, peer.Active)
+	require.True(t, peer.LastAnnouncement.Signed)
+	require.Equal(t, "198.51.100.1:51820", peer.LastAnnouncement.Endpoint.String())
+
+	alice.prog.AllowUnsigned = true
+	msg.Endpoints = []libwireguard.HostPort{libwireguard.ParseHostPort("198.51.100.2:51820")}
+	text, err = FormatAnnounceMsg(msg)
+	require.NoError(t, err)
+	announce(bobDesktop, text)
+	peer = alice.prog.KeybasePeers[bobDesktopDev]
+	require.False(t, peer.LastAnnouncement.Signed)
+	require.Equal(t, "198.51.100.2:51820", peer.LastAnnouncement.Endpoint.String())
+}
+
+func TestVerifyAnnounceMsg(t *testing.T) {
+	m := newTestMesh(t, `[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.2" }
+	]`, "alice", "bob")
+	alice := m.start("alice", "laptop")
+	bob := m.start("bob", "desktop")
+
+	// Bob's announcement as delivered by chat, with device ID of the sender
+	// filled in by Keybase.
+	messages, err := alice.prog.API.GetTextMessages(alice.prog.AnnounceChannel, false /* unreadOnly */)
+	require.NoError(t, err)
+	var msg chat1.MsgSummary
+	for _, v := range messages {
+		if v.Sender.Username == "bob" {
+			msg = v
+		}
+	}
+	require.Equal(t, keybase1.DeviceID(bob.prog.SelfDeviceID), msg.Sender.DeviceID)
+	parsed, ok := ParseAnnounceMsg(msg.Content.Text.Body)
+	require.True(t, ok)
+
+	verified, err := verifyAnnounceMsg(alice.mctx(), msg, parsed)
+	require.NoError(t, err)
+	require.Equal(t, bob.prog.SelfPeer.PublicKey, verified.PublicKey)
+
+	// Same message coming from another device of bob.
+	msg.Sender.DeviceID = keybase1.DeviceID(fmt.Sprintf("%x", "bob/phone"))
+	_, err = verifyAnnounceMsg(alice.mctx(), msg, parsed)
+	require.EqualError(t, err, fmt.Sprintf("signed for device ID %q, but sent from %q", bob.prog.SelfDeviceID, msg.Sender.DeviceID))
+}
+
+func TestAnnouncementReplay(t *testing.T) {
+	m := newTestMesh(t, `[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.2" }
+	]`, "alice", "bob")
+	alice := m.start("alice", "laptop")
+	bob := m.start("bob", "desktop")
+	bobDev := bob.prog.Self
+	channel := alice.prog.AnnounceChannel
+
+	alice.prog.Lock()
+	defer alice.prog.Unlock()
+	mctx := alice.mctx()
+	alice.read()
+	first := alice.prog.KeybasePeers[bobDev].LastAnnouncement
+	require.NotZero(t, first.Seq)
+
+	sub, err := alice.prog.API.ListenNewMessages()
+	require.NoError(t, err)
+	defer sub.Shutdown()
+	processNext := func() {
+		subMsg, err := sub.Read()
+		require.NoError(t, err)
+		require.NoError(t, processAnnouncementMsg(mctx, subMsg.Message))
+	}
+
+	bob.prog.Endpoints = []libwireguard.HostPort{libwireguard.ParseHostPort("198.51.100.2:51821")}
+	require.NoError(t, SendAnnouncement(bob.mctx()))
+	processNext()
+	second := alice.prog.KeybasePeers[bobDev].LastAnnouncement
+	require.True(t, second.Seq > first.Seq)
+
+	// First announcement posted again has an old sequence number.
+	messages, err := bob.prog.API.GetTextMessages(channel, false /* unreadOnly */)
+	require.NoError(t, err)
+	var firstBody string
+	for _, msg := range messages {
+		if msg.Id == first.MessageID {
+			firstBody = msg.Content.Text.Body
+		}
+	}
+	require.NotEmpty(t, firstBody)
+	_, err = bob.prog.API.SendMessage(channel, firstBody)
+	require.NoError(t, err)
+	processNext()
+	require.Equal(t, second.MessageID, alice.prog.KeybasePeers[bobDev].LastAnnouncement.MessageID)
+
+	// Edits are not announcements, original is kept.
+	bobClient := bob.prog.API.(*fakeKeybaseClient)
+	require.NoError(t, bobClient.EditMessage(channel, second.MessageID, firstBody))
+	processNext()
+	peer := alice.prog.KeybasePeers[bobDev]
+	require.True(t, peer.Active)
+	require.Equal(t, second.MessageID, peer.LastAnnouncement.MessageID)
+	require.Equal(t, "198.51.100.2:51821", peer.LastAnnouncement.Endpoint.String())
+
+	// Only the announcing user can take the announcement back, deletes by
+	// others (team admins) are ignored.
+	aliceClient := alice.prog.API.(*fakeKeybaseClient)
+	require.NoError(t, aliceClient.DeleteMessage(channel, second.MessageID))
+	processNext()
+	require.True(t, alice.prog.KeybasePeers[bobDev].Active)
+
+	// Deleting the current announcement deactivates the peer, and reading
+	// older announcements again does not bring it back.
+	require.NoError(t, bobClient.DeleteMessage(channel, second.MessageID))
+	processNext()
+	require.False(t, alice.prog.KeybasePeers[bobDev].Active)
+	alice.prog.LastAnnounceMsgID = 0
+	alice.read()
+	require.False(t, alice.prog.KeybasePeers[bobDev].Active)
+
+	// Bob restarts with clock that went back. Sequence numbers continue from
+	// the ones bob sent before.
+	bob.prog.AnnounceSeq += uint64(time.Hour / time.Millisecond)
+	require.NoError(t, SendAnnouncement(bob.mctx()))
+	processNext()
+	last := alice.prog.KeybasePeers[bobDev].LastAnnouncement
+	require.True(t, alice.prog.KeybasePeers[bobDev].Active)
+
+	bob = m.start("bob", "desktop")
+	processNext()
+	peer = alice.prog.KeybasePeers[bobDev]
+	require.True(t, peer.Active)
+	require.True(t, peer.LastAnnouncement.Seq > last.Seq)
+}
+
+func TestPresharedKeys(t *testing.T) {
+	m := newTestMesh(t, `[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+		{ "username": "alice", "device": "server", "ip": "100.0.0.2" },
+		{ "username": "bob", "device": "desktop", "ip": "100.0.0.3" },
+		{ "username": "carol", "device": "phone", "ip": "100.0.0.4" }
+	]`, "alice", "bob", "carol")
+	laptop := m.start("alice", "laptop")
+	server := m.start("alice", "server")
+	bob := m.start("bob", "desktop")
+	// Carol runs an older version without preshared keys, others must not
+	// use one with her.
+	caps := announceCapabilities
+	announceCapabilities = []string{CapMultiEndpoint, CapIPv6, CapSigned}
+	carol := m.start("carol", "phone")
+	announceCapabilities = caps
+
+	m.readAll()
+
+	psk := func(node *testNode, other *testNode) libwireguard.WireguardPresharedKey {
+		for _, peer := range node.lastPeers() {
+			if peer.PublicKey == other.prog.SelfPeer.PublicKey {
+				return peer.PresharedKey
+			}
+		}
+		t.Fatalf("%v has no peer %v", node.prog.Self, other.prog.Self)
+		return libwireguard.WireguardPresharedKey{}
+	}
+
+	// Both sides of each pair agree, pairs have different keys.
+	seen := make(map[libwireguard.WireguardPresharedKey]bool)
+	for i, a := range m.nodes[:3] {
+		for _, b := range m.nodes[i+1 : 3] {
+			key := psk(a, b)
+			require.False(t, key.IsZero(), "%v - %v", a.prog.Self, b.prog.Self)
+			require.Equal(t, key, psk(b, a))
+			require.False(t, seen[key])
+			seen[key] = true
+		}
+		require.True(t, psk(a, carol).IsZero())
+	}
+
+	// Seeds are in private folders of user pairs, carol can't read them.
+	seedPath := pskSeedPath(testTeam, "bob", "alice")
+	require.Equal(t, "/keybase/private/alice,bob/.kb-wireguard-wgteam.psk", seedPath)
+	_, err := carol.prog.API.ReadKBFS(seedPath)
+	require.Error(t, err)
+	_, err = bob.prog.API.ReadKBFS(pskSeedPath(testTeam, "alice", "alice"))
+	require.Error(t, err)
+
+	// Key rotation changes preshared keys of the rotated peer.
+	before := psk(laptop, bob)
+	bob.prog.Lock()
+	bob.prog.SelfPeer.PublicKey = testPubKey("bob/desktop/2")
+	require.NoError(t, SendAnnouncement(bob.mctx()))
+	syncPeers(bob.mctx(), "Rotated key")
+	bob.prog.Unlock()
+	m.readAll()
+	require.NotEqual(t, before, psk(laptop, bob))
+	require.Equal(t, psk(laptop, bob), psk(bob, laptop))
+	require.Equal(t, psk(laptop, server), psk(server, laptop))
+
+	// Laptop and bob created the seed at the same time and laptop kept its
+	// own. Seed is read again once handshakes stop.
+	laptop.prog.Lock()
+	otherSeed, err := libwireguard.GeneratePresharedKey()
+	require.NoError(t, err)
+	now := time.Now()
+	laptop.prog.pskSeeds[seedPath] = pskSeed{seed: otherSeed, loadedAt: now}
+	syncPeers(laptop.mctx(), "Seed race")
+	require.NotEqual(t, psk(laptop, bob), psk(bob, laptop))
+	recheckAt := now.Add(pskRecheckInterval)
+	bobPeer := laptop.prog.KeybasePeers[bob.prog.Self]
+	bobPeer.LastHandshake = recheckAt
+	laptop.prog.KeybasePeers[bob.prog.Self] = bobPeer
+	require.False(t, RecheckPSKSeeds(laptop.mctx(), recheckAt))
+	bobPeer.LastHandshake = recheckAt.Add(-handshakeStaleTimeout)
+	laptop.prog.KeybasePeers[bob.prog.Self] = bobPeer
+	require.False(t, RecheckPSKSeeds(laptop.mctx(), recheckAt.Add(-time.Second)))
+	require.True(t, RecheckPSKSeeds(laptop.mctx(), recheckAt))
+	syncPeers(laptop.mctx(), "Preshared key seeds changed")
+	require.Equal(t, psk(laptop, bob), psk(bob, laptop))
+
+	// Without a seed, peer that uses preshared keys is left out instead of
+	// getting none.
+	serverSeedPath := pskSeedPath(testTeam, "alice", "alice")
+	m.fake.WriteKBFS(serverSeedPath, []byte("garbage\n"))
+	delete(laptop.prog.pskSeeds, serverSeedPath)
+	syncPeers(laptop.mctx(), "Seed is broken")
+	laptop.prog.Unlock()
+	for _, peer := range laptop.lastPeers() {
+		require.NotEqual(t, server.prog.SelfPeer.PublicKey, peer.PublicKey)
+	}
+	require.Len(t, laptop.lastPeers(), 2)
+}
+
+func TestScheduledKeyRotation(t *testing.T) {
+	m := newTestMesh(t, `{
+		"version": 2,
+		"network": { "key_rotation": "24h" },
+		"peers": [
+			{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+			{ "username": "bob", "device": "desktop", "ip": "100.0.0.2" }
+		]
+	}`, "alice", "bob")
+	alice := m.start("alice", "laptop")
+	bob := m.start("bob", "desktop")
+	bobDev := bob.prog.Self
+	oldKey := bob.prog.SelfPeer.PublicKey
+	nextKey := testPubKey("bob/desktop/next")
+	bob.pipe.nextKey = nextKey
+	// Run-dev sends the new key before replying to `rotate-key`, so it's
+	// not waited on with Program locked.
+	bob.pipe.unlocked = bob.prog
+
+	// RotateKeyIfDue locks bob itself.
+	alice.prog.Lock()
+	defer alice.prog.Unlock()
+	rotateCalls := func() int {
+		require.NoError(t, bob.prog.DevRunner.PipeWriter.Flush())
+		return strings.Count(bob.pipe.String(), `"rotate-key"`)
+	}
+
+	now := time.Now()
+	bob.prog.KeyRotatedAt = now.Add(-23 * time.Hour)
+	require.NoError(t, RotateKeyIfDue(bob.mctx(), now))
+	require.True(t, bob.prog.NextKey.IsZero())
+
+	// Next key is announced ahead of the switch, alice keeps using the old
+	// one until then.
+	bob.prog.KeyRotatedAt = now.Add(-24*time.Hour + KeyRotationOverlap)
+	require.NoError(t, RotateKeyIfDue(bob.mctx(), now))
+	require.Equal(t, nextKey, bob.prog.NextKey)
+	switchAt := now.Add(KeyRotationOverlap)
+	require.Equal(t, switchAt, bob.prog.NextKeyAt)
+	alice.read()
+	peer := alice.prog.KeybasePeers[bobDev]
+	require.Equal(t, oldKey, peer.PublicKey)
+	require.Equal(t, nextKey, peer.LastAnnouncement.NextPublicKey)
+	require.False(t, SwitchPeerKeys(alice.mctx(), switchAt.Add(-time.Second)))
+
+	require.NoError(t, RotateKeyIfDue(bob.mctx(), switchAt.Add(-time.Second)))
+	require.Equal(t, 0, rotateCalls())
+
+	// Both sides switch at the same time.
+	require.NoError(t, RotateKeyIfDue(bob.mctx(), switchAt))
+	require.Equal(t, 1, rotateCalls())
+	// Not asked again while the new key is on its way.
+	require.NoError(t, RotateKeyIfDue(bob.mctx(), switchAt.Add(keyRotationCheckInterval)))
+	require.Equal(t, 1, rotateCalls())
+	bob.pipe.unlocked = nil
+	bob.prog.Lock()
+	require.NoError(t, selfKeyChanged(bob.mctx(), nextKey, switchAt))
+	bob.prog.Unlock()
+	require.True(t, bob.prog.NextKey.IsZero())
+	require.Equal(t, switchAt, bob.prog.KeyRotatedAt)
+
+	require.True(t, SwitchPeerKeys(alice.mctx(), switchAt))
+	require.Equal(t, nextKey, alice.prog.KeybasePeers[bobDev].PublicKey)
+	syncPeers(alice.mctx(), "Peer keys rotated")
+	peers := alice.lastPeers()
+	require.Len(t, peers, 1)
+	require.Equal(t, nextKey, peers[0].PublicKey)
+	require.Equal(t, peers[0].PresharedKey, bob.lastPeers()[0].PresharedKey)
+
+	// Announcement made after the switch has only the new key.
+	alice.read()
+	peer = alice.prog.KeybasePeers[bobDev]
+	require.Equal(t, nextKey, peer.PublicKey)
+	require.Equal(t, nextKey, peer.LastAnnouncement.PublicKey)
+	require.True(t, peer.LastAnnouncement.NextPublicKey.IsZero())
+}
+
+func TestExitNode(t *testing.T) {
+	m := newTestMesh(t, `[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+		{ "username": "bob", "device": "gateway", "ip": "100.0.0.2", "exit_node": true },
+		{ "username": "bob", "device": "phone", "ip": "100.0.0.3" }
+	]`, "alice", "bob")
+	alice := m.start("alice", "laptop")
+	bob := m.start("bob", "gateway")
+	require.True(t, bob.prog.SelfPeer.ExitNode)
+
+	alice.prog.Lock()
+	defer alice.prog.Unlock()
+	mctx := alice.mctx()
+
+	for _, v := range []struct {
+		name string
+		err  string
+	}{
+		{"gateway", ""},
+		{"bob/gateway", ""},
+		{"alice/gateway", `exit node "alice/gateway" is not in peers.json`},
+		{"phone", "{bob phone} is not an exit node in peers.json"},
+		{"laptop", `exit node "laptop" is this device`},
+	} {
+		alice.prog.ExitNode = v.name
+		exitNode, err := FindExitNode(alice.prog)
+		if v.err != "" {
+			require.EqualError(t, err, v.err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, bob.prog.Self, exitNode)
+	}
+
+	// Default routes go to the exit node only.
+	alice.prog.ExitNode = "gateway"
+	require.NoError(t, processAnnouncements(mctx, true /* alwaysSync */, "Got new announcements"))
+	peers := alice.lastPeers()
+	require.Len(t, peers, 1)
+	require.Equal(t, []string{"100.0.0.2/32", "0.0.0.0/0", "::/0"}, peers[0].AllowedIPs)
+
+	// Exit node is unmarked in peers.json, traffic is no longer routed
+	// through it.
+	list, err := ParsePeerList([]byte(`[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" },
+		{ "username": "bob", "device": "gateway", "ip": "100.0.0.2" }
+	]`))
+	require.NoError(t, err)
+	require.NoError(t, reloadPeerList(mctx, list))
+	require.Equal(t, []string{"100.0.0.2/32"}, alice.lastPeers()[0].AllowedIPs)
+}
@@ -1 +1,88 @@
 package kbwg
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/zapu/kb-wireguard/libwireguard"
+	"gortc.io/stun"
+)
+
+// DefaultSTUNServers are used for endpoint discovery when no other servers
+// are configured.
+var DefaultSTUNServers = []string{
+	"stun.l.google.com:19302",
+	"stun1.l.google.com:19302",
+	"stun2.l.google.com:19302",
+}
+
+// DiscoverEndpoint finds our public (server reflexive) endpoint by doing STUN
+// binding requests from local UDP port `bindPort`. It has to be the same port
+// that WireGuard will bind to, so NAT mapping that we discover is the one
+// that peers will be able to use. Because of that, it has to be called before
+// `RunDevRunner` - after that, the port is taken by WireGuard device.
+//
+// Servers are tried in order, first successful response wins.
+func DiscoverEndpoint(servers []string, bindPort uint16) (ret libwireguard.HostPort, err error) {
+	if len(servers) == 0 {
+		return ret, fmt.Errorf("no STUN servers configured")
+	}
+
+	var errs []string
+	for _, server := range servers {
+		ret, err = stunBindingRequest(server, bindPort)
+		if err == nil {
+			return ret, nil
+		}
+		fmt.Printf("! STUN request to %s failed: %s\n", server, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", server, err))
+	}
+	return ret, fmt.Errorf("all STUN servers failed: %s", strings.Join(errs, "; "))
+}
+
+func stunBindingRequest(server string, bindPort uint16) (ret libwireguard.HostPort, err error) {
+	raddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return ret, fmt.Errorf("failed to resolve STUN server address: %w", err)
+	}
+	laddr := &net.UDPAddr{Port: int(bindPort)}
+	conn, err := net.DialUDP("udp4", laddr, raddr)
+	if err != nil {
+		return ret, fmt.Errorf("failed to dial udp from port %d: %w", bindPort, err)
+	}
+
+	// Client takes ownership of the connection and closes it in `Close`.
+	c, err := stun.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return ret, fmt.Errorf("failed to stun.NewClient: %w", err)
+	}
+	defer c.Close()
+
+	var resErr error
+	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	err = c.Do(message, func(res stun.Event) {
+		if res.Error != nil {
+			resErr = res.Error
+			return
+		}
+		var xorAddr stun.XORMappedAddress
+		if err := xorAddr.GetFrom(res.Message); err != nil {
+			resErr = fmt.Errorf("failed to get XOR-MAPPED-ADDRESS: %w", err)
+			return
+		}
+		ret.Host = xorAddr.IP
+		ret.Port = uint16(xorAddr.Port)
+	})
+	if err != nil {
+		return ret, err
+	}
+	if resErr != nil {
+		return ret, resErr
+	}
+	if ret.IsNil() {
+		return ret, fmt.Errorf("STUN server did not return an address")
+	}
+	return ret, nil
+}
@@ -0,0 +1,67 @@
+package kbwg
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gortc.io/stun"
+)
+
+// runTestSTUNServer starts STUN responder on localhost that answers binding
+// requests with source address of the request.
+func runTestSTUNServer(t *testing.T) (addr string, stop func()) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := new(stun.Message)
+			req.Raw = append(req.Raw[:0], buf[:n]...)
+			if err := req.Decode(); err != nil {
+				continue
+			}
+			res, err := stun.Build(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: from.IP, Port: from.Port}, stun.Fingerprint)
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(res.Raw, from)
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+func freeUDPPort(t *testing.T) uint16 {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestDiscoverEndpoint(t *testing.T) {
+	addr, stop := runTestSTUNServer(t)
+	defer stop()
+
+	port := freeUDPPort(t)
+	endpoint, err := DiscoverEndpoint([]string{addr}, port)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", endpoint.Host.String())
+	require.Equal(t, port, endpoint.Port)
+
+	// Port should be released after discovery so WireGuard can bind to it.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(port)})
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestDiscoverEndpointNoServers(t *testing.T) {
+	_, err := DiscoverEndpoint(nil, 51820)
+	require.Error(t, err)
+}
@@ -1,10 +1,16 @@
 package kbwg
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 	"github.com/zapu/kb-wireguard/libwireguard"
 )
 
@@ -26,9 +32,26 @@ type KeybasePeer struct {
 	// Was there an announcement from that peer?
 	Active bool
 
+	// Dynamic peers are not in peers.json, they picked their address
+	// themselves and announced it.
+	Dynamic bool
+	// ClaimID is MessageID of the first announcement in which dynamic peer
+	// claimed its current address. Lower claim wins in case of conflict.
+	ClaimID chat1.MessageID
+	// AddressLost is set for dynamic peers that claimed an address that was
+	// claimed by someone else first. They are not added to WireGuard config
+	// until they announce a new address.
+	AddressLost bool
+
 	// IP address for the peer. If we hear an announcement from that peer, we
 	// will give them this address.
 	IP net.IP `json:"ip"`
+	// Optional IPv6 address for dual-stack peers. Only static peers can have
+	// one.
+	IP6 net.IP `json:"ip6"`
+
+	// Configuration of static peers from peers.json.
+	PeerConfig
 
 	// Wireguard public key
 	PublicKey libwireguard.WireguardPubKey `json:"public_key"`
@@ -38,17 +61,92 @@ type KeybasePeer struct {
 	// be implemented.)
 	MulticastID string
 
-	// Endpoint to reach the peer. Either from the announcement, on from LAN
-	// discovery (LAN not implemented).
+	// Endpoint to reach the peer. One of `Candidates`, selected by endpoint
+	// probing.
 	Endpoint libwireguard.HostPort
 
+	// Endpoint candidates from the announcement, in order we want to try
+	// them.
+	Candidates []libwireguard.HostPort
+
+	// Latest WireGuard handshake with the peer, as reported by run-dev.
+	LastHandshake time.Time
+	// Endpoint the device uses for the peer, as reported by run-dev. Differs
+	// from `Endpoint` if the peer roamed.
+	DeviceEndpoint libwireguard.HostPort
+	// Bytes received from and sent to the peer, as reported by run-dev.
+	RxBytes uint64
+	TxBytes uint64
+
 	LastAnnouncement AnnounceMsg
+
+	probe endpointProbe
+}
+
+// PeerConfig is per-peer configuration from peers.json, other than
+// addresses.
+type PeerConfig struct {
+	// Extra subnets routed through the peer, for site-to-site setups.
+	Routes []string
+	// PersistentKeepalive interval in seconds, 0 for default
+	// (`ProbeKeepalive`).
+	Keepalive int
+	// EndpointOverride is used instead of announced endpoints if set.
+	EndpointOverride libwireguard.HostPort
+	// Free-form tags, not used by kb-wireguard itself.
+	Tags []string
+	// ExitNode peers forward traffic of other peers to the internet. Other
+	// peers can route all their traffic through one of them with
+	// `-exit-node`.
+	ExitNode bool
+}
+
+// PeerListVersion is the newest peers.json format we understand. Version 1 is
+// a flat array of peers.
+const PeerListVersion = 2
+
+// PeerList is contents of peers.json.
+type PeerList struct {
+	Version int           `json:"version"`
+	Network NetworkConfig `json:"network"`
+	Peers   []PeerJSON    `json:"peers"`
+}
+
+// NetworkConfig is network-level configuration from peers.json.
+type NetworkConfig struct {
+	// Subnet and Subnet6 are used unless `-subnet` and `-subnet6` flags are
+	// given.
+	Subnet  string `json:"subnet,omitempty"`
+	Subnet6 string `json:"subnet6,omitempty"`
+	// MTU of WireGuard devices, default if 0.
+	MTU int `json:"mtu,omitempty"`
+	// DNS servers to use while connected.
+	DNS []string `json:"dns,omitempty"`
+	// Interval of scheduled key rotation, e.g. "24h". Empty disables it.
+	KeyRotation string `json:"key_rotation,omitempty"`
+}
+
+// KeyRotationInterval returns interval of scheduled key rotation, 0 if it's
+// disabled or invalid.
+func (c NetworkConfig) KeyRotationInterval() time.Duration {
+	interval, err := time.ParseDuration(c.KeyRotation)
+	if err != nil || interval < MinKeyRotation {
+		return 0
+	}
+	return interval
 }
 
 type PeerJSON struct {
 	Username string `json:"username"`
 	Device   string `json:"device"`
 	IP       string `json:"ip"`
+	IP6      string `json:"ip6,omitempty"`
+
+	Routes    []string `json:"routes,omitempty"`
+	Keepalive int      `json:"keepalive,omitempty"`
+	Endpoint  string   `json:"endpoint,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	ExitNode  bool     `json:"exit_node,omitempty"`
 }
 
 func (p PeerJSON) GetKBDev() KBDev {
@@ -61,40 +159,365 @@ func (p PeerJSON) GetKBDev() KBDev {
 func (p PeerJSON) MakeKeybasePeer() (ret KeybasePeer, err error) {
 	ip := net.ParseIP(p.IP)
 	if ip == nil {
-		return ret, fmt.Errorf("invalid IP format")
+		return ret, fmt.Errorf("invalid ip %q", p.IP)
 	}
 	ret.IP = ip
+	if p.IP6 != "" {
+		ip6 := net.ParseIP(p.IP6)
+		if ip6 == nil || ip6.To4() != nil {
+			return ret, fmt.Errorf("invalid ip6 %q, has to be an IPv6 address", p.IP6)
+		}
+		ret.IP6 = ip6
+	}
+	for _, route := range p.Routes {
+		_, ipNet, err := net.ParseCIDR(route)
+		if err != nil {
+			return ret, fmt.Errorf("invalid route %q: %w", route, err)
+		}
+		ret.Routes = append(ret.Routes, ipNet.String())
+	}
+	if p.Keepalive < 0 || p.Keepalive > 65535 {
+		return ret, fmt.Errorf("invalid keepalive %d", p.Keepalive)
+	}
+	ret.Keepalive = p.Keepalive
+	if p.Endpoint != "" {
+		ret.EndpointOverride = libwireguard.ParseHostPort(p.Endpoint)
+		if !ret.EndpointOverride.Exists() {
+			return ret, fmt.Errorf("invalid endpoint %q", p.Endpoint)
+		}
+	}
+	ret.Tags = p.Tags
+	ret.ExitNode = p.ExitNode
 	ret.Device = p.GetKBDev()
 	return ret, nil
 }
 
-func LoadPeerList(mctx MetaContext) (peers []PeerJSON, err error) {
-	peerBytes, err := KeybaseReadKBFS(mctx.API(), fmt.Sprintf("/keybase/team/%s/peers.json", mctx.Prog.KeybaseTeam))
+// AllowedIPs returns addresses and routes of the peer as WireGuard allowed
+// IPs.
+func (p KeybasePeer) AllowedIPs() (ret []string) {
+	ret = append(ret, hostCIDR(p.IP))
+	if p.IP6 != nil {
+		ret = append(ret, hostCIDR(p.IP6))
+	}
+	return append(ret, p.Routes...)
+}
+
+// endpointCandidates returns endpoints to try for the peer: the one from
+// peers.json if it's set there, otherwise the announced ones.
+func (p KeybasePeer) endpointCandidates(localNets []*net.IPNet) []libwireguard.HostPort {
+	if p.EndpointOverride.Exists() {
+		return []libwireguard.HostPort{p.EndpointOverride}
+	}
+	return SortCandidates(p.LastAnnouncement.Endpoints, localNets)
+}
+
+func hostCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return fmt.Sprintf("%s/32", ip)
+	}
+	return fmt.Sprintf("%s/128", ip)
+}
+
+// DefaultPrefix6 is the prefix length of our IPv6 address if there is no
+// IPv6 subnet configured.
+const DefaultPrefix6 = 64
+
+// SelfAddresses returns our addresses with prefix lengths of team subnets, to
+// be assigned to WireGuard device.
+func (p *Program) SelfAddresses() (ret []string) {
+	prefix, _ := p.Subnet.Mask.Size()
+	ret = append(ret, fmt.Sprintf("%s/%d", p.SelfPeer.IP, prefix))
+	if p.SelfPeer.IP6 != nil {
+		prefix6 := DefaultPrefix6
+		if p.Subnet6 != nil {
+			prefix6, _ = p.Subnet6.Mask.Size()
+		}
+		ret = append(ret, fmt.Sprintf("%s/%d", p.SelfPeer.IP6, prefix6))
+	}
+	return ret
+}
+
+func peerListPath(team string) string {
+	return fmt.Sprintf("/keybase/team/%s/peers.json", team)
+}
+
+func LoadPeerList(mctx MetaContext) (list PeerList, err error) {
+	peerBytes, err := mctx.API().ReadKBFS(peerListPath(mctx.Prog.KeybaseTeam))
 	if err != nil {
-		return nil, err
+		return list, err
 	}
+	return ParsePeerList(peerBytes)
+}
 
-	err = json.Unmarshal(peerBytes, &peers)
+// ParsePeerList parses contents of peers.json, either a flat array of peers
+// (version 1) or an object with "version" field.
+func ParsePeerList(peerBytes []byte) (list PeerList, err error) {
+	trimmed := bytes.TrimSpace(peerBytes)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		list.Version = 1
+		err = json.Unmarshal(trimmed, &list.Peers)
+	} else {
+		// Newer versions are expected to only add fields, so we parse what
+		// we understand.
+		err = json.Unmarshal(trimmed, &list)
+		if err == nil && list.Version < 2 {
+			err = fmt.Errorf("unsupported version %d", list.Version)
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Failed to unmarshal peers.json: %w", err)
+		return PeerList{}, fmt.Errorf("Failed to unmarshal peers.json: %w", err)
+	}
+	return list, nil
+}
+
+// makeKeybasePeers turns peers.json entries into peers. We are returned
+// separately, `self` is nil if we are not in the list.
+func (p *Program) makeKeybasePeers(peers []PeerJSON) (self *KeybasePeer, others map[KBDev]KeybasePeer, err error) {
+	others = make(map[KBDev]KeybasePeer, len(peers))
+	for _, peer := range peers {
+		kbPeer, err := peer.MakeKeybasePeer()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse kb peer %v: %w", peer.GetKBDev(), err)
+		}
+
+		if kbPeer.Device == p.Self {
+			if self != nil {
+				// TODO: be smarter about finding duplicates in peers.json
+				return nil, nil, fmt.Errorf("Found self twice???")
+			}
+			self = &kbPeer
+		} else {
+			others[kbPeer.Device] = kbPeer
+		}
 	}
-	return peers, nil
+	return self, others, nil
+}
+
+// SetPeerList fills `SelfPeer` and `KeybasePeers` of the program from
+// peers.json entries. Returns false if we are not in the list (then we need
+// a dynamic address).
+func (p *Program) SetPeerList(peers []PeerJSON) (foundSelf bool, err error) {
+	self, others, err := p.makeKeybasePeers(peers)
+	if err != nil {
+		return false, err
+	}
+	if self != nil {
+		p.SelfPeer = *self
+	}
+	p.KeybasePeers = others
+	return self != nil, nil
+}
+
+// ReloadPeerList applies changed peers.json to running program. Peers that
+// were added, removed or got new addresses are updated, the rest keep their
+// announcement state. Returns true if peers were added, then announcements
+// have to be read again, since the new peers might have announced already.
+func ReloadPeerList(mctx MetaContext, peers []PeerJSON) (added bool, err error) {
+	prog := mctx.Prog
+	self, others, err := prog.makeKeybasePeers(peers)
+	if err != nil {
+		return false, err
+	}
+
+	for kbdev, peer := range prog.KeybasePeers {
+		if peer.Dynamic {
+			continue
+		}
+		newPeer, ok := others[kbdev]
+		if !ok {
+			fmt.Printf("- %v was removed from peers.json\n", kbdev)
+			delete(prog.KeybasePeers, kbdev)
+			continue
+		}
+		if !newPeer.IP.Equal(peer.IP) || !newPeer.IP6.Equal(peer.IP6) ||
+			!reflect.DeepEqual(newPeer.PeerConfig, peer.PeerConfig) {
+			fmt.Printf(":: %v has new config in peers.json: %v\n", kbdev, newPeer.AllowedIPs())
+			peer.IP = newPeer.IP
+			peer.IP6 = newPeer.IP6
+			peer.setConfig(newPeer.PeerConfig)
+			prog.KeybasePeers[kbdev] = peer
+		}
+	}
+	for kbdev, newPeer := range others {
+		peer, ok := prog.KeybasePeers[kbdev]
+		switch {
+		case !ok:
+			fmt.Printf("+ %v was added to peers.json\n", kbdev)
+			peer = newPeer
+			added = true
+		case peer.Dynamic:
+			fmt.Printf(":: Dynamic peer %v was added to peers.json with address %v\n", kbdev, newPeer.AllowedIPs())
+			peer.Dynamic = false
+			peer.ClaimID = 0
+			peer.AddressLost = false
+			peer.IP = newPeer.IP
+			peer.IP6 = newPeer.IP6
+			peer.setConfig(newPeer.PeerConfig)
+		default:
+			continue
+		}
+		prog.KeybasePeers[kbdev] = peer
+	}
+
+	selfPeer := &prog.SelfPeer
+	if exitNode := self != nil && self.ExitNode; exitNode != selfPeer.ExitNode {
+		if exitNode {
+			fmt.Printf(":: We are now an exit node\n")
+		} else {
+			fmt.Printf(":: We are no longer an exit node\n")
+		}
+		selfPeer.ExitNode = exitNode
+	}
+	switch {
+	case self == nil && !selfPeer.Dynamic:
+		fmt.Printf("! We were removed from peers.json, picking a dynamic address\n")
+		selfPeer.IP6 = nil
+		if err := AllocateSelfAddress(mctx); err != nil {
+			return added, err
+		}
+	case self != nil && (selfPeer.Dynamic || !self.IP.Equal(selfPeer.IP) || !self.IP6.Equal(selfPeer.IP6)):
+		fmt.Printf(":: Our address in peers.json is now: %v\n", self.AllowedIPs())
+		selfPeer.Dynamic = false
+		selfPeer.ClaimID = 0
+		selfPeer.IP = self.IP
+		selfPeer.IP6 = self.IP6
+	default:
+		return added, nil
+	}
+	fmt.Printf(":: We are: %s\n", strings.Join(prog.SelfAddresses(), ", "))
+	return added, selfAddressChanged(mctx)
+}
+
+// setConfig replaces peers.json config of the peer. Endpoint candidates are
+// updated if endpoint override changed.
+func (p *KeybasePeer) setConfig(config PeerConfig) {
+	overrideChanged := !config.EndpointOverride.Equal(p.EndpointOverride)
+	p.PeerConfig = config
+	if overrideChanged && p.Active {
+		p.SetCandidates(p.endpointCandidates(localNetworks()), time.Now())
+	}
+}
+
+// How often peers.json is read again to look for changes.
+const peerListReloadInterval = 1 * time.Minute
+
+// PeerListBgTask periodically reads peers.json and applies changes, resyncing
+// run-dev if WireGuard peers changed.
+func PeerListBgTask(mctx MetaContext) error {
+	var lastBytes []byte
+	ticker := time.NewTicker(peerListReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			peerBytes, err := mctx.API().ReadKBFS(peerListPath(mctx.Prog.KeybaseTeam))
+			if err != nil {
+				fmt.Printf("! Failed to read peers.json: %s\n", err)
+				continue
+			}
+			if lastBytes != nil && bytes.Equal(peerBytes, lastBytes) {
+				continue
+			}
+			list, err := ParsePeerList(peerBytes)
+			if err != nil {
+				fmt.Printf("! Not applying changed peers.json: %s\n", err)
+				continue
+			}
+			if err := CheckPeerList(mctx, list); err != nil {
+				fmt.Printf("! Not applying changed peers.json: %s\n", err)
+				continue
+			}
+			mctx.Prog.Lock()
+			err = reloadPeerList(mctx, list)
+			mctx.Prog.Unlock()
+			if err != nil {
+				fmt.Printf("! Failed to apply changed peers.json: %s\n", err)
+				continue
+			}
+			lastBytes = peerBytes
+		case <-mctx.Ctx.Done():
+			return mctx.Ctx.Err()
+		}
+	}
+}
+
+// reloadPeerList applies new peer list and syncs peers with run-dev if
+// needed. Has to be called with Program locked.
+func reloadPeerList(mctx MetaContext, list PeerList) error {
+	network := mctx.Prog.Network
+	if list.Network.Subnet != network.Subnet || list.Network.Subnet6 != network.Subnet6 {
+		fmt.Printf("! Team subnet changed in peers.json, restart kb-wireguard to apply\n")
+	}
+	networkChanged := list.Network.MTU != network.MTU || !reflect.DeepEqual(list.Network.DNS, network.DNS)
+	mctx.Prog.Network = list.Network
+
+	before := SerializeWireGuardPeerList(mctx)
+	wasExitNode := mctx.Prog.SelfPeer.ExitNode
+	added, err := ReloadPeerList(mctx, list.Peers)
+	if err != nil {
+		return err
+	}
+	if networkChanged || wasExitNode != mctx.Prog.SelfPeer.ExitNode {
+		SendNetworkSettings(mctx)
+	}
+	if mctx.Prog.ExitNode != "" {
+		if _, err := FindExitNode(mctx.Prog); err != nil {
+			fmt.Printf("! Not routing traffic through exit node: %s\n", err)
+		}
+	}
+	if added {
+		// Read recent announcements again to find the new peers.
+		mctx.Prog.LastAnnounceMsgID = 0
+		if _, err := FindAnnouncements(mctx); err != nil {
+			return err
+		}
+	}
+	if ResolveAddressConflicts(mctx) {
+		if err := rerollAddress(mctx); err != nil {
+			return err
+		}
+	}
+	if !reflect.DeepEqual(before, SerializeWireGuardPeerList(mctx)) {
+		syncPeers(mctx, "peers.json changed")
+	}
+	return nil
 }
 
 func SerializeWireGuardPeerList(mctx MetaContext) (ret []libwireguard.WireguardPeer) {
 	ret = make([]libwireguard.WireguardPeer, 0, len(mctx.Prog.KeybasePeers))
+	exitNode, _ := FindExitNode(mctx.Prog)
 	for _, v := range mctx.Prog.KeybasePeers {
-		if !v.Active {
+		if !v.Active || v.AddressLost {
+			continue
+		}
+		psk, ok := PresharedKeyFor(mctx, v)
+		if !ok {
 			continue
 		}
 
 		label := fmt.Sprintf("%s (%s)", v.Device.Username, v.Device.Device)
+		// Keep the tunnel busy so we get handshakes that tell us if the
+		// endpoint works.
+		keepalive := ProbeKeepalive
+		if v.Keepalive != 0 {
+			keepalive = v.Keepalive
+		}
+		allowedIPs := v.AllowedIPs()
+		if v.Device == exitNode {
+			allowedIPs = append(allowedIPs, DefaultRoutes...)
+		}
 		ret = append(ret, libwireguard.WireguardPeer{
-			PublicKey:  string(v.PublicKey),
-			AllowedIPs: v.IP.String(),
-			Endpoint:   v.Endpoint.String(),
-			Label:      label,
+			PublicKey:           v.PublicKey,
+			AllowedIPs:          allowedIPs,
+			Endpoint:            v.Endpoint.String(),
+			Label:               label,
+			PersistentKeepalive: keepalive,
+			PresharedKey:        psk,
 		})
 	}
+	// Stable order, so peer lists can be compared.
+	sort.Slice(ret, func(i, j int) bool {
+		return bytes.Compare(ret[i].PublicKey[:], ret[j].PublicKey[:]) < 0
+	})
 	return ret
 }
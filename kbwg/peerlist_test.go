@@ -0,0 +1,96 @@
+package kbwg
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+func TestDualStackPeers(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("100.0.0.0/16")
+	require.NoError(t, err)
+	prog := &Program{
+		Self:   KBDev{Username: "alice", Device: "laptop"},
+		Subnet: subnet,
+	}
+	foundSelf, err := prog.SetPeerList([]PeerJSON{
+		{Username: "alice", Device: "laptop", IP: "100.0.0.1", IP6: "fd00:6b62::1"},
+		{Username: "bob", Device: "desktop", IP: "100.0.0.2", IP6: "fd00:6b62::2"},
+		{Username: "carol", Device: "phone", IP: "100.0.0.3"},
+	})
+	require.NoError(t, err)
+	require.True(t, foundSelf)
+
+	require.Equal(t, []string{"100.0.0.1/16", "fd00:6b62::1/64"}, prog.SelfAddresses())
+	_, prog.Subnet6, err = net.ParseCIDR("fd00:6b62::/48")
+	require.NoError(t, err)
+	require.Equal(t, []string{"100.0.0.1/16", "fd00:6b62::1/48"}, prog.SelfAddresses())
+
+	bob := prog.KeybasePeers[KBDev{Username: "bob", Device: "desktop"}]
+	require.Equal(t, []string{"100.0.0.2/32", "fd00:6b62::2/128"}, bob.AllowedIPs())
+	carol := prog.KeybasePeers[KBDev{Username: "carol", Device: "phone"}]
+	require.Equal(t, []string{"100.0.0.3/32"}, carol.AllowedIPs())
+
+	_, err = prog.SetPeerList([]PeerJSON{
+		{Username: "bob", Device: "desktop", IP: "100.0.0.2", IP6: "100.0.0.2"},
+	})
+	require.Error(t, err)
+}
+
+func TestParsePeerList(t *testing.T) {
+	list, err := ParsePeerList([]byte(`
+	[
+		{ "username": "alice", "device": "laptop", "ip": "100.0.0.1" }
+	]`))
+	require.NoError(t, err)
+	require.Equal(t, 1, list.Version)
+	require.Len(t, list.Peers, 1)
+
+	list, err = ParsePeerList([]byte(`{
+		"version": 2,
+		"network": { "subnet": "10.8.0.0/16", "mtu": 1380, "dns": ["10.8.0.1"] },
+		"peers": [
+			{ "username": "alice", "device": "laptop", "ip": "10.8.0.1" },
+			{
+				"username": "office", "device": "router", "ip": "10.8.0.2",
+				"routes": ["192.168.10.1/24"], "keepalive": 10,
+				"endpoint": "198.51.100.7:51820", "tags": ["site", "exit"]
+			}
+		]
+	}`))
+	require.NoError(t, err)
+	require.Equal(t, 2, list.Version)
+	require.Equal(t, NetworkConfig{Subnet: "10.8.0.0/16", MTU: 1380, DNS: []string{"10.8.0.1"}}, list.Network)
+	require.Len(t, list.Peers, 2)
+
+	router, err := list.Peers[1].MakeKeybasePeer()
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.168.10.0/24"}, router.Routes)
+	require.Equal(t, []string{"10.8.0.2/32", "192.168.10.0/24"}, router.AllowedIPs())
+	require.Equal(t, 10, router.Keepalive)
+	require.Equal(t, "198.51.100.7:51820", router.EndpointOverride.String())
+	require.Equal(t, []string{"site", "exit"}, router.Tags)
+
+	// Endpoint override is used instead of announced endpoints.
+	_, subnet, err := net.ParseCIDR("10.8.0.0/16")
+	require.NoError(t, err)
+	prog := &Program{Subnet: subnet, KeybasePeers: map[KBDev]KeybasePeer{}}
+	router.Active = true
+	router.PublicKey = testPubKey("router")
+	router.LastAnnouncement.Endpoints = []libwireguard.HostPort{libwireguard.ParseHostPort("203.0.113.5:51820")}
+	router.SetCandidates(router.endpointCandidates(nil), time.Now())
+	prog.KeybasePeers[router.Device] = router
+	wgPeers := SerializeWireGuardPeerList(prog.MCtxTODO())
+	require.Len(t, wgPeers, 1)
+	require.Equal(t, "198.51.100.7:51820", wgPeers[0].Endpoint)
+	require.Equal(t, 10, wgPeers[0].PersistentKeepalive)
+
+	_, err = ParsePeerList([]byte(`{ "peers": [] }`))
+	require.Error(t, err)
+	list.Peers[1].Routes = []string{"192.168.10.1"}
+	_, err = list.Peers[1].MakeKeybasePeer()
+	require.Error(t, err)
+}
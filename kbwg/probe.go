@@ -0,0 +1,204 @@
+package kbwg
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+// Peers can announce more than one endpoint candidate: manually configured
+// ones, the one discovered with STUN, and addresses of their local network
+// interfaces. We don't know which one is reachable from where we are, so we
+// try them one by one, watching WireGuard handshakes reported by run-dev.
+
+const (
+	// How long to wait for a handshake after switching to a candidate before
+	// trying the next one.
+	probeTimeout = 15 * time.Second
+	// If a working candidate does not handshake for that long, it's
+	// considered dead and we start probing again. WireGuard re-handshakes
+	// every 2 minutes when there is traffic, and `ProbeKeepalive` makes sure
+	// there is.
+	handshakeStaleTimeout = 3 * time.Minute
+	// ProbeKeepalive is PersistentKeepalive used for peers, so handshakes
+	// keep happening even on idle tunnels and we can tell if endpoint works.
+	ProbeKeepalive = 25
+)
+
+// endpointProbe is a state of endpoint selection for a peer.
+type endpointProbe struct {
+	// Index of currently used candidate in `KeybasePeer.Candidates`.
+	index int
+	// When we switched to current candidate.
+	since time.Time
+	// Did we see a handshake since we switched to current candidate.
+	working bool
+}
+
+// LocalEndpointCandidates returns endpoint candidates for addresses of local
+// network interfaces, with port `port`. These are useful for peers that are
+// in the same LAN as we are. Addresses in `exclude` (our VPN addresses) are
+// skipped.
+func LocalEndpointCandidates(port uint16, exclude ...net.IP) (ret []libwireguard.HostPort, err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get addresses of %s: %w", iface.Name, err)
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipNet.IP
+			if !ip.IsGlobalUnicast() || containsIP(exclude, ip) {
+				continue
+			}
+			ret = append(ret, libwireguard.HostPort{Host: ip, Port: port})
+		}
+	}
+	return ret, nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// localNetworks returns networks of local interfaces.
+func localNetworks() (ret []*net.IPNet) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		fmt.Printf("! Failed to get interface addresses: %s\n", err)
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			ret = append(ret, ipNet)
+		}
+	}
+	return ret
+}
+
+// SortCandidates orders endpoint candidates so these that are in one of
+// `localNets` come first - if a peer is in the same LAN as we are, talking to
+// them directly is better than going through NAT. Otherwise, the order
+// announced by the peer is kept.
+func SortCandidates(candidates []libwireguard.HostPort, localNets []*net.IPNet) []libwireguard.HostPort {
+	isLocal := func(hp libwireguard.HostPort) bool {
+		for _, n := range localNets {
+			if n.Contains(hp.Host) {
+				return true
+			}
+		}
+		return false
+	}
+	ret := make([]libwireguard.HostPort, len(candidates))
+	copy(ret, candidates)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return isLocal(ret[i]) && !isLocal(ret[j])
+	})
+	return ret
+}
+
+// SetCandidates sets new endpoint candidates for the peer. If current
+// endpoint is still one of them, it's kept along with its probe state, so
+// periodic announcements don't disturb a working endpoint. Otherwise endpoint
+// probing restarts from the first (best) candidate.
+func (p *KeybasePeer) SetCandidates(candidates []libwireguard.HostPort, now time.Time) {
+	if len(p.Candidates) > 0 {
+		for i, candidate := range candidates {
+			if candidate.Equal(p.Endpoint) {
+				p.Candidates = candidates
+				p.probe.index = i
+				return
+			}
+		}
+	}
+	p.Candidates = candidates
+	p.probe = endpointProbe{since: now}
+	if len(candidates) > 0 {
+		p.Endpoint = candidates[0]
+	}
+}
+
+// probeStep advances endpoint probing for the peer. Returns true if peer's
+// endpoint was changed and WireGuard config has to be synced.
+func (p *KeybasePeer) probeStep(now time.Time) (changed bool) {
+	if len(p.Candidates) == 0 {
+		return false
+	}
+
+	if p.LastHandshake.After(p.probe.since) {
+		if !p.probe.working {
+			fmt.Printf("+ %v: endpoint %s works\n", p.Device, p.Endpoint)
+		}
+		p.probe.working = true
+	}
+
+	if p.probe.working {
+		if now.Sub(p.LastHandshake) < handshakeStaleTimeout {
+			return false
+		}
+		fmt.Printf("! %v: no handshake through %s since %s, trying other endpoints\n",
+			p.Device, p.Endpoint, p.LastHandshake.Format(time.RFC3339))
+	} else if now.Sub(p.probe.since) < probeTimeout {
+		return false
+	}
+
+	if len(p.Candidates) == 1 {
+		// Nothing else to try, but restart the timer so we don't spam the
+		// messages above.
+		p.probe = endpointProbe{since: now}
+		return false
+	}
+
+	next := (p.probe.index + 1) % len(p.Candidates)
+	p.probe = endpointProbe{index: next, since: now}
+	p.Endpoint = p.Candidates[next]
+	fmt.Printf("+ %v: trying endpoint %s\n", p.Device, p.Endpoint)
+	return true
+}
+
+// ProbeEndpoints does a probing step for all active peers. Returns true if
+// any of the endpoints changed.
+func ProbeEndpoints(mctx MetaContext, now time.Time) (changed bool) {
+	for kbdev, peer := range mctx.Prog.KeybasePeers {
+		if !peer.Active {
+			continue
+		}
+		if peer.probeStep(now) {
+			changed = true
+		}
+		mctx.Prog.KeybasePeers[kbdev] = peer
+	}
+	return changed
+}
+
+// UpdatePeerStats stores runtime state of peers reported by run-dev,
+// matching them by public key.
+func UpdatePeerStats(mctx MetaContext, stats map[libwireguard.WireguardPubKey]PeerStats) {
+	for kbdev, peer := range mctx.Prog.KeybasePeers {
+		if s, ok := stats[peer.PublicKey]; ok && peer.Active {
+			peer.LastHandshake = s.LastHandshake
+			peer.DeviceEndpoint = s.Endpoint
+			peer.RxBytes = s.RxBytes
+			peer.TxBytes = s.TxBytes
+			mctx.Prog.KeybasePeers[kbdev] = peer
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package kbwg
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zapu/kb-wireguard/libpipe"
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+func TestSortCandidates(t *testing.T) {
+	_, lan, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	candidates := []libwireguard.HostPort{
+		libwireguard.ParseHostPort("94.130.0.10:51820"),
+		libwireguard.ParseHostPort("10.0.0.5:51820"),
+		libwireguard.ParseHostPort("192.168.1.20:51820"),
+	}
+	sorted := SortCandidates(candidates, []*net.IPNet{lan})
+	require.Equal(t, "192.168.1.20:51820", sorted[0].String())
+	require.Equal(t, "94.130.0.10:51820", sorted[1].String())
+	require.Equal(t, "10.0.0.5:51820", sorted[2].String())
+	// Input is not modified.
+	require.Equal(t, "94.130.0.10:51820", candidates[0].String())
+}
+
+func TestProbeStep(t *testing.T) {
+	now := time.Now()
+	var peer KeybasePeer
+	peer.SetCandidates([]libwireguard.HostPort{
+		libwireguard.ParseHostPort("192.168.1.20:51820"),
+		libwireguard.ParseHostPort("94.130.0.10:51820"),
+	}, now)
+	require.Equal(t, "192.168.1.20:51820", peer.Endpoint.String())
+
+	// No handshake through first candidate, move to the next one.
+	require.False(t, peer.probeStep(now.Add(5*time.Second)))
+	now = now.Add(probeTimeout + time.Second)
+	require.True(t, peer.probeStep(now))
+	require.Equal(t, "94.130.0.10:51820", peer.Endpoint.String())
+
+	// Handshake through second one, it should stick.
+	peer.LastHandshake = now.Add(time.Second)
+	now = now.Add(probeTimeout + time.Second)
+	require.False(t, peer.probeStep(now))
+	require.Equal(t, "94.130.0.10:51820", peer.Endpoint.String())
+
+	// Handshakes stop, fall back to probing from the start.
+	now = peer.LastHandshake.Add(handshakeStaleTimeout + time.Second)
+	require.True(t, peer.probeStep(now))
+	require.Equal(t, "192.168.1.20:51820", peer.Endpoint.String())
+}
+
+func TestSetCandidatesKeepsEndpoint(t *testing.T) {
+	now := time.Now()
+	candidates := []libwireguard.HostPort{
+		libwireguard.ParseHostPort("192.168.1.20:51820"),
+		libwireguard.ParseHostPort("94.130.0.10:51820"),
+	}
+	var peer KeybasePeer
+	peer.SetCandidates(candidates, now)
+
+	// LAN candidate does not work, public one does.
+	now = now.Add(probeTimeout + time.Second)
+	require.True(t, peer.probeStep(now))
+	peer.LastHandshake = now.Add(time.Second)
+	require.False(t, peer.probeStep(now.Add(2*time.Second)))
+	require.True(t, peer.probe.working)
+
+	// Periodic announcement with the same candidates keeps the working
+	// endpoint.
+	peer.SetCandidates(candidates, now)
+	require.Equal(t, "94.130.0.10:51820", peer.Endpoint.String())
+	require.True(t, peer.probe.working)
+
+	// So does a new candidate list that still has it.
+	candidates = append(candidates, libwireguard.ParseHostPort("203.0.113.7:51820"))
+	peer.SetCandidates(candidates, now)
+	require.Equal(t, "94.130.0.10:51820", peer.Endpoint.String())
+	require.Len(t, peer.Candidates, 3)
+	require.True(t, peer.Candidates[peer.probe.index].Equal(peer.Endpoint))
+
+	// Endpoint that is gone restarts probing.
+	peer.SetCandidates([]libwireguard.HostPort{candidates[0], candidates[2]}, now)
+	require.Equal(t, "192.168.1.20:51820", peer.Endpoint.String())
+	require.False(t, peer.probe.working)
+}
+
+func TestUpdatePeerStats(t *testing.T) {
+	bobDev := KBDev{Username: "bob", Device: "desktop"}
+	carolDev := KBDev{Username: "carol", Device: "phone"}
+	_, subnet, err := net.ParseCIDR(DefaultSubnet)
+	require.NoError(t, err)
+	prog := &Program{Subnet: subnet, KeybasePeers: map[KBDev]KeybasePeer{
+		bobDev:   {Device: bobDev, Active: true, PublicKey: testPubKey("bob")},
+		carolDev: {Device: carolDev, PublicKey: testPubKey("carol")},
+	}}
+	prog.SelfPeer.IP = net.ParseIP("100.0.0.1")
+	mctx := prog.MCtxTODO()
+
+	now := time.Unix(1600000000, 0)
+	stats := MakePeerStats(libpipe.StatsMsg{Peers: []libpipe.PeerStats{
+		{PublicKey: testPubKey("bob").Base64(), Endpoint: "94.130.0.10:51820", LastHandshake: now.Unix(), RxBytes: 100, TxBytes: 200},
+		{PublicKey: testPubKey("carol").Base64(), LastHandshake: now.Unix()},
+	}})
+	UpdatePeerStats(mctx, stats)
+
+	bob := prog.KeybasePeers[bobDev]
+	require.Equal(t, now, bob.LastHandshake)
+	require.Equal(t, "94.130.0.10:51820", bob.DeviceEndpoint.String())
+	require.Equal(t, uint64(100), bob.RxBytes)
+	require.Equal(t, uint64(200), bob.TxBytes)
+	require.Equal(t, PeerStateConnected, PeerState(bob, now.Add(time.Minute)))
+	require.Equal(t, PeerStateStale, PeerState(bob, now.Add(handshakeStaleTimeout)))
+
+	// Inactive peers are not updated.
+	carol := prog.KeybasePeers[carolDev]
+	require.True(t, carol.LastHandshake.IsZero())
+	require.Equal(t, PeerStateInactive, PeerState(carol, now))
+	carol.Active = true
+	require.Equal(t, PeerStateNever, PeerState(carol, now))
+
+	status := GetTeamStatus(mctx, "kbwg0", now)
+	require.Equal(t, 2, status.Peers)
+	require.Equal(t, 1, status.ActivePeers)
+	require.Equal(t, 1, status.ConnectedPeers)
+	peers := GetPeerStatuses(mctx, now)
+	require.Len(t, peers, 2)
+	require.Equal(t, PeerStateConnected, peers[0].State)
+	require.Equal(t, "94.130.0.10:51820", peers[0].Endpoint)
+	require.Equal(t, PeerStateInactive, peers[1].State)
+}
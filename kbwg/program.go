@@ -2,21 +2,45 @@ package kbwg
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
 
-	"github.com/keybase/go-keybase-chat-bot/kbchat"
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
 	"github.com/zapu/kb-wireguard/libwireguard"
 )
 
 type Program struct {
-	API *kbchat.API
+	// Guards peer state (`SelfPeer`, `KeybasePeers`) that is accessed from
+	// multiple background tasks.
+	sync.Mutex
+
+	API KeybaseClient
 
 	Self         KBDev
 	SelfDeviceID string
 
 	KeybaseTeam string
+	// Subnet of the team network. Dynamic peers pick their addresses from it.
+	Subnet *net.IPNet
+	// IPv6 subnet of the team network, optional. Only used for the prefix
+	// length of our IPv6 address, if we have one.
+	Subnet6 *net.IPNet
+	// Network settings from peers.json.
+	Network NetworkConfig
+	// Accept announcements that are not signed, e.g. from peers running
+	// older versions of kb-wireguard.
+	AllowUnsigned bool
 
-	Endpoint libwireguard.HostPort
+	// Our endpoint candidates, in order of preference. These are announced
+	// to other peers.
+	Endpoints []libwireguard.HostPort
+	// Port that our WireGuard device listens on.
+	ListenPort uint16
+	// Peer that we route all traffic through, "device" or "username/device"
+	// from `-exit-node`. Empty if we don't use an exit node.
+	ExitNode string
 
 	// `KeybasePeers` is a list of peers from peers.json excluding ourselves.
 	// So the actual list of all peers in the VPN is `KeybasePeers` +
@@ -26,8 +50,27 @@ type Program struct {
 	KeybasePeers map[KBDev]KeybasePeer
 
 	AnnounceChannel chat1.ChatChannel
+	// ID of the newest message in `AnnounceChannel` that we have processed.
+	// Tracked by us instead of relying on unread state of the conversation.
+	LastAnnounceMsgID chat1.MessageID
+	// Sequence number of our last announcement.
+	AnnounceSeq uint64
+
+	// When our current key pair came into use (or when we started).
+	KeyRotatedAt time.Time
+	// Key pair that run-dev prepared for scheduled rotation, we switch to it
+	// at `NextKeyAt`. Zero if no rotation is pending.
+	NextKey   libwireguard.WireguardPubKey
+	NextKeyAt time.Time
+	// Set when we asked run-dev to switch to `NextKey`, until the new key
+	// comes back, so we don't ask twice.
+	switchingKey bool
 
 	DevRunner *DevRunnerProcess
+	// Peers last sent to run-dev, to log what changed on the next sync.
+	syncedPeers []libwireguard.WireguardPeer
+	// PSK seeds read from KBFS, by path. See `psk.go`.
+	pskSeeds map[string]pskSeed
 }
 
 type MetaContext struct {
@@ -35,7 +78,7 @@ type MetaContext struct {
 	Ctx  context.Context
 }
 
-func (mctx MetaContext) API() *kbchat.API {
+func (mctx MetaContext) API() KeybaseClient {
 	return mctx.Prog.API
 }
 
@@ -46,8 +89,30 @@ func (p *Program) MCtxTODO() MetaContext {
 	}
 }
 
+// SetSubnets parses and sets team subnets. Empty `subnet` means
+// `DefaultSubnet`, empty `subnet6` means no IPv6 subnet.
+func (p *Program) SetSubnets(subnet string, subnet6 string) error {
+	if subnet == "" {
+		subnet = DefaultSubnet
+	}
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil || ipNet.IP.To4() == nil {
+		return fmt.Errorf("subnet %q has to be an IPv4 CIDR", subnet)
+	}
+	p.Subnet = ipNet
+	p.Subnet6 = nil
+	if subnet6 != "" {
+		_, ipNet, err := net.ParseCIDR(subnet6)
+		if err != nil || ipNet.IP.To4() != nil {
+			return fmt.Errorf("subnet6 %q has to be an IPv6 CIDR", subnet6)
+		}
+		p.Subnet6 = ipNet
+	}
+	return nil
+}
+
 func (p *Program) LoadSelf(ctx context.Context) error {
-	kbStatus, err := KeybaseGetLoggedInStatus(p.API)
+	kbStatus, err := p.API.LoggedInStatus()
 	if err != nil {
 		return err
 	}
@@ -59,3 +124,15 @@ func (p *Program) LoadSelf(ctx context.Context) error {
 	p.SelfDeviceID = kbStatus.Device.DeviceID
 	return nil
 }
+
+// nextAnnounceSeq returns sequence number for our next announcement. It's
+// based on current time, so it keeps growing across restarts without being
+// stored anywhere.
+func (p *Program) nextAnnounceSeq() uint64 {
+	seq := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if seq <= p.AnnounceSeq {
+		seq = p.AnnounceSeq + 1
+	}
+	p.AnnounceSeq = seq
+	return seq
+}
@@ -0,0 +1,163 @@
+package kbwg
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+// Preshared keys add a symmetric layer on top of Curve25519 handshakes of
+// WireGuard, as a hedge against it being broken (e.g. by quantum computers).
+//
+// Each pair of users shares a random seed, kept in their KBFS private folder
+// (`/keybase/private/alice,bob`, or `/keybase/private/alice` for devices of
+// the same user), so only they can read it. It's created by whichever device
+// needs it first. Preshared key of two devices is derived from the seed and
+// their WireGuard public keys, so both sides get the same key without
+// talking to each other, and the key changes when either side rotates its
+// key pair.
+//
+// Peers that don't announce `CapPSK` don't get a preshared key. Peers that
+// announce it, but whose seed we can't read, are not configured at all, so we
+// never talk to them without one.
+//
+// KBFS can't create a file only if it doesn't exist, so two devices can
+// create the seed at the same time and end up with different ones until KBFS
+// settles on one. Handshakes with a preshared key mismatch fail, so when
+// they stop succeeding, we read the seed again, see `RecheckPSKSeeds`.
+
+// How often seed of a peer that doesn't handshake is read again.
+const pskRecheckInterval = 5 * time.Minute
+
+type pskSeed struct {
+	seed     libwireguard.WireguardPresharedKey
+	loadedAt time.Time
+}
+
+// pskSeedPath returns KBFS path of PSK seed shared by users `a` and `b`.
+func pskSeedPath(team string, a string, b string) string {
+	users := []string{a, b}
+	if a == b {
+		users = users[:1]
+	}
+	sort.Strings(users)
+	return fmt.Sprintf("/keybase/private/%s/.kb-wireguard-%s.psk", strings.Join(users, ","), team)
+}
+
+// LoadPSKSeeds reads PSK seeds shared with users of active peers that use
+// preshared keys, and creates the ones that don't exist yet. Seeds are
+// cached, so each one is read once. Has to be called with Program locked.
+func LoadPSKSeeds(mctx MetaContext) {
+	if mctx.Prog.pskSeeds == nil {
+		mctx.Prog.pskSeeds = make(map[string]pskSeed)
+	}
+	failed := make(map[string]bool)
+	for _, peer := range mctx.Prog.KeybasePeers {
+		if !peer.Active || !peer.LastAnnouncement.HasCapability(CapPSK) {
+			continue
+		}
+		path := pskSeedPath(mctx.Prog.KeybaseTeam, mctx.Prog.Self.Username, peer.Device.Username)
+		if _, ok := mctx.Prog.pskSeeds[path]; ok || failed[path] {
+			continue
+		}
+		seed, err := loadPSKSeed(mctx, path)
+		if err != nil {
+			fmt.Printf("! Failed to load preshared key seed for %s, not configuring their devices: %s\n", peer.Device.Username, err)
+			failed[path] = true
+			continue
+		}
+		mctx.Prog.pskSeeds[path] = pskSeed{seed: seed, loadedAt: time.Now()}
+	}
+}
+
+// RecheckPSKSeeds reads seeds of peers that use preshared keys but don't
+// handshake again, at most every `pskRecheckInterval`. Returns true if any
+// seed changed and WireGuard config has to be synced.
+func RecheckPSKSeeds(mctx MetaContext, now time.Time) (changed bool) {
+	for _, peer := range mctx.Prog.KeybasePeers {
+		if !peer.Active || !peer.LastAnnouncement.HasCapability(CapPSK) {
+			continue
+		}
+		if now.Sub(peer.LastHandshake) < handshakeStaleTimeout {
+			continue
+		}
+		path := pskSeedPath(mctx.Prog.KeybaseTeam, mctx.Prog.Self.Username, peer.Device.Username)
+		cached, ok := mctx.Prog.pskSeeds[path]
+		if !ok || now.Sub(cached.loadedAt) < pskRecheckInterval {
+			continue
+		}
+		seed, err := loadPSKSeed(mctx, path)
+		mctx.Prog.pskSeeds[path] = pskSeed{seed: cached.seed, loadedAt: now}
+		if err != nil {
+			fmt.Printf("! Failed to read preshared key seed for %s again: %s\n", peer.Device.Username, err)
+			continue
+		}
+		if seed != cached.seed {
+			fmt.Printf(":: Preshared key seed %s changed\n", path)
+			mctx.Prog.pskSeeds[path] = pskSeed{seed: seed, loadedAt: now}
+			changed = true
+		}
+	}
+	return changed
+}
+
+func loadPSKSeed(mctx MetaContext, path string) (seed libwireguard.WireguardPresharedKey, err error) {
+	seedBytes, err := mctx.API().ReadKBFS(path)
+	if errors.Is(err, os.ErrNotExist) {
+		seed, err = libwireguard.GeneratePresharedKey()
+		if err != nil {
+			return seed, err
+		}
+		if err := mctx.API().WriteKBFS(path, []byte(seed.Base64()+"\n")); err != nil {
+			return seed, err
+		}
+		fmt.Printf(":: Created preshared key seed %s\n", path)
+		// Read it back, in case the other side created one at the same
+		// time. This doesn't catch all races, `RecheckPSKSeeds` does.
+		seedBytes, err = mctx.API().ReadKBFS(path)
+	}
+	if err != nil {
+		return seed, err
+	}
+	seed, err = libwireguard.ParsePresharedKey(strings.TrimSpace(string(seedBytes)))
+	if err != nil {
+		return seed, fmt.Errorf("invalid seed in %s: %w", path, err)
+	}
+	return seed, nil
+}
+
+// PresharedKeyFor returns preshared key we use with `peer`, or zero key if we
+// don't use one with it. Returns false if the peer uses preshared keys but we
+// don't have its seed, and it must not be configured.
+func PresharedKeyFor(mctx MetaContext, peer KeybasePeer) (ret libwireguard.WireguardPresharedKey, ok bool) {
+	if !peer.LastAnnouncement.HasCapability(CapPSK) {
+		return ret, true
+	}
+	cached, ok := mctx.Prog.pskSeeds[pskSeedPath(mctx.Prog.KeybaseTeam, mctx.Prog.Self.Username, peer.Device.Username)]
+	if !ok {
+		return ret, false
+	}
+	return derivePresharedKey(cached.seed, mctx.Prog.SelfPeer.PublicKey, peer.PublicKey), true
+}
+
+// derivePresharedKey is HMAC-SHA256 of both public keys in sorted order, so
+// it's the same for both sides.
+func derivePresharedKey(seed libwireguard.WireguardPresharedKey, a, b libwireguard.WireguardPubKey) (ret libwireguard.WireguardPresharedKey) {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	mac := hmac.New(sha256.New, seed[:])
+	mac.Write([]byte("kb-wireguard psk v1"))
+	mac.Write(a[:])
+	mac.Write(b[:])
+	copy(ret[:], mac.Sum(nil))
+	return ret
+}
@@ -0,0 +1,125 @@
+package kbwg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+// Scheduled key rotation, enabled with `network.key_rotation` in peers.json.
+//
+// WireGuard device has a single key pair, so we can't use two at once.
+// Instead, the next key is announced `KeyRotationOverlap` before we switch to
+// it, along with the time of the switch. Peers keep using our old key until
+// then, and switch to the new one at the same time as we do.
+
+// KeyRotationOverlap is how long before the switch the next key is
+// announced. Peers that are subscribed to announcements learn it right away,
+// others have until the switch to read it.
+const KeyRotationOverlap = 5 * time.Minute
+
+// MinKeyRotation is the shortest allowed rotation interval.
+const MinKeyRotation = 1 * time.Hour
+
+// How often to check if it's time to rotate.
+const keyRotationCheckInterval = 10 * time.Second
+
+// KeyRotationBgTask rotates our key pair when it's due.
+func KeyRotationBgTask(mctx MetaContext) error {
+	mctx.Prog.Lock()
+	if mctx.Prog.KeyRotatedAt.IsZero() {
+		mctx.Prog.KeyRotatedAt = time.Now()
+	}
+	mctx.Prog.Unlock()
+
+	ticker := time.NewTicker(keyRotationCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := RotateKeyIfDue(mctx, time.Now()); err != nil {
+				fmt.Printf("! Failed to rotate key: %s\n", err)
+			}
+		case <-mctx.Ctx.Done():
+			return mctx.Ctx.Err()
+		}
+	}
+}
+
+// RotateKeyIfDue announces the next key when rotation is due, and switches
+// to it when the overlap is over. Locks Program, but not while waiting for
+// run-dev, which sends the new key to `PubKeyBgTask` before it replies.
+func RotateKeyIfDue(mctx MetaContext, now time.Time) error {
+	prog := mctx.Prog
+	prog.Lock()
+	if prog.NextKey.IsZero() {
+		interval := prog.Network.KeyRotationInterval()
+		due := interval != 0 && !now.Before(prog.KeyRotatedAt.Add(interval-KeyRotationOverlap))
+		prog.Unlock()
+		if !due {
+			return nil
+		}
+		pubKey, err := prog.DevRunner.PrepareKey()
+		if err != nil {
+			return fmt.Errorf("failed to prepare next key: %w", err)
+		}
+		prog.Lock()
+		defer prog.Unlock()
+		prog.NextKey = pubKey
+		prog.NextKeyAt = now.Add(KeyRotationOverlap)
+		fmt.Printf(":: Announcing next key %s, switching at %s\n", pubKey, prog.NextKeyAt.Format(time.RFC3339))
+		return SendAnnouncement(mctx)
+	}
+	if now.Before(prog.NextKeyAt) || prog.switchingKey {
+		prog.Unlock()
+		return nil
+	}
+	prog.switchingKey = true
+	prog.Unlock()
+
+	// New public key comes back through `PubKeyCh`, see `selfKeyChanged`.
+	err := prog.DevRunner.RotateKey()
+	if err != nil {
+		prog.Lock()
+		prog.switchingKey = false
+		prog.Unlock()
+	}
+	return err
+}
+
+// selfKeyChanged starts using our new public key, announces it and updates
+// preshared keys, which are derived from it. Has to be called with Program
+// locked.
+func selfKeyChanged(mctx MetaContext, pubKey libwireguard.WireguardPubKey, now time.Time) error {
+	prog := mctx.Prog
+	prog.SelfPeer.PublicKey = pubKey
+	prog.KeyRotatedAt = now
+	prog.NextKey = libwireguard.WireguardPubKey{}
+	prog.NextKeyAt = time.Time{}
+	prog.switchingKey = false
+	if err := SendAnnouncement(mctx); err != nil {
+		return err
+	}
+	syncPeers(mctx, "Rotated key")
+	return nil
+}
+
+// SwitchPeerKeys switches peers whose announced next key is due. Returns true
+// if any peer switched.
+func SwitchPeerKeys(mctx MetaContext, now time.Time) (changed bool) {
+	for kbdev, peer := range mctx.Prog.KeybasePeers {
+		if !peer.Active {
+			continue
+		}
+		pubKey := peer.LastAnnouncement.PublicKeyAt(now)
+		if pubKey == peer.PublicKey {
+			continue
+		}
+		fmt.Printf("+ %v switched to next key %s\n", kbdev, pubKey)
+		peer.PublicKey = pubKey
+		mctx.Prog.KeybasePeers[kbdev] = peer
+		changed = true
+	}
+	return changed
+}
@@ -3,7 +3,9 @@ package kbwg
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -11,7 +13,9 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/zapu/kb-wireguard/devowner"
 	"github.com/zapu/kb-wireguard/libpipe"
 	"github.com/zapu/kb-wireguard/libwireguard"
 )
@@ -20,17 +24,45 @@ import (
 // down when it exits.
 
 type DevRunnerProcess struct {
-	DoneCh  chan struct{}
+	DoneCh chan struct{}
+	// Process is nil if run-dev was started by `DevLauncher`.
 	Process *os.Process
+	// ExitCh is closed when run-dev exits.
+	ExitCh chan struct{}
 
 	PubKeyCh chan libwireguard.WireguardPubKey
+	// StatsCh receives runtime state of WireGuard peers, periodically
+	// reported by run-dev.
+	StatsCh chan map[libwireguard.WireguardPubKey]PeerStats
 
 	PipeWriter *bufio.Writer
 	pipeLock   sync.Mutex
+	pipe       *os.File
+
+	// Requests waiting for reply, by seq.
+	pending     map[uint64]chan libpipe.PipeMsg
+	lastSeq     uint64
+	pendingLock sync.Mutex
 
 	cmd *exec.Cmd
 }
 
+// RunDevError is error reply from run-dev to a request.
+type RunDevError struct {
+	Request string
+	Message string
+}
+
+func (e *RunDevError) Error() string {
+	return fmt.Sprintf("run-dev failed to handle %q: %s", e.Request, e.Message)
+}
+
+// ErrRunDevExited is returned by requests to run-dev that exited.
+var ErrRunDevExited = errors.New("run-dev exited")
+
+// How long to wait for reply from run-dev.
+const runDevCallTimeout = 30 * time.Second
+
 func makePipe() (string, error) {
 	f, err := ioutil.TempFile("", "*.pipe.tmp")
 	if err != nil {
@@ -52,47 +84,112 @@ func makePipe() (string, error) {
 	return name, err
 }
 
-func RunDevRunner(ipAddr string, bindPort uint16) (ret *DevRunnerProcess, err error) {
+type DevRunnerOptions struct {
+	// Name of WireGuard device, run-dev picks the default if empty.
+	DeviceName string
+	// Addresses to assign to the device, in CIDR notation.
+	Addresses []string
+	// Port WireGuard will listen on.
+	BindPort uint16
+	// Private key is persisted in run-dev's key store under team and Keybase
+	// device ID if they are set (see `devowner.KeyFilePath`), otherwise new
+	// key is generated every time.
+	KeyTeam     string
+	KeyDeviceID string
+	// RotateKey forces generating new key even if there is a persisted one.
+	RotateKey bool
+	// Launcher starts run-dev if set, instead of running it with `sudo`.
+	Launcher *DevLauncher
+}
+
+func RunDevRunner(opts DevRunnerOptions) (ret *DevRunnerProcess, err error) {
 	ret = &DevRunnerProcess{}
 	ret.DoneCh = make(chan struct{})
-	ret.PubKeyCh = make(chan libwireguard.WireguardPubKey)
+	ret.ExitCh = make(chan struct{})
+	// Buffered, so the initial key does not block reading replies to
+	// requests that we send before anyone reads it.
+	ret.PubKeyCh = make(chan libwireguard.WireguardPubKey, 1)
+	ret.StatsCh = make(chan map[libwireguard.WireguardPubKey]PeerStats, 1)
 
 	wrPipeFilename, err := makePipe()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to make pipe: %w", err)
 	}
 
-	args := []string{"sudo", "./run-dev", "-pipe", wrPipeFilename}
-	if ipAddr != "" {
-		args = append(args, "-ip", ipAddr)
-	}
-	if bindPort != 0 {
-		args = append(args, "-port", strconv.Itoa(int(bindPort)))
-	}
+	var stdout, stderr io.Reader
+	if opts.Launcher != nil {
+		// Launcher runs as root, so it gets a request that it can check
+		// instead of command line arguments.
+		launch := libpipe.LaunchMsg{
+			Pipe:        wrPipeFilename,
+			Device:      opts.DeviceName,
+			Addresses:   opts.Addresses,
+			Port:        int(opts.BindPort),
+			KeyTeam:     opts.KeyTeam,
+			KeyDeviceID: opts.KeyDeviceID,
+			RotateKey:   opts.RotateKey,
+		}
+		fmt.Printf("Launching run-dev for %s\n", opts.DeviceName)
+		stdout, stderr, err = opts.Launcher.launch(launch)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		args := []string{"sudo", "./run-dev", "-pipe", wrPipeFilename}
+		if opts.DeviceName != "" {
+			args = append(args, "-dev", opts.DeviceName)
+		}
+		if len(opts.Addresses) > 0 {
+			args = append(args, "-ip", strings.Join(opts.Addresses, ","))
+		}
+		if opts.BindPort != 0 {
+			args = append(args, "-port", strconv.Itoa(int(opts.BindPort)))
+		}
+		if opts.KeyTeam != "" {
+			keyFile, err := devowner.KeyFilePath(opts.KeyTeam, opts.KeyDeviceID)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "-keyfile", keyFile)
+		}
+		if opts.RotateKey {
+			args = append(args, "-rotate-key")
+		}
+		fmt.Printf("Running: %v\n", args)
+		cmd := exec.Command(args[0], args[1:]...)
+		ret.cmd = cmd
 
-	fmt.Printf("Running: %v\n", args)
-	cmd := exec.Command(args[0], args[1:]...)
-	ret.cmd = cmd
+		stdout, err = cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		stderr, err = cmd.StderrPipe()
+		if err != nil {
+			return nil, err
+		}
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
-	stdoutReader := bufio.NewReader(stdout)
+		cmd.Stdin = os.Stdin
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, err
+		go func() {
+			select {
+			case <-ret.DoneCh:
+				fmt.Printf("[xx] Sending SIGTERM to device owner\n")
+				cmd.Process.Signal(syscall.SIGTERM)
+			}
+		}()
+
+		cmd.Start()
+		ret.Process = cmd.Process
 	}
+	stdoutReader := bufio.NewReader(stdout)
 	stderrReader := bufio.NewReader(stderr)
 
-	cmd.Stdin = os.Stdin
-
 	go func() {
+		defer close(ret.ExitCh)
 		for {
 			line, err := stdoutReader.ReadBytes('\n')
-			if err != nil || len(line) == 0 {
-				continue
+			if err != nil {
+				return
 			}
 			var msg libpipe.PipeMsg
 			err = json.Unmarshal(line, &msg)
@@ -102,7 +199,7 @@ func RunDevRunner(ipAddr string, bindPort uint16) (ret *DevRunnerProcess, err er
 			}
 			err = ret.handleDevRunnerControlMsg(msg)
 			if err != nil {
-
+				fmt.Fprintf(os.Stderr, "Failed to handle %q from RunDev: %s\n", msg.ID, err)
 			}
 		}
 	}()
@@ -110,38 +207,65 @@ func RunDevRunner(ipAddr string, bindPort uint16) (ret *DevRunnerProcess, err er
 	go func() {
 		for {
 			line, err := stderrReader.ReadBytes('\n')
-			if err != nil || len(line) == 0 {
-				continue
+			if len(line) > 0 {
+				fmt.Printf("[RunDev]: %s\n", strings.TrimRight(string(line), "\n"))
+			}
+			if err != nil {
+				return
 			}
-			fmt.Printf("[RunDev]: %s\n", strings.TrimRight(string(line), "\n"))
 
 			// TODO: Push these through channel as well
 		}
 	}()
 
-	go func() {
-		select {
-		case <-ret.DoneCh:
-			fmt.Printf("[xx] Sending SIGTERM to device owner\n")
-			cmd.Process.Signal(syscall.SIGTERM)
-		}
-	}()
-
-	cmd.Start()
-	ret.Process = cmd.Process
-
 	{
-		fd, err := os.OpenFile(wrPipeFilename, os.O_WRONLY, os.ModeNamedPipe)
+		fd, err := openPipeWriter(wrPipeFilename, ret.ExitCh)
 		if err != nil {
 			return ret, fmt.Errorf("failed to open pipe: %w", err)
 		}
 		fmt.Printf("[%%] Opened write side of pipe: %s\n", wrPipeFilename)
 		ret.PipeWriter = bufio.NewWriter(fd)
+		ret.pipe = fd
+	}
+
+	if err := ret.Hello(); err != nil {
+		// run-dev exits when we close the pipe.
+		ret.pipe.Close()
+		close(ret.DoneCh)
+		go ret.Wait()
+		return nil, err
 	}
 
 	return ret, nil
 }
 
+// openPipeWriter opens write side of named pipe, which blocks until reader
+// opens it. Gives up if `exitCh` is closed first.
+func openPipeWriter(filename string, exitCh chan struct{}) (*os.File, error) {
+	type result struct {
+		fd  *os.File
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		fd, err := os.OpenFile(filename, os.O_WRONLY, os.ModeNamedPipe)
+		resCh <- result{fd, err}
+	}()
+	select {
+	case res := <-resCh:
+		return res.fd, res.err
+	case <-exitCh:
+		// Unblock the writer by opening the read side ourselves.
+		if rd, err := os.OpenFile(filename, os.O_RDONLY|syscall.O_NONBLOCK, os.ModeNamedPipe); err == nil {
+			rd.Close()
+		}
+		if res := <-resCh; res.fd != nil {
+			res.fd.Close()
+		}
+		return nil, ErrRunDevExited
+	}
+}
+
 func (runner *DevRunnerProcess) handleDevRunnerControlMsg(msg libpipe.PipeMsg) error {
 	if msg.ID == "pubkey" {
 		var pubkey libwireguard.WireguardPubKey
@@ -151,13 +275,264 @@ func (runner *DevRunnerProcess) handleDevRunnerControlMsg(msg libpipe.PipeMsg) e
 		}
 		fmt.Printf("Received pub key from device runner: %s\n", pubkey)
 		runner.PubKeyCh <- pubkey
+	} else if msg.ID == libpipe.ReplyID {
+		runner.pendingLock.Lock()
+		replyCh, ok := runner.pending[msg.Seq]
+		delete(runner.pending, msg.Seq)
+		runner.pendingLock.Unlock()
+		if !ok {
+			return fmt.Errorf("unexpected reply, seq: %d", msg.Seq)
+		}
+		replyCh <- msg
+	} else if msg.ID == "stats" {
+		var statsMsg libpipe.StatsMsg
+		err := json.Unmarshal([]byte(msg.Payload), &statsMsg)
+		if err != nil {
+			return err
+		}
+		// Do not block reading from run-dev if nobody is consuming these
+		// (yet). Reports are periodic, so dropping one is fine.
+		select {
+		case runner.StatsCh <- MakePeerStats(statsMsg):
+		default:
+		}
 	}
 	return nil
 }
 
-func (runner *DevRunnerProcess) WriteLine(str string) {
+// PeerStats is runtime state of a WireGuard peer, as reported by run-dev.
+type PeerStats struct {
+	// Endpoint the device currently uses, can differ from the configured
+	// one if the peer roamed.
+	Endpoint libwireguard.HostPort
+	// Zero if there was no handshake.
+	LastHandshake time.Time
+	RxBytes       uint64
+	TxBytes       uint64
+}
+
+// MakePeerStats converts "stats" message from run-dev to PeerStats by
+// public key.
+func MakePeerStats(msg libpipe.StatsMsg) map[libwireguard.WireguardPubKey]PeerStats {
+	ret := make(map[libwireguard.WireguardPubKey]PeerStats, len(msg.Peers))
+	for _, peer := range msg.Peers {
+		pubKey, err := libwireguard.ParsePubKey(peer.PublicKey)
+		if err != nil {
+			continue
+		}
+		stats := PeerStats{
+			Endpoint: libwireguard.ParseHostPort(peer.Endpoint),
+			RxBytes:  peer.RxBytes,
+			TxBytes:  peer.TxBytes,
+		}
+		if peer.LastHandshake != 0 {
+			stats.LastHandshake = time.Unix(peer.LastHandshake, 0)
+		}
+		ret[pubKey] = stats
+	}
+	return ret
+}
+
+func (runner *DevRunnerProcess) WriteLine(str string) error {
 	runner.pipeLock.Lock()
 	defer runner.pipeLock.Unlock()
 	runner.PipeWriter.WriteString(str + "\n")
-	runner.PipeWriter.Flush()
+	return runner.PipeWriter.Flush()
+}
+
+// Call sends request `id` to run-dev and waits for the reply, which is
+// unmarshalled into `reply` if it's not nil. Error reply is returned as
+// `*RunDevError`.
+func (runner *DevRunnerProcess) Call(id string, payload interface{}, reply interface{}) error {
+	replyCh := make(chan libpipe.PipeMsg, 1)
+	runner.pendingLock.Lock()
+	if runner.pending == nil {
+		runner.pending = make(map[uint64]chan libpipe.PipeMsg)
+	}
+	runner.lastSeq++
+	seq := runner.lastSeq
+	runner.pending[seq] = replyCh
+	runner.pendingLock.Unlock()
+	defer func() {
+		runner.pendingLock.Lock()
+		delete(runner.pending, seq)
+		runner.pendingLock.Unlock()
+	}()
+
+	msg, err := libpipe.SerializeRequest(id, seq, payload)
+	if err != nil {
+		return err
+	}
+	if err := runner.WriteLine(msg); err != nil {
+		return fmt.Errorf("failed to send %q to run-dev: %w", id, err)
+	}
+
+	timer := time.NewTimer(runDevCallTimeout)
+	defer timer.Stop()
+	var res libpipe.PipeMsg
+	select {
+	case res = <-replyCh:
+	case <-runner.ExitCh:
+		// Reply could have been read right before run-dev exited.
+		select {
+		case res = <-replyCh:
+		default:
+			return ErrRunDevExited
+		}
+	case <-timer.C:
+		return fmt.Errorf("timed out waiting for run-dev to reply to %q", id)
+	}
+	if res.Error != "" {
+		return &RunDevError{Request: id, Message: res.Error}
+	}
+	if reply != nil {
+		if err := json.Unmarshal([]byte(res.Payload), reply); err != nil {
+			return fmt.Errorf("failed to unmarshal reply to %q: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// Hello checks that run-dev speaks the same protocol version as we do.
+func (runner *DevRunnerProcess) Hello() error {
+	var hello libpipe.HelloMsg
+	err := runner.Call("hello", libpipe.HelloMsg{Version: libpipe.ProtocolVersion}, &hello)
+	if err != nil {
+		return fmt.Errorf("run-dev protocol handshake failed: %w", err)
+	}
+	if hello.Version != libpipe.ProtocolVersion {
+		return fmt.Errorf("run-dev speaks protocol version %d, expected %d", hello.Version, libpipe.ProtocolVersion)
+	}
+	return nil
+}
+
+// SetPeers replaces peers of the device.
+func (runner *DevRunnerProcess) SetPeers(peers []libwireguard.WireguardPeer) error {
+	return runner.Call("peers", peers, nil)
+}
+
+// SetAddresses replaces addresses of the device.
+func (runner *DevRunnerProcess) SetAddresses(addresses []string) error {
+	return runner.Call("address", addresses, nil)
+}
+
+// SetNetwork applies network settings from peers.json to the device.
+func (runner *DevRunnerProcess) SetNetwork(network libpipe.NetworkMsg) error {
+	return runner.Call("network", network, nil)
+}
+
+// PrepareKey asks run-dev to generate key pair for scheduled rotation,
+// without using it yet. Returns public key of the pair. `RotateKey` switches
+// to the prepared pair.
+func (runner *DevRunnerProcess) PrepareKey() (pubKey libwireguard.WireguardPubKey, err error) {
+	err = runner.Call("prepare-key", nil, &pubKey)
+	return pubKey, err
+}
+
+// RotateKey asks run-dev to switch to the key pair from `PrepareKey`, or to
+// generate a new one if none was prepared. New public key will arrive on
+// `PubKeyCh`.
+func (runner *DevRunnerProcess) RotateKey() error {
+	return runner.Call("rotate-key", nil, nil)
+}
+
+// Stop asks run-dev to remove the device and exit. Use `Wait` to wait until
+// it does.
+func (runner *DevRunnerProcess) Stop() error {
+	return runner.Call("stop", nil, nil)
+}
+
+// Wait waits until run-dev exits.
+func (runner *DevRunnerProcess) Wait() {
+	<-runner.ExitCh
+	if runner.cmd != nil {
+		runner.cmd.Wait()
+	}
+}
+
+// DevLauncher is run-dev started with `sudo` once, that starts other run-dev
+// processes for us, so we don't need `sudo` every time.
+type DevLauncher struct {
+	PipeWriter *bufio.Writer
+	pipeLock   sync.Mutex
+	pipe       *os.File
+
+	cmd *exec.Cmd
+}
+
+// StartDevLauncher runs `sudo ./run-dev -launcher`. Has stdin of our process,
+// so interactive `sudo` works.
+func StartDevLauncher() (*DevLauncher, error) {
+	pipeFilename, err := makePipe()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to make pipe: %w", err)
+	}
+	args := []string{"sudo", "./run-dev", "-launcher", "-pipe", pipeFilename}
+	fmt.Printf("Running: %v\n", args)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	exitCh := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exitCh)
+	}()
+	fd, err := openPipeWriter(pipeFilename, exitCh)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open launcher pipe: %w", err)
+	}
+	return &DevLauncher{PipeWriter: bufio.NewWriter(fd), pipe: fd, cmd: cmd}, nil
+}
+
+// launch starts run-dev as described by `msg`, and returns its stdout and
+// stderr.
+func (l *DevLauncher) launch(msg libpipe.LaunchMsg) (stdout io.Reader, stderr io.Reader, err error) {
+	stdoutFilename, err := makePipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to make pipe: %w", err)
+	}
+	stderrFilename, err := makePipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to make pipe: %w", err)
+	}
+	msg.Stdout = stdoutFilename
+	msg.Stderr = stderrFilename
+	line, err := libpipe.SerializeMsgInterface("launch", msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	l.pipeLock.Lock()
+	l.PipeWriter.WriteString(line + "\n")
+	err = l.PipeWriter.Flush()
+	l.pipeLock.Unlock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write to launcher: %w", err)
+	}
+	// Launcher opens them in the same order.
+	stdoutFd, err := os.OpenFile(stdoutFilename, os.O_RDONLY, os.ModeNamedPipe)
+	if err != nil {
+		return nil, nil, err
+	}
+	stderrFd, err := os.OpenFile(stderrFilename, os.O_RDONLY, os.ModeNamedPipe)
+	if err != nil {
+		stdoutFd.Close()
+		return nil, nil, err
+	}
+	os.Remove(stdoutFilename)
+	os.Remove(stderrFilename)
+	return stdoutFd, stderrFd, nil
+}
+
+// Close stops the launcher. run-dev processes it started keep running until
+// they are stopped.
+func (l *DevLauncher) Close() error {
+	l.pipeLock.Lock()
+	defer l.pipeLock.Unlock()
+	err := l.pipe.Close()
+	l.cmd.Wait()
+	return err
 }
@@ -0,0 +1,46 @@
+package kbwg
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zapu/kb-wireguard/libpipe"
+	"github.com/zapu/kb-wireguard/libwireguard"
+)
+
+func TestRunDevCall(t *testing.T) {
+	f := newFakeRunDev()
+	runner := f.runner
+	require.NoError(t, runner.Hello())
+	require.NoError(t, runner.SetAddresses([]string{"100.0.0.1/24"}))
+
+	// Failure on run-dev side is returned to the caller.
+	f.failID = "peers"
+	err := runner.SetPeers([]libwireguard.WireguardPeer{})
+	var runDevErr *RunDevError
+	require.True(t, errors.As(err, &runDevErr))
+	require.Equal(t, "peers", runDevErr.Request)
+	require.Equal(t, "peers failed", runDevErr.Message)
+	require.Empty(t, runner.pending)
+
+	// Requests have increasing seq numbers.
+	lines := f.String()
+	require.Contains(t, lines, `"i":"hello","p":"{\"version\":1}","s":1}`)
+	require.Contains(t, lines, `"i":"peers","p":"[]","s":3}`)
+
+	// Replies that nobody waits for are rejected.
+	require.Error(t, runner.handleDevRunnerControlMsg(libpipe.PipeMsg{ID: libpipe.ReplyID, Seq: 100}))
+}
+
+func TestRunDevCallExited(t *testing.T) {
+	runner := &DevRunnerProcess{
+		PipeWriter: bufio.NewWriter(ioutil.Discard),
+		ExitCh:     make(chan struct{}),
+	}
+	close(runner.ExitCh)
+	require.Equal(t, ErrRunDevExited, runner.Stop())
+	require.Empty(t, runner.pending)
+}
@@ -0,0 +1,131 @@
+package kbwg
+
+import (
+	"sort"
+	"time"
+)
+
+// TeamStatus is a summary of team network we are connected to.
+type TeamStatus struct {
+	Team string `json:"team"`
+	// WireGuard device of the team network.
+	DeviceName string   `json:"device_name"`
+	ListenPort uint16   `json:"listen_port"`
+	Addresses  []string `json:"addresses"`
+	PublicKey  string   `json:"public_key,omitempty"`
+	// Number of peers we know about, how many of them are active, and how
+	// many of these we recently had a handshake with.
+	Peers          int `json:"peers"`
+	ActivePeers    int `json:"active_peers"`
+	ConnectedPeers int `json:"connected_peers"`
+}
+
+// Connection states of peers in PeerStatus.
+const (
+	// Peer did not announce itself, it's not configured on the device.
+	PeerStateInactive = "inactive"
+	// No handshake with the peer yet.
+	PeerStateNever = "never"
+	// Latest handshake is older than `handshakeStaleTimeout`.
+	PeerStateStale     = "stale"
+	PeerStateConnected = "connected"
+)
+
+// PeerState returns connection state of `peer` at `now`, one of PeerState*
+// constants.
+func PeerState(peer KeybasePeer, now time.Time) string {
+	switch {
+	case !peer.Active:
+		return PeerStateInactive
+	case peer.LastHandshake.IsZero():
+		return PeerStateNever
+	case now.Sub(peer.LastHandshake) >= handshakeStaleTimeout:
+		return PeerStateStale
+	default:
+		return PeerStateConnected
+	}
+}
+
+// PeerStatus is what we know about a single peer.
+type PeerStatus struct {
+	Username  string   `json:"username"`
+	Device    string   `json:"device"`
+	Addresses []string `json:"addresses"`
+	Active    bool     `json:"active"`
+	Dynamic   bool     `json:"dynamic"`
+	State     string   `json:"state"`
+	PublicKey string   `json:"public_key,omitempty"`
+	// Endpoint the device uses for the peer, or the one we picked if
+	// run-dev did not report it yet.
+	Endpoint string `json:"endpoint,omitempty"`
+	RxBytes  uint64 `json:"rx_bytes"`
+	TxBytes  uint64 `json:"tx_bytes"`
+	// Zero if there was no handshake, or no announcement.
+	LastHandshake    time.Time `json:"last_handshake"`
+	LastAnnouncement time.Time `json:"last_announcement"`
+}
+
+// GetTeamStatus returns status of team network of `mctx.Prog` at `now`. Has
+// to be called with Program locked.
+func GetTeamStatus(mctx MetaContext, deviceName string, now time.Time) TeamStatus {
+	prog := mctx.Prog
+	ret := TeamStatus{
+		Team:       prog.KeybaseTeam,
+		DeviceName: deviceName,
+		ListenPort: prog.ListenPort,
+		Addresses:  prog.SelfAddresses(),
+		Peers:      len(prog.KeybasePeers),
+	}
+	if !prog.SelfPeer.PublicKey.IsZero() {
+		ret.PublicKey = prog.SelfPeer.PublicKey.String()
+	}
+	for _, peer := range prog.KeybasePeers {
+		if peer.Active {
+			ret.ActivePeers++
+		}
+		if PeerState(peer, now) == PeerStateConnected {
+			ret.ConnectedPeers++
+		}
+	}
+	return ret
+}
+
+// GetPeerStatuses returns status of all peers at `now`, sorted by username
+// and device. Has to be called with Program locked.
+func GetPeerStatuses(mctx MetaContext, now time.Time) (ret []PeerStatus) {
+	for _, peer := range mctx.Prog.KeybasePeers {
+		status := PeerStatus{
+			Username:         peer.Device.Username,
+			Device:           peer.Device.Device,
+			Active:           peer.Active,
+			Dynamic:          peer.Dynamic,
+			State:            PeerState(peer, now),
+			RxBytes:          peer.RxBytes,
+			TxBytes:          peer.TxBytes,
+			LastHandshake:    peer.LastHandshake,
+			LastAnnouncement: peer.LastAnnouncement.SentAt,
+		}
+		if !peer.PublicKey.IsZero() {
+			status.PublicKey = peer.PublicKey.String()
+		}
+		if peer.IP != nil {
+			status.Addresses = append(status.Addresses, peer.IP.String())
+		}
+		if peer.IP6 != nil {
+			status.Addresses = append(status.Addresses, peer.IP6.String())
+		}
+		if peer.DeviceEndpoint.Exists() {
+			status.Endpoint = peer.DeviceEndpoint.String()
+		} else if peer.Endpoint.Exists() {
+			status.Endpoint = peer.Endpoint.String()
+		}
+		ret = append(ret, status)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Username != ret[j].Username {
+			return ret[i].Username < ret[j].Username
+		}
+		return ret[i].Device < ret[j].Device
+	})
+	return ret
+}
@@ -0,0 +1,63 @@
+package kbwg
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// teamNet is a part of address space used by a team network.
+type teamNet struct {
+	team  string
+	what  string
+	ipNet *net.IPNet
+}
+
+func teamNets(prog *Program) (ret []teamNet) {
+	for _, subnet := range []*net.IPNet{prog.Subnet, prog.Subnet6} {
+		if subnet != nil {
+			ret = append(ret, teamNet{team: prog.KeybaseTeam, what: "subnet " + subnet.String(), ipNet: subnet})
+		}
+	}
+	peers := []KeybasePeer{prog.SelfPeer}
+	for _, peer := range prog.KeybasePeers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		a, b := peers[i].Device, peers[j].Device
+		return a.Username < b.Username || (a.Username == b.Username && a.Device < b.Device)
+	})
+	for _, peer := range peers {
+		for _, route := range peer.Routes {
+			_, ipNet, err := net.ParseCIDR(route)
+			if err != nil {
+				continue
+			}
+			what := fmt.Sprintf("route %s of %v", route, peer.Device)
+			ret = append(ret, teamNet{team: prog.KeybaseTeam, what: what, ipNet: ipNet})
+		}
+	}
+	return ret
+}
+
+// TeamNetworkCollisions finds overlapping address space between team
+// networks that run at the same time: subnets and routes from peers.json.
+// Every team has its own WireGuard device, so overlapping addresses would
+// make routing between them ambiguous. Returns description of every
+// collision found.
+func TeamNetworkCollisions(progs []*Program) (ret []string) {
+	var seen []teamNet
+	for _, prog := range progs {
+		nets := teamNets(prog)
+		for _, n := range nets {
+			for _, other := range seen {
+				if netsOverlap(n.ipNet, other.ipNet) {
+					ret = append(ret, fmt.Sprintf("%s of team %s overlaps with %s of team %s",
+						n.what, n.team, other.what, other.team))
+				}
+			}
+		}
+		seen = append(seen, nets...)
+	}
+	return ret
+}
@@ -0,0 +1,40 @@
+package kbwg
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTeamNetworkCollisions(t *testing.T) {
+	makeProg := func(team string, subnet string, peers []PeerJSON) *Program {
+		prog := &Program{
+			KeybaseTeam: team,
+			Self:        KBDev{Username: "alice", Device: "laptop"},
+		}
+		require.NoError(t, prog.SetSubnets(subnet, ""))
+		_, err := prog.SetPeerList(peers)
+		require.NoError(t, err)
+		return prog
+	}
+
+	team1 := makeProg("team1", "100.0.0.0/24", []PeerJSON{
+		{Username: "bob", Device: "router", IP: "100.0.0.2", Routes: []string{"192.168.1.0/24"}},
+	})
+	team2 := makeProg("team2", "100.0.1.0/24", []PeerJSON{
+		{Username: "carol", Device: "router", IP: "100.0.1.2", Routes: []string{"192.168.2.0/24"}},
+	})
+	require.Empty(t, TeamNetworkCollisions([]*Program{team1, team2}))
+
+	team3 := makeProg("team3", "100.0.0.0/16", []PeerJSON{
+		{Username: "dave", Device: "router", IP: "100.0.5.2", Routes: []string{"192.168.0.0/16"}},
+	})
+	_, team3.Subnet6, _ = net.ParseCIDR("fd00::/64")
+	require.Equal(t, []string{
+		"subnet 100.0.0.0/16 of team team3 overlaps with subnet 100.0.0.0/24 of team team1",
+		"subnet 100.0.0.0/16 of team team3 overlaps with subnet 100.0.1.0/24 of team team2",
+		"route 192.168.0.0/16 of {dave router} of team team3 overlaps with route 192.168.1.0/24 of {bob router} of team team1",
+		"route 192.168.0.0/16 of {dave router} of team team3 overlaps with route 192.168.2.0/24 of {carol router} of team team2",
+	}, TeamNetworkCollisions([]*Program{team1, team2, team3}))
+}
@@ -0,0 +1,246 @@
+package kbwg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PeerListProblem is a single problem found in peers.json.
+type PeerListProblem struct {
+	// Index of the peer in the peers array, -1 if the problem is not about
+	// a single peer.
+	Index   int
+	Message string
+}
+
+func (p PeerListProblem) String() string {
+	if p.Index < 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("peers[%d]: %s", p.Index, p.Message)
+}
+
+// PeerListError is returned when peers.json has problems. It lists all of
+// them, not just the first one.
+type PeerListError struct {
+	Problems []PeerListProblem
+}
+
+// NewPeerListError returns error with `problems` ordered by peer index,
+// network problems first.
+func NewPeerListError(problems []PeerListProblem) *PeerListError {
+	return NewPeerListError(problems)
+}
+
+func (e *PeerListError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		lines[i] = "  " + problem.String()
+	}
+	return fmt.Sprintf("peers.json has %d problem(s):\n%s", len(e.Problems), strings.Join(lines, "\n"))
+}
+
+// Smallest MTU that makes sense for WireGuard device, IPv6 needs 1280.
+const minMTU = 576
+
+type problemList []PeerListProblem
+
+func (l *problemList) add(index int, format string, args ...interface{}) {
+	*l = append(*l, PeerListProblem{Index: index, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidatePeerList finds problems in peers.json that can be found without
+// asking Keybase. `subnet6` can be nil, then IPv6 addresses are not checked
+// against it.
+func ValidatePeerList(list PeerList, subnet *net.IPNet, subnet6 *net.IPNet) []PeerListProblem {
+	var problems problemList
+
+	network := list.Network
+	if network.MTU != 0 && (network.MTU < minMTU || network.MTU > 65535) {
+		problems.add(-1, "network.mtu %d is out of range (%d-65535)", network.MTU, minMTU)
+	}
+	for _, server := range network.DNS {
+		if net.ParseIP(server) == nil {
+			problems.add(-1, "network.dns: invalid address %q", server)
+		}
+	}
+	if network.KeyRotation != "" {
+		if interval, err := time.ParseDuration(network.KeyRotation); err != nil {
+			problems.add(-1, "network.key_rotation: invalid duration %q", network.KeyRotation)
+		} else if interval < MinKeyRotation {
+			problems.add(-1, "network.key_rotation %s is shorter than %s", interval, MinKeyRotation)
+		}
+	}
+	if network.Subnet != "" {
+		if _, _, err := net.ParseCIDR(network.Subnet); err != nil {
+			problems.add(-1, "network.subnet: invalid CIDR %q", network.Subnet)
+		}
+	}
+	if network.Subnet6 != "" {
+		if _, _, err := net.ParseCIDR(network.Subnet6); err != nil {
+			problems.add(-1, "network.subnet6: invalid CIDR %q", network.Subnet6)
+		}
+	}
+
+	type peerNet struct {
+		index int
+		ipNet *net.IPNet
+	}
+	var peerNets []peerNet
+	devices := make(map[KBDev]int)
+	for i, peerJSON := range list.Peers {
+		if peerJSON.Username == "" {
+			problems.add(i, "username is missing")
+		}
+		if peerJSON.Device == "" {
+			problems.add(i, "device is missing")
+		}
+		kbdev := peerJSON.GetKBDev()
+		if j, ok := devices[kbdev]; ok {
+			problems.add(i, "device %q of %q is already in peers[%d]", kbdev.Device, kbdev.Username, j)
+		} else {
+			devices[kbdev] = i
+		}
+
+		peer, err := peerJSON.MakeKeybasePeer()
+		if err != nil {
+			problems.add(i, "%s", err)
+			continue
+		}
+		checkPeerAddress(&problems, i, "ip", peer.IP, subnet)
+		if peer.IP6 != nil {
+			checkPeerAddress(&problems, i, "ip6", peer.IP6, subnet6)
+		}
+		// Routes that overlap the team subnet are reported once, not
+		// against every peer address they cover.
+		inSubnet := make(map[string]bool)
+		for _, route := range peer.Routes {
+			_, ipNet, _ := net.ParseCIDR(route)
+			if subnet != nil && netsOverlap(ipNet, subnet) {
+				problems.add(i, "route %s overlaps with team subnet %s", route, subnet)
+				inSubnet[route] = true
+			}
+		}
+
+		for _, allowedIP := range peer.AllowedIPs() {
+			if inSubnet[allowedIP] {
+				continue
+			}
+			_, ipNet, _ := net.ParseCIDR(allowedIP)
+			for _, other := range peerNets {
+				if !netsOverlap(ipNet, other.ipNet) {
+					continue
+				}
+				if ipNet.String() == other.ipNet.String() && isHostNet(ipNet) {
+					problems.add(i, "address %s is already used by peers[%d]", ipNet.IP, other.index)
+				} else {
+					problems.add(i, "%s overlaps with %s of peers[%d]", ipNet, other.ipNet, other.index)
+				}
+			}
+			peerNets = append(peerNets, peerNet{index: i, ipNet: ipNet})
+		}
+	}
+	return problems
+}
+
+func checkPeerAddress(problems *problemList, index int, field string, ip net.IP, subnet *net.IPNet) {
+	if subnet == nil {
+		return
+	}
+	if !subnet.Contains(ip) {
+		problems.add(index, "%s %s is outside of subnet %s", field, ip, subnet)
+		return
+	}
+	if ip.Equal(subnet.IP) {
+		problems.add(index, "%s %s is the network address of subnet %s", field, ip, subnet)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		broadcast := make(net.IP, len(ip4))
+		for i := range ip4 {
+			broadcast[i] = subnet.IP.To4()[i] | ^subnet.Mask[len(subnet.Mask)-4+i]
+		}
+		if ip4.Equal(broadcast) {
+			problems.add(index, "%s %s is the broadcast address of subnet %s", field, ip, subnet)
+		}
+	}
+}
+
+func netsOverlap(a, b *net.IPNet) bool {
+	if len(a.IP) != len(b.IP) {
+		return false
+	}
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func isHostNet(ipNet *net.IPNet) bool {
+	ones, bits := ipNet.Mask.Size()
+	return ones == bits
+}
+
+// ValidatePeerListMembers checks that users in peers.json are members of the
+// team, and that their devices exist on their sigchains.
+func ValidatePeerListMembers(mctx MetaContext, list PeerList) ([]PeerListProblem, error) {
+	var problems problemList
+	members, err := mctx.API().TeamMembers(mctx.Prog.KeybaseTeam)
+	if err != nil {
+		return nil, err
+	}
+	isMember := make(map[string]bool, len(members))
+	for _, member := range members {
+		isMember[member] = true
+	}
+
+	userDevices := make(map[string][]string)
+	for i, peer := range list.Peers {
+		if peer.Username == "" {
+			continue
+		}
+		devices, ok := userDevices[peer.Username]
+		if !ok {
+			devices, err = mctx.API().UserDevices(peer.Username)
+			if errors.Is(err, ErrUserNotFound) {
+				problems.add(i, "user %q does not exist", peer.Username)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			userDevices[peer.Username] = devices
+		}
+		if !isMember[peer.Username] {
+			problems.add(i, "user %q is not a member of team %q", peer.Username, mctx.Prog.KeybaseTeam)
+		}
+		found := false
+		for _, device := range devices {
+			if device == peer.Device {
+				found = true
+				break
+			}
+		}
+		if !found && peer.Device != "" {
+			problems.add(i, "user %q has no device %q, active devices are: %q", peer.Username, peer.Device, devices)
+		}
+	}
+	return problems, nil
+}
+
+// CheckPeerList runs all peers.json checks. Returns *PeerListError if there
+// are problems.
+func CheckPeerList(mctx MetaContext, list PeerList) error {
+	problems := ValidatePeerList(list, mctx.Prog.Subnet, mctx.Prog.Subnet6)
+	memberProblems, err := ValidatePeerListMembers(mctx, list)
+	if err != nil {
+		return fmt.Errorf("failed to check team members and devices: %w", err)
+	}
+	problems = append(problems, memberProblems...)
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Index < problems[j].Index
+	})
+	return &PeerListError{Problems: problems}
+}
@@ -0,0 +1,96 @@
+package kbwg
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func problemStrings(problems []PeerListProblem) (ret []string) {
+	for _, problem := range problems {
+		ret = append(ret, problem.String())
+	}
+	return ret
+}
+
+func TestValidatePeerList(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("100.0.0.0/24")
+	require.NoError(t, err)
+	_, subnet6, err := net.ParseCIDR("fd00:6b62::/64")
+	require.NoError(t, err)
+
+	list := PeerList{
+		Network: NetworkConfig{MTU: 100, DNS: []string{"100.0.0.1", "dns.example"}, KeyRotation: "10m"},
+		Peers: []PeerJSON{
+			{Username: "alice", Device: "laptop", IP: "100.0.0.1", IP6: "fd00:6b62::1"},
+			{Username: "bob", Device: "desktop", IP: "100.0.0.1"},
+			{Username: "alice", Device: "laptop", IP: "100.0.0.3"},
+			{Username: "carol", Device: "phone", IP: "100.0.1.4"},
+			{Username: "dave", Device: "", IP: "100.0.0.255"},
+			{Username: "erin", Device: "nas", IP: "100.0.0.0", IP6: "fd00:1::1"},
+			{Username: "office", Device: "router", IP: "100.0.0.7", Routes: []string{"192.168.0.0/16"}},
+			{Username: "home", Device: "router", IP: "100.0.0.8", Routes: []string{"192.168.10.0/24", "100.0.0.128/25"}},
+			{Username: "frank", Device: "pc", IP: "not an ip"},
+		},
+	}
+	require.Equal(t, []string{
+		"network.mtu 100 is out of range (576-65535)",
+		`network.dns: invalid address "dns.example"`,
+		"network.key_rotation 10m0s is shorter than 1h0m0s",
+		"peers[1]: address 100.0.0.1 is already used by peers[0]",
+		`peers[2]: device "laptop" of "alice" is already in peers[0]`,
+		"peers[3]: ip 100.0.1.4 is outside of subnet 100.0.0.0/24",
+		"peers[4]: device is missing",
+		"peers[4]: ip 100.0.0.255 is the broadcast address of subnet 100.0.0.0/24",
+		"peers[5]: ip 100.0.0.0 is the network address of subnet 100.0.0.0/24",
+		"peers[5]: ip6 fd00:1::1 is outside of subnet fd00:6b62::/64",
+		"peers[7]: route 100.0.0.128/25 overlaps with team subnet 100.0.0.0/24",
+		"peers[7]: 192.168.10.0/24 overlaps with 192.168.0.0/16 of peers[6]",
+		`peers[8]: invalid ip "not an ip"`,
+	}, problemStrings(ValidatePeerList(list, subnet, subnet6)))
+
+	list = PeerList{Peers: []PeerJSON{
+		{Username: "alice", Device: "laptop", IP: "100.0.0.1", IP6: "fd00:1::1"},
+		{Username: "bob", Device: "desktop", IP: "100.0.0.2"},
+	}}
+	require.Empty(t, ValidatePeerList(list, subnet, nil))
+}
+
+func TestCheckPeerListMembers(t *testing.T) {
+	fake := NewFakeKeybase()
+	fake.AddTeam("wgteam", "alice", "bob")
+	fake.AddDevice("bob", "desktop")
+	fake.AddDevice("mallory", "laptop")
+
+	_, subnet, err := net.ParseCIDR(DefaultSubnet)
+	require.NoError(t, err)
+	prog := &Program{
+		API:         fake.Client("alice", "laptop"),
+		KeybaseTeam: "wgteam",
+		Subnet:      subnet,
+	}
+	mctx := prog.MCtxTODO()
+
+	list := PeerList{Peers: []PeerJSON{
+		{Username: "alice", Device: "laptop", IP: "100.0.0.1"},
+		{Username: "bob", Device: "desktop", IP: "100.0.0.2"},
+	}}
+	require.NoError(t, CheckPeerList(mctx, list))
+
+	list.Peers = append(list.Peers,
+		PeerJSON{Username: "bob", Device: "phone", IP: "100.0.0.3"},
+		PeerJSON{Username: "mallory", Device: "laptop", IP: "100.0.0.4"},
+		PeerJSON{Username: "nobody", Device: "laptop", IP: "100.0.0.2"},
+	)
+	err = CheckPeerList(mctx, list)
+	var listErr *PeerListError
+	require.True(t, errors.As(err, &listErr))
+	require.Equal(t, []string{
+		`peers[2]: user "bob" has no device "phone", active devices are: ["desktop"]`,
+		`peers[3]: user "mallory" is not a member of team "wgteam"`,
+		"peers[4]: address 100.0.0.2 is already used by peers[1]",
+		`peers[4]: user "nobody" does not exist`,
+	}, problemStrings(listErr.Problems))
+}
@@ -2,27 +2,125 @@ package libpipe
 
 import "encoding/json"
 
+// ProtocolVersion is version of the pipe protocol between kb-wireguard and
+// run-dev, checked with "hello" request when run-dev starts. Bump it on
+// incompatible changes.
+const ProtocolVersion = 1
+
+// ReplyID is ID of messages that reply to requests.
+const ReplyID = "reply"
+
+// PipeMsg is a single line sent through the pipe. Messages with `Seq` are
+// requests, the other side answers each of them with a "reply" message with
+// the same `Seq`. Messages without `Seq` are one-way notifications.
 type PipeMsg struct {
 	ID      string `json:"i"`
 	Payload string `json:"p"`
+	Seq     uint64 `json:"s,omitempty"`
+	// Error of failed request, only in replies.
+	Error string `json:"e,omitempty"`
 }
 
 func SerializeMsgInterface(ID string, obj interface{}) (ret string, err error) {
+	return SerializeRequest(ID, 0, obj)
+}
+
+func SerializeMsgString(ID string, val string) (ret string, err error) {
+	return serializeMsg(PipeMsg{
+		ID:      ID,
+		Payload: val,
+	})
+}
+
+// SerializeRequest serializes request `ID` with `obj` as payload. Request
+// with `seq` 0 is a notification that does not get a reply.
+func SerializeRequest(ID string, seq uint64, obj interface{}) (ret string, err error) {
 	objBytes, err := json.Marshal(obj)
 	if err != nil {
 		return "", err
 	}
-	return SerializeMsgString(ID, string(objBytes))
+	return serializeMsg(PipeMsg{
+		ID:      ID,
+		Payload: string(objBytes),
+		Seq:     seq,
+	})
 }
 
-func SerializeMsgString(ID string, val string) (ret string, err error) {
-	pMsg := PipeMsg{
-		ID:      ID,
-		Payload: val,
+// SerializeReply serializes reply to request `seq`: `obj` as payload if
+// `replyErr` is nil, error message otherwise.
+func SerializeReply(seq uint64, obj interface{}, replyErr error) (ret string, err error) {
+	if replyErr != nil {
+		return serializeMsg(PipeMsg{
+			ID:    ReplyID,
+			Seq:   seq,
+			Error: replyErr.Error(),
+		})
 	}
-	b, err := json.Marshal(pMsg)
+	return SerializeRequest(ReplyID, seq, obj)
+}
+
+func serializeMsg(msg PipeMsg) (ret string, err error) {
+	b, err := json.Marshal(msg)
 	if err != nil {
 		return "", err
 	}
 	return string(b), nil
 }
+
+// HelloMsg is payload of "hello" request that kb-wireguard sends first, and
+// of its reply.
+type HelloMsg struct {
+	Version int `json:"version"`
+}
+
+// NetworkMsg is payload of "network" message, with network settings from
+// peers.json that run-dev applies to the device.
+type NetworkMsg struct {
+	// MTU of the device, 0 for default.
+	MTU int `json:"mtu,omitempty"`
+	// DNS servers to use while connected.
+	DNS []string `json:"dns,omitempty"`
+	// We are an exit node: forward and masquerade traffic of peers to other
+	// networks.
+	ExitNode bool `json:"exit_node,omitempty"`
+}
+
+// LaunchMsg is payload of "launch" message, sent to run-dev started with
+// `-launcher` to start another run-dev. Launcher runs as root, so it checks
+// every field before using it.
+type LaunchMsg struct {
+	// Named pipe for messages to the new run-dev.
+	Pipe string `json:"pipe"`
+	// Name of WireGuard device to create.
+	Device string `json:"device"`
+	// Addresses of the device, in CIDR notation.
+	Addresses []string `json:"addresses,omitempty"`
+	// Port WireGuard will listen on.
+	Port int `json:"port"`
+	// Team and Keybase device ID that name persistent private key in key
+	// store of run-dev. Key is not persisted if empty.
+	KeyTeam     string `json:"key_team,omitempty"`
+	KeyDeviceID string `json:"key_device_id,omitempty"`
+	// Generate new persistent key even if there is one.
+	RotateKey bool `json:"rotate_key,omitempty"`
+	// Named pipes for stdout and stderr of the new run-dev.
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+}
+
+// StatsMsg is payload of "stats" message, periodically sent by run-dev with
+// runtime state of peers read from the device.
+type StatsMsg struct {
+	Peers []PeerStats `json:"peers"`
+}
+
+// PeerStats is runtime state of a single WireGuard peer.
+type PeerStats struct {
+	PublicKey string `json:"public_key"`
+	// Endpoint the device currently uses for the peer, empty if unknown.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Unix time of the latest handshake, 0 if there was none.
+	LastHandshake int64  `json:"last_handshake"`
+	RxBytes       uint64 `json:"rx_bytes"`
+	TxBytes       uint64 `json:"tx_bytes"`
+}
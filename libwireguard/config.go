@@ -1,13 +1,36 @@
 package libwireguard
 
 import (
+	"bytes"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// WireguardConfig is configuration of WireGuard device, in the same shape
+// as `wg` and `wg-quick` config files.
 type WireguardConfig struct {
 	ListenPort uint16
 	PrivateKey WireguardPrivKey
+	// FwMark of outgoing packets, 0 for none.
+	FwMark uint32
+
+	// wg-quick settings. `wg` does not understand them, they are kept so
+	// wg-quick configs can be parsed and written back. See `StripWgQuick`.
+	Address    []string
+	DNS        []string
+	MTU        int
+	Table      string
+	PreUp      []string
+	PostUp     []string
+	PreDown    []string
+	PostDown   []string
+	SaveConfig bool
+
+	// Comment lines of [Interface] section, joined with newlines.
+	Comment string
 
 	Peers []WireguardPeer
 }
@@ -16,36 +39,452 @@ type WireguardPeer struct {
 	// NOTE: These are strings instead of complex types like net.IP or HostPort
 	// because we are sending these through pipe in JSON format. net.IP sent in
 	// JSON would become a base64 buffer and we want to keep things readable
-	// (debuggable) for now.
+	// (debuggable) for now. Keys are marshaled as base64, and malformed keys
+	// fail to unmarshal.
 
-	PublicKey           string
-	AllowedIPs          string
+	PublicKey    WireguardPubKey
+	PresharedKey WireguardPresharedKey
+	// Addresses in CIDR notation. Bare addresses are host routes (/32 or
+	// /128).
+	AllowedIPs []string
+	// Empty if the peer has no known endpoint.
 	Endpoint            string
 	PersistentKeepalive int
 
+	// Label is written as a comment in [Peer] section. Comment lines are
+	// parsed into it, joined with newlines.
 	Label string
 }
 
+// WireguardPeerStats is runtime state of a peer, read from the device.
+type WireguardPeerStats struct {
+	PublicKey WireguardPubKey
+	// Current endpoint of the peer, can differ from configured one if the
+	// peer roamed. Empty if unknown.
+	Endpoint string
+	// Unix time of the latest handshake, 0 if there was none.
+	LastHandshake int64
+	RxBytes       uint64
+	TxBytes       uint64
+}
+
+// StripWgQuick returns `conf` without wg-quick settings, so it can be used
+// with `wg setconf` and `wg syncconf`.
+func (conf WireguardConfig) StripWgQuick() WireguardConfig {
+	return WireguardConfig{
+		ListenPort: conf.ListenPort,
+		PrivateKey: conf.PrivateKey,
+		FwMark:     conf.FwMark,
+		Comment:    conf.Comment,
+		Peers:      conf.Peers,
+	}
+}
+
+// SerializeConfig writes `conf` in `wg-quick` config format. Settings that
+// are not set are left out, so configs without wg-quick settings can be used
+// with `wg` as well.
 func SerializeConfig(conf WireguardConfig) string {
 	var builder strings.Builder
+	line := func(key string, value interface{}) {
+		builder.WriteString(fmt.Sprintf("%s = %v\n", key, value))
+	}
+	comment := func(text string) {
+		if text == "" {
+			return
+		}
+		for _, v := range strings.Split(text, "\n") {
+			builder.WriteString(fmt.Sprintf("# %s\n", v))
+		}
+	}
+
 	builder.WriteString("[Interface]\n")
-	builder.WriteString(fmt.Sprintf("ListenPort = %d\n", conf.ListenPort))
-	builder.WriteString(fmt.Sprintf("PrivateKey = %s\n", string(conf.PrivateKey)))
-	builder.WriteString("\n")
+	comment(conf.Comment)
+	if len(conf.Address) > 0 {
+		line("Address", strings.Join(conf.Address, ", "))
+	}
+	if conf.ListenPort != 0 {
+		line("ListenPort", conf.ListenPort)
+	}
+	if conf.FwMark != 0 {
+		line("FwMark", fmt.Sprintf("0x%x", conf.FwMark))
+	}
+	line("PrivateKey", conf.PrivateKey.Base64())
+	if len(conf.DNS) > 0 {
+		line("DNS", strings.Join(conf.DNS, ", "))
+	}
+	if conf.MTU != 0 {
+		line("MTU", conf.MTU)
+	}
+	if conf.Table != "" {
+		line("Table", conf.Table)
+	}
+	for _, hook := range []struct {
+		key      string
+		commands []string
+	}{
+		{"PreUp", conf.PreUp},
+		{"PostUp", conf.PostUp},
+		{"PreDown", conf.PreDown},
+		{"PostDown", conf.PostDown},
+	} {
+		for _, v := range hook.commands {
+			line(hook.key, v)
+		}
+	}
+	if conf.SaveConfig {
+		line("SaveConfig", true)
+	}
 
 	for _, peer := range conf.Peers {
-		builder.WriteString("[Peer]\n")
-		if peer.Label != "" {
-			builder.WriteString(fmt.Sprintf("# %s\n", peer.Label))
+		builder.WriteString("\n[Peer]\n")
+		comment(peer.Label)
+		line("PublicKey", peer.PublicKey)
+		if !peer.PresharedKey.IsZero() {
+			line("PresharedKey", peer.PresharedKey.Base64())
+		}
+		if len(peer.AllowedIPs) > 0 {
+			line("AllowedIPs", strings.Join(peer.AllowedIPs, ", "))
+		}
+		if peer.Endpoint != "" {
+			line("Endpoint", peer.Endpoint)
 		}
-		builder.WriteString(fmt.Sprintf("PublicKey = %s\n", peer.PublicKey))
-		builder.WriteString(fmt.Sprintf("AllowedIPs = %s\n", peer.AllowedIPs))
-		builder.WriteString(fmt.Sprintf("Endpoint = %s\n", peer.Endpoint))
 		if peer.PersistentKeepalive != 0 {
-			builder.WriteString(fmt.Sprintf("PersistentKeepalive = %d\n", peer.PersistentKeepalive))
+			line("PersistentKeepalive", peer.PersistentKeepalive)
 		}
-		builder.WriteString("\n")
 	}
 
 	return builder.String()
 }
+
+// ParseConfig parses `wg` or `wg-quick` config. Keys are case insensitive,
+// and list values can be split across several lines. Comment lines are kept
+// in `Comment` of the interface or `Label` of the peer whose section they
+// are in, comments before the first section go to the interface. Comments
+// at the end of lines are dropped.
+func ParseConfig(text string) (ret WireguardConfig, err error) {
+	var section string
+	var comments []string
+	var peer *WireguardPeer
+	seenKeys := make(map[WireguardPubKey]bool)
+
+	endSection := func() error {
+		if section == "peer" {
+			if peer.PublicKey.IsZero() {
+				return fmt.Errorf("peer without PublicKey")
+			}
+			if seenKeys[peer.PublicKey] {
+				return fmt.Errorf("duplicate peer %s", peer.PublicKey)
+			}
+			seenKeys[peer.PublicKey] = true
+			peer.Label = strings.Join(comments, "\n")
+			ret.Peers = append(ret.Peers, *peer)
+		} else {
+			ret.Comment = strings.Join(append(strings.Split(ret.Comment, "\n"), comments...), "\n")
+			ret.Comment = strings.Trim(ret.Comment, "\n")
+		}
+		comments = nil
+		return nil
+	}
+
+	for i, line := range strings.Split(text, "\n") {
+		lineErr := func(err error) error {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			comments = append(comments, strings.TrimSpace(line[1:]))
+			continue
+		}
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if err := endSection(); err != nil {
+				return ret, lineErr(err)
+			}
+			switch name := strings.ToLower(strings.TrimSpace(line[1 : len(line)-1])); name {
+			case "interface":
+				if section != "" {
+					return ret, lineErr(fmt.Errorf("[Interface] has to be the first section"))
+				}
+			case "peer":
+				peer = &WireguardPeer{}
+			default:
+				return ret, lineErr(fmt.Errorf("unknown section %q", line))
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			return ret, lineErr(fmt.Errorf("expected `key = value`, got %q", line))
+		}
+		key := strings.TrimSpace(line[:idx])
+		value := strings.TrimSpace(line[idx+1:])
+		switch section {
+		case "interface":
+			err = parseInterfaceKey(&ret, key, value)
+		case "peer":
+			err = parsePeerKey(peer, key, value)
+		default:
+			err = fmt.Errorf("%q is not in a section", key)
+		}
+		if err != nil {
+			return ret, lineErr(err)
+		}
+	}
+	if err := endSection(); err != nil {
+		return ret, fmt.Errorf("at the end: %w", err)
+	}
+	return ret, nil
+}
+
+func parseInterfaceKey(conf *WireguardConfig, key string, value string) (err error) {
+	switch strings.ToLower(key) {
+	case "privatekey":
+		conf.PrivateKey, err = ParsePrivKey(value)
+	case "listenport":
+		var port uint64
+		port, err = strconv.ParseUint(value, 10, 16)
+		conf.ListenPort = uint16(port)
+	case "fwmark":
+		if value == "off" {
+			conf.FwMark = 0
+			return nil
+		}
+		var mark uint64
+		mark, err = strconv.ParseUint(value, 0, 32)
+		conf.FwMark = uint32(mark)
+	case "address":
+		conf.Address = append(conf.Address, splitList(value)...)
+	case "dns":
+		conf.DNS = append(conf.DNS, splitList(value)...)
+	case "mtu":
+		conf.MTU, err = strconv.Atoi(value)
+	case "table":
+		conf.Table = value
+	case "preup":
+		conf.PreUp = append(conf.PreUp, value)
+	case "postup":
+		conf.PostUp = append(conf.PostUp, value)
+	case "predown":
+		conf.PreDown = append(conf.PreDown, value)
+	case "postdown":
+		conf.PostDown = append(conf.PostDown, value)
+	case "saveconfig":
+		conf.SaveConfig, err = strconv.ParseBool(value)
+	default:
+		return fmt.Errorf("unknown [Interface] key %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
+
+func parsePeerKey(peer *WireguardPeer, key string, value string) (err error) {
+	switch strings.ToLower(key) {
+	case "publickey":
+		peer.PublicKey, err = ParsePubKey(value)
+	case "presharedkey":
+		peer.PresharedKey, err = ParsePresharedKey(value)
+	case "allowedips":
+		for _, v := range splitList(value) {
+			if _, err := ParseAllowedIP(v); err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, v)
+		}
+	case "endpoint":
+		// Can be a host name in wg-quick configs, so only the form is
+		// checked.
+		_, _, err = net.SplitHostPort(value)
+		peer.Endpoint = value
+	case "persistentkeepalive":
+		if value == "off" {
+			peer.PersistentKeepalive = 0
+			return nil
+		}
+		var keepalive uint64
+		keepalive, err = strconv.ParseUint(value, 10, 16)
+		peer.PersistentKeepalive = int(keepalive)
+	default:
+		return fmt.Errorf("unknown [Peer] key %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return nil
+}
+
+func splitList(value string) (ret []string) {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// ParseAllowedIP parses allowed IP in CIDR notation, or a bare address which
+// is a host route (/32 or /128).
+func ParseAllowedIP(str string) (*net.IPNet, error) {
+	if !strings.Contains(str, "/") {
+		ip := net.ParseIP(str)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", str)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(str)
+	return ipNet, err
+}
+
+// ConfigDiff is structural difference between two configs. Comments and
+// peer labels are not compared.
+type ConfigDiff struct {
+	// Names of [Interface] settings that changed, e.g. "ListenPort".
+	Interface []string
+	Added     []WireguardPeer
+	Removed   []WireguardPeer
+	Changed   []PeerDiff
+}
+
+// PeerDiff is a peer whose settings changed.
+type PeerDiff struct {
+	Old WireguardPeer
+	New WireguardPeer
+	// Names of settings that changed, e.g. "Endpoint".
+	Fields []string
+}
+
+// DiffConfigs compares configs. Peers are matched by public key and sorted by
+// it in the result.
+func DiffConfigs(old WireguardConfig, new WireguardConfig) (ret ConfigDiff) {
+	addIf := func(fields *[]string, changed bool, name string) {
+		if changed {
+			*fields = append(*fields, name)
+		}
+	}
+	addIf(&ret.Interface, old.ListenPort != new.ListenPort, "ListenPort")
+	addIf(&ret.Interface, old.PrivateKey != new.PrivateKey, "PrivateKey")
+	addIf(&ret.Interface, old.FwMark != new.FwMark, "FwMark")
+	addIf(&ret.Interface, !equalSets(old.Address, new.Address), "Address")
+	addIf(&ret.Interface, !equalLists(old.DNS, new.DNS), "DNS")
+	addIf(&ret.Interface, old.MTU != new.MTU, "MTU")
+	addIf(&ret.Interface, old.Table != new.Table, "Table")
+	addIf(&ret.Interface, !equalLists(old.PreUp, new.PreUp), "PreUp")
+	addIf(&ret.Interface, !equalLists(old.PostUp, new.PostUp), "PostUp")
+	addIf(&ret.Interface, !equalLists(old.PreDown, new.PreDown), "PreDown")
+	addIf(&ret.Interface, !equalLists(old.PostDown, new.PostDown), "PostDown")
+	addIf(&ret.Interface, old.SaveConfig != new.SaveConfig, "SaveConfig")
+
+	oldPeers := make(map[WireguardPubKey]WireguardPeer, len(old.Peers))
+	for _, peer := range old.Peers {
+		oldPeers[peer.PublicKey] = peer
+	}
+	newPeers := make(map[WireguardPubKey]bool, len(new.Peers))
+	for _, peer := range new.Peers {
+		newPeers[peer.PublicKey] = true
+		oldPeer, ok := oldPeers[peer.PublicKey]
+		if !ok {
+			ret.Added = append(ret.Added, peer)
+			continue
+		}
+		diff := PeerDiff{Old: oldPeer, New: peer}
+		addIf(&diff.Fields, oldPeer.PresharedKey != peer.PresharedKey, "PresharedKey")
+		addIf(&diff.Fields, !equalAllowedIPs(oldPeer.AllowedIPs, peer.AllowedIPs), "AllowedIPs")
+		addIf(&diff.Fields, oldPeer.Endpoint != peer.Endpoint, "Endpoint")
+		addIf(&diff.Fields, oldPeer.PersistentKeepalive != peer.PersistentKeepalive, "PersistentKeepalive")
+		if len(diff.Fields) > 0 {
+			ret.Changed = append(ret.Changed, diff)
+		}
+	}
+	for _, peer := range old.Peers {
+		if !newPeers[peer.PublicKey] {
+			ret.Removed = append(ret.Removed, peer)
+		}
+	}
+
+	less := func(a, b WireguardPubKey) bool {
+		return bytes.Compare(a[:], b[:]) < 0
+	}
+	sort.Slice(ret.Added, func(i, j int) bool { return less(ret.Added[i].PublicKey, ret.Added[j].PublicKey) })
+	sort.Slice(ret.Removed, func(i, j int) bool { return less(ret.Removed[i].PublicKey, ret.Removed[j].PublicKey) })
+	sort.Slice(ret.Changed, func(i, j int) bool { return less(ret.Changed[i].New.PublicKey, ret.Changed[j].New.PublicKey) })
+	return ret
+}
+
+// IsEmpty returns true if configs are the same.
+func (d ConfigDiff) IsEmpty() bool {
+	return len(d.Interface) == 0 && len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// String returns the diff as lines starting with "+" for added peers, "-"
+// for removed ones and "~" for changes.
+func (d ConfigDiff) String() string {
+	var lines []string
+	if len(d.Interface) > 0 {
+		lines = append(lines, fmt.Sprintf("~ interface: %s", strings.Join(d.Interface, ", ")))
+	}
+	for _, peer := range d.Removed {
+		lines = append(lines, fmt.Sprintf("- peer %s", peerName(peer)))
+	}
+	for _, peer := range d.Added {
+		lines = append(lines, fmt.Sprintf("+ peer %s", peerName(peer)))
+	}
+	for _, diff := range d.Changed {
+		lines = append(lines, fmt.Sprintf("~ peer %s: %s", peerName(diff.New), strings.Join(diff.Fields, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func peerName(peer WireguardPeer) string {
+	if peer.Label != "" {
+		return fmt.Sprintf("%s %s", strings.SplitN(peer.Label, "\n", 2)[0], peer.PublicKey)
+	}
+	return peer.PublicKey.String()
+}
+
+func equalLists(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalSets(a, b []string) bool {
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return equalLists(a, b)
+}
+
+// equalAllowedIPs compares allowed IPs regardless of order and of the way
+// they are written.
+func equalAllowedIPs(a, b []string) bool {
+	normalize := func(list []string) (ret []string) {
+		for _, v := range list {
+			if ipNet, err := ParseAllowedIP(v); err == nil {
+				v = ipNet.String()
+			}
+			ret = append(ret, v)
+		}
+		return ret
+	}
+	return equalSets(normalize(a), normalize(b))
+}
@@ -0,0 +1,131 @@
+package libwireguard
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testPrivKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+const testPubKey1 = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+const testPubKey2 = "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="
+const testPSK = "UQWEYEq/K/KeWaBbXJfuDSFxeR/AImH+vnjA4zM1ceU="
+
+const testConfig = `[Interface]
+# Office gateway
+Address = 10.192.122.1/24, fd00::1/64
+ListenPort = 51820
+FwMark = 0x1234
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+DNS = 10.192.122.2
+MTU = 1420
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+PostDown = iptables -D FORWARD -i %i -j ACCEPT
+
+[Peer]
+# laptop
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = UQWEYEq/K/KeWaBbXJfuDSFxeR/AImH+vnjA4zM1ceU=
+AllowedIPs = 10.192.122.3/32, 10.192.124.0/24
+Endpoint = 192.95.5.67:1234
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=
+AllowedIPs = 10.192.122.4/32
+`
+
+func TestParseConfig(t *testing.T) {
+	conf, err := ParseConfig(testConfig)
+	require.NoError(t, err)
+	require.Equal(t, testPrivKey, conf.PrivateKey.Base64())
+	require.Equal(t, uint16(51820), conf.ListenPort)
+	require.Equal(t, uint32(0x1234), conf.FwMark)
+	require.Equal(t, []string{"10.192.122.1/24", "fd00::1/64"}, conf.Address)
+	require.Equal(t, 1420, conf.MTU)
+	require.Equal(t, "Office gateway", conf.Comment)
+	require.Len(t, conf.Peers, 2)
+	require.Equal(t, "laptop", conf.Peers[0].Label)
+	require.Equal(t, testPubKey1, conf.Peers[0].PublicKey.Base64())
+	require.Equal(t, testPSK, conf.Peers[0].PresharedKey.Base64())
+	require.Equal(t, []string{"10.192.122.3/32", "10.192.124.0/24"}, conf.Peers[0].AllowedIPs)
+	require.Equal(t, 25, conf.Peers[0].PersistentKeepalive)
+	require.Equal(t, "", conf.Peers[1].Endpoint)
+	require.True(t, conf.Peers[1].PresharedKey.IsZero())
+
+	// Writing and parsing again gives the same config, and the text does not
+	// change after the first round trip.
+	text := SerializeConfig(conf)
+	require.Equal(t, testConfig, text)
+	again, err := ParseConfig(text)
+	require.NoError(t, err)
+	require.Equal(t, conf, again)
+
+	// Keys are case insensitive, lists can be split across lines.
+	conf, err = ParseConfig(`[interface]
+privatekey = ` + testPrivKey + ` # our key
+[PEER]
+PublicKey = ` + testPubKey1 + `
+AllowedIPs = 10.0.0.1
+AllowedIPs = 10.0.1.0/24,
+PersistentKeepalive = off
+`)
+	require.NoError(t, err)
+	require.Equal(t, testPrivKey, conf.PrivateKey.Base64())
+	require.Equal(t, []string{"10.0.0.1", "10.0.1.0/24"}, conf.Peers[0].AllowedIPs)
+
+	stripped := conf.StripWgQuick()
+	require.NotContains(t, SerializeConfig(stripped), "Address")
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, v := range []struct {
+		text string
+		err  string
+	}{
+		{"PrivateKey = " + testPrivKey, `line 1: "PrivateKey" is not in a section`},
+		{"[Interface]\nFoo = bar", `line 2: unknown [Interface] key "Foo"`},
+		{"[Interface]\nListenPort = 70000", `line 2: invalid ListenPort: strconv.ParseUint: parsing "70000": value out of range`},
+		{"[Interface]\nPrivateKey", "line 2: expected `key = value`, got \"PrivateKey\""},
+		{"[Wat]", `line 1: unknown section "[Wat]"`},
+		{"[Peer]\nAllowedIPs = 10.0.0.0/8", "at the end: peer without PublicKey"},
+		{"[Peer]\nPublicKey = " + testPubKey1 + "\nAllowedIPs = 10.0.0.300", `line 3: invalid AllowedIPs: invalid address "10.0.0.300"`},
+		{"[Peer]\nPublicKey = " + testPubKey1 + "\nEndpoint = 10.0.0.1", "line 3: invalid Endpoint: address 10.0.0.1: missing port in address"},
+		{"[Peer]\nPublicKey = " + testPubKey1 + "\n[Peer]\nPublicKey = " + testPubKey1, "at the end: duplicate peer " + testPubKey1},
+		{"[Peer]\nPublicKey = " + testPubKey1 + "\n[Interface]", "line 3: [Interface] has to be the first section"},
+	} {
+		_, err := ParseConfig(v.text)
+		require.EqualError(t, err, v.err, v.text)
+	}
+}
+
+func TestDiffConfigs(t *testing.T) {
+	old, err := ParseConfig(testConfig)
+	require.NoError(t, err)
+	require.True(t, DiffConfigs(old, old).IsEmpty())
+
+	new, err := ParseConfig(testConfig)
+	require.NoError(t, err)
+	new.ListenPort = 51821
+	// Same allowed IPs written differently is not a change.
+	new.Peers[0].AllowedIPs = []string{"10.192.124.0/24", "10.192.122.3"}
+	new.Peers[0].Endpoint = "192.95.5.67:4321"
+	new.Peers[0].Label = "renamed laptop"
+	new.Peers = new.Peers[:1]
+	pubKey, err := ParsePubKey(testPubKey2)
+	require.NoError(t, err)
+	pubKey[0]++
+	new.Peers = append(new.Peers, WireguardPeer{PublicKey: pubKey, AllowedIPs: []string{"10.192.122.5/32"}})
+
+	diff := DiffConfigs(old, new)
+	require.False(t, diff.IsEmpty())
+	require.Equal(t, []string{"ListenPort"}, diff.Interface)
+	require.Len(t, diff.Added, 1)
+	require.Len(t, diff.Removed, 1)
+	require.Len(t, diff.Changed, 1)
+	require.Equal(t, []string{"Endpoint"}, diff.Changed[0].Fields)
+	require.Equal(t, "~ interface: ListenPort\n"+
+		"- peer "+testPubKey2+"\n"+
+		"+ peer "+pubKey.Base64()+"\n"+
+		"~ peer renamed laptop "+testPubKey1+": Endpoint", diff.String())
+}
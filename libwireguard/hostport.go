@@ -1,10 +1,8 @@
 package libwireguard
 
 import (
-	"fmt"
 	"net"
 	"strconv"
-	"strings"
 )
 
 type HostPort struct {
@@ -20,20 +18,25 @@ func (h HostPort) IsNil() bool {
 	return h.Host == nil
 }
 
+func (h HostPort) Equal(other HostPort) bool {
+	return h.Host.Equal(other.Host) && h.Port == other.Port
+}
+
+// String returns "ip:port" for IPv4 and "[ip]:port" for IPv6 hosts.
 func (h HostPort) String() string {
-	return fmt.Sprintf("%s:%d", h.Host.String(), h.Port)
+	return net.JoinHostPort(h.Host.String(), strconv.Itoa(int(h.Port)))
 }
 
 func ParseHostPort(str string) (ret HostPort) {
-	arr := strings.Split(str, ":")
-	if len(arr) != 2 {
+	host, port, err := net.SplitHostPort(str)
+	if err != nil {
 		return ret
 	}
-	ip := net.ParseIP(arr[0])
+	ip := net.ParseIP(host)
 	if ip == nil {
 		return ret
 	}
-	v, err := strconv.ParseUint(arr[1], 10, 16)
+	v, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
 		return ret
 	}
@@ -0,0 +1,161 @@
+package libwireguard
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// KeyLen is length of WireGuard (Curve25519) keys in bytes.
+const KeyLen = 32
+
+// WireguardPrivKey is Curve25519 private key. It's marshaled to text as
+// base64, the same way `wg` prints it, but `String` does not reveal it.
+type WireguardPrivKey [KeyLen]byte
+
+// WireguardPubKey is Curve25519 public key, marshaled to text as base64.
+type WireguardPubKey [KeyLen]byte
+
+// GeneratePrivKey generates new private key, like `wg genkey`.
+func GeneratePrivKey() (ret WireguardPrivKey, err error) {
+	if _, err := rand.Read(ret[:]); err != nil {
+		return ret, fmt.Errorf("failed to generate key: %w", err)
+	}
+	// Clamp the key, as `wg genkey` does.
+	ret[0] &= 248
+	ret[31] = (ret[31] & 127) | 64
+	return ret, nil
+}
+
+// PublicKey derives public key from private key, like `wg pubkey`.
+func (pk WireguardPrivKey) PublicKey() (ret WireguardPubKey) {
+	priv, err := ecdh.X25519().NewPrivateKey(pk[:])
+	if err != nil {
+		// Only fails for keys of wrong length.
+		panic(err)
+	}
+	copy(ret[:], priv.PublicKey().Bytes())
+	return ret
+}
+
+// ParsePrivKey parses base64 encoded private key.
+func ParsePrivKey(str string) (ret WireguardPrivKey, err error) {
+	err = parseKey(str, ret[:])
+	return ret, err
+}
+
+// ParsePubKey parses base64 encoded public key.
+func ParsePubKey(str string) (ret WireguardPubKey, err error) {
+	err = parseKey(str, ret[:])
+	return ret, err
+}
+
+func parseKey(str string, dst []byte) error {
+	b, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return fmt.Errorf("invalid key %q: %w", str, err)
+	}
+	if len(b) != KeyLen {
+		return fmt.Errorf("invalid key %q: has %d bytes, expected %d", str, len(b), KeyLen)
+	}
+	copy(dst, b)
+	return nil
+}
+
+// Base64 returns the key in format used by `wg`.
+func (pk WireguardPrivKey) Base64() string {
+	return base64.StdEncoding.EncodeToString(pk[:])
+}
+
+func (pk WireguardPrivKey) String() string {
+	return "<private key>"
+}
+
+func (pk WireguardPrivKey) IsZero() bool {
+	return pk == WireguardPrivKey{}
+}
+
+func (pk WireguardPrivKey) MarshalText() ([]byte, error) {
+	return []byte(pk.Base64()), nil
+}
+
+func (pk *WireguardPrivKey) UnmarshalText(text []byte) (err error) {
+	*pk, err = ParsePrivKey(string(text))
+	return err
+}
+
+// Bytes returns raw bytes of the key.
+func (pk WireguardPubKey) Bytes() []byte {
+	return pk[:]
+}
+
+// Base64 returns the key in format used by `wg`.
+func (pk WireguardPubKey) Base64() string {
+	return base64.StdEncoding.EncodeToString(pk[:])
+}
+
+func (pk WireguardPubKey) String() string {
+	return pk.Base64()
+}
+
+func (pk WireguardPubKey) IsZero() bool {
+	return pk == WireguardPubKey{}
+}
+
+func (pk WireguardPubKey) MarshalText() ([]byte, error) {
+	return []byte(pk.Base64()), nil
+}
+
+func (pk *WireguardPubKey) UnmarshalText(text []byte) (err error) {
+	*pk, err = ParsePubKey(string(text))
+	return err
+}
+
+// WireguardPresharedKey is optional symmetric key shared by two peers, mixed
+// into their handshakes. Zero key means no preshared key, and is marshaled
+// to empty text.
+type WireguardPresharedKey [KeyLen]byte
+
+// GeneratePresharedKey generates new preshared key, like `wg genpsk`.
+func GeneratePresharedKey() (ret WireguardPresharedKey, err error) {
+	if _, err := rand.Read(ret[:]); err != nil {
+		return ret, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return ret, nil
+}
+
+// ParsePresharedKey parses base64 encoded preshared key.
+func ParsePresharedKey(str string) (ret WireguardPresharedKey, err error) {
+	err = parseKey(str, ret[:])
+	return ret, err
+}
+
+// Base64 returns the key in format used by `wg`.
+func (pk WireguardPresharedKey) Base64() string {
+	return base64.StdEncoding.EncodeToString(pk[:])
+}
+
+func (pk WireguardPresharedKey) String() string {
+	return "<preshared key>"
+}
+
+func (pk WireguardPresharedKey) IsZero() bool {
+	return pk == WireguardPresharedKey{}
+}
+
+func (pk WireguardPresharedKey) MarshalText() ([]byte, error) {
+	if pk.IsZero() {
+		return []byte{}, nil
+	}
+	return []byte(pk.Base64()), nil
+}
+
+func (pk *WireguardPresharedKey) UnmarshalText(text []byte) (err error) {
+	if len(text) == 0 {
+		*pk = WireguardPresharedKey{}
+		return nil
+	}
+	*pk, err = ParsePresharedKey(string(text))
+	return err
+}
@@ -0,0 +1,40 @@
+package libwireguard
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeys(t *testing.T) {
+	// RFC 7748, section 6.1.
+	privBytes, err := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	require.NoError(t, err)
+	var priv WireguardPrivKey
+	copy(priv[:], privBytes)
+	require.Equal(t, "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a", hex.EncodeToString(priv.PublicKey().Bytes()))
+
+	priv, err = GeneratePrivKey()
+	require.NoError(t, err)
+	require.False(t, priv.IsZero())
+	require.Equal(t, "<private key>", priv.String())
+	parsed, err := ParsePrivKey(priv.Base64())
+	require.NoError(t, err)
+	require.Equal(t, priv, parsed)
+
+	pub := priv.PublicKey()
+	b, err := json.Marshal(map[string]WireguardPubKey{"key": pub})
+	require.NoError(t, err)
+	require.Equal(t, `{"key":"`+pub.Base64()+`"}`, string(b))
+	var decoded map[string]WireguardPubKey
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	require.Equal(t, pub, decoded["key"])
+
+	for _, bad := range []string{"", "a2V5", "not base64!", pub.Base64() + "AAAA", pub.Base64()[:43]} {
+		_, err := ParsePubKey(bad)
+		require.Error(t, err, "%q", bad)
+	}
+	require.Error(t, json.Unmarshal([]byte(`{"key":"a2V5"}`), &decoded))
+}
@@ -1,9 +0,0 @@
-package libwireguard
-
-type WireguardPrivKey string
-
-func (pk WireguardPrivKey) String() string {
-	return "<private key>"
-}
-
-type WireguardPubKey string